@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// cleanedNamespace is one namespace handled by POST /admin/cleanup.
+type cleanedNamespace struct {
+	Cluster      string `json:"cluster"`
+	Namespace    string `json:"namespace"`
+	DeploymentID string `json:"deploymentID,omitempty"`
+	// Error is set if the namespace could not be deleted.
+	Error string `json:"error,omitempty"`
+}
+
+// adminCleanupResponse is returned by POST /admin/cleanup.
+type adminCleanupResponse struct {
+	UserID  string             `json:"userID"`
+	Deleted []cleanedNamespace `json:"deleted"`
+	Failed  []cleanedNamespace `json:"failed,omitempty"`
+}
+
+// adminCleanupHandler serves POST /admin/cleanup?userID=..., deleting every managed
+// namespace of the user in every cluster. In-flight deployments in those namespaces are
+// cancelled, and the deployments the namespaces belonged to are marked deleted. It requires
+// a token granting adminRole.
+func adminCleanupHandler(w http.ResponseWriter, r *http.Request) {
+	adminID, err := authenticateAdmin(r)
+	if errors.Is(err, errNotAdmin) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userID := r.URL.Query().Get("userID")
+	if userID == "" {
+		http.Error(w, "userID is required", http.StatusBadRequest)
+		return
+	}
+	logger := slog.Default().With("adminID", adminID, "userID", userID)
+	logger.Info("Cleaning up user's namespaces")
+
+	resp := adminCleanupResponse{UserID: userID, Deleted: []cleanedNamespace{}}
+	for _, c := range clusters {
+		ctx := withCluster(r.Context(), c)
+		deleted, failed := cleanupUserNamespaces(ctx, logger, userID)
+		resp.Deleted = append(resp.Deleted, deleted...)
+		resp.Failed = append(resp.Failed, failed...)
+	}
+	ip := clientIP(r)
+	for _, ns := range resp.Deleted {
+		recordAudit(ns.auditEntry(adminID, userID, auditSucceeded, ip))
+	}
+	for _, ns := range resp.Failed {
+		recordAudit(ns.auditEntry(adminID, userID, auditFailed, ip))
+	}
+	status := http.StatusOK
+	if len(resp.Failed) > 0 {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, resp)
+}
+
+// auditEntry returns the audit log entry recording the admin's deletion of the namespace.
+func (ns cleanedNamespace) auditEntry(adminID, userID, outcome, sourceIP string) auditEntry {
+	return auditEntry{
+		UserID:       adminID,
+		Action:       "admin_cleanup",
+		DeploymentID: ns.DeploymentID,
+		Namespace:    ns.Namespace,
+		Cluster:      ns.Cluster,
+		Outcome:      outcome,
+		SourceIP:     sourceIP,
+		Detail:       "namespaces of user " + userID,
+	}
+}
+
+// cleanupUserNamespaces deletes the user's managed namespaces in the cluster selected for
+// ctx. Namespaces are found by their user label, which holds a normalized user ID, and
+// confirmed by the annotation holding the exact one.
+func cleanupUserNamespaces(ctx context.Context, logger *slog.Logger, userID string) (deleted, failed []cleanedNamespace) {
+	cluster := clusterFrom(ctx).Name
+	selector := managedByLabel + "=" + managedByValue
+	if label := dnsLabel(userID); label != "" {
+		selector += "," + userIDLabel + "=" + label
+	}
+	list, err := kubeFor(ctx).CoreV1().Namespaces().List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		logger.Error("Error listing user's namespaces", "cluster", cluster, "error", err)
+		return nil, []cleanedNamespace{{Cluster: cluster, Error: "listing namespaces: " + err.Error()}}
+	}
+	for _, ns := range list.Items {
+		if ns.Annotations[userIDAnnotation] != userID {
+			continue
+		}
+		cleaned := cleanedNamespace{Cluster: cluster, Namespace: ns.Name, DeploymentID: ns.Annotations[deploymentIDAnnotation]}
+		cancelDeployment(cleaned.DeploymentID)
+		// A cancelled deployment holds the namespace until it has stopped.
+		unlock, err := lockNamespace(ctx, ns.Name)
+		if err != nil {
+			cleaned.Error = err.Error()
+			failed = append(failed, cleaned)
+			continue
+		}
+		err = deleteNamespace(ctx, logger, ns.Name)
+		unlock()
+		if err != nil {
+			cleaned.Error = err.Error()
+			failed = append(failed, cleaned)
+			continue
+		}
+		markDeploymentDeleted(ctx, logger, cleaned.DeploymentID)
+		deleted = append(deleted, cleaned)
+	}
+	return deleted, failed
+}
+
+// markDeploymentDeleted records that the namespace of the deployment with the given ID
+// has been deleted, if the deployment is known.
+func markDeploymentDeleted(ctx context.Context, logger *slog.Logger, id string) {
+	if id == "" {
+		return
+	}
+	rec, err := deploymentStore.Get(ctx, id)
+	if err != nil {
+		if !errors.Is(err, errDeploymentNotFound) {
+			logger.Error("Error loading deployment", "deploymentID", id, "error", err)
+		}
+		return
+	}
+	rec.Status = StatusDeleted
+	rec.UpdatedAt = time.Now().UTC()
+	if err := deploymentStore.Save(ctx, rec); err != nil {
+		logger.Error("Error persisting deleted deployment", "deploymentID", id, "error", err)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing JSON response: %v", err)
+	}
+}
+
+// deploymentStatusHandler serves GET /deployments/{id} with the current status of a
+// deployment owned by the authenticated user.
+func deploymentStatusHandler(w http.ResponseWriter, r *http.Request) {
+	rec, ok := ownedDeployment(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, rec)
+}
+
+// Pagination bounds for GET /deployments.
+const (
+	defaultListLimit = 50
+	maxListLimit     = 200
+)
+
+// listDeploymentsHandler serves GET /deployments?userID=...&status=...&limit=...&offset=...
+// with the authenticated user's deployment records, oldest first.
+func listDeploymentsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := authenticate(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+	if requested := query.Get("userID"); requested != "" && requested != userID {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	filter := DeploymentFilter{UserID: userID, Status: DeploymentStatus(query.Get("status")), Limit: defaultListLimit}
+	if v := query.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 || filter.Limit > maxListLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxListLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if filter.Offset, err = strconv.Atoi(v); err != nil || filter.Offset < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := deploymentStore.List(r.Context(), filter)
+	if err != nil {
+		log.Printf("Error listing deployments for %s: %v", userID, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// deleteDeploymentResponse reports the outcome of DELETE /deployments/{id}.
+type deleteDeploymentResponse struct {
+	ID        string           `json:"id"`
+	Namespace string           `json:"namespace"`
+	Status    DeploymentStatus `json:"status"`
+	Message   string           `json:"message"`
+}
+
+// deleteDeploymentHandler serves DELETE /deployments/{id}: it tears down the deployment's
+// namespace and marks the record deleted. Only the deployment's owner may delete it.
+func deleteDeploymentHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := authenticate(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	entry := auditEntry{UserID: userID, Action: "delete", DeploymentID: r.PathValue("id"), Outcome: auditFailed, SourceIP: clientIP(r)}
+	defer func() { recordAudit(entry) }()
+
+	rec, err := deploymentStore.Get(r.Context(), r.PathValue("id"))
+	if errors.Is(err, errDeploymentNotFound) {
+		http.Error(w, "deployment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading deployment %s: %v", r.PathValue("id"), err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if rec.UserID != userID {
+		entry.Outcome = auditRejected
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	entry.Namespace, entry.Cluster = rec.Namespace, rec.Cluster
+	if rec.Status == StatusDeleted {
+		entry.Outcome, entry.Detail = auditSucceeded, "already deleted"
+		writeJSON(w, http.StatusOK, deleteDeploymentResponse{ID: rec.ID, Namespace: rec.Namespace, Status: rec.Status, Message: "Deployment already deleted"})
+		return
+	}
+
+	// An in-flight deployment deletes its own namespace when cancelled.
+	if cancelDeployment(rec.ID) {
+		entry.Outcome, entry.Detail = auditSucceeded, "cancelled while in progress"
+		writeJSON(w, http.StatusAccepted, deleteDeploymentResponse{ID: rec.ID, Namespace: rec.Namespace, Status: StatusCancelled,
+			Message: "Deployment was in progress; it has been cancelled and its namespace will be removed"})
+		return
+	}
+
+	logger := slog.Default().With("deploymentID", rec.ID, "userID", userID)
+	if rec.Namespace != "" {
+		c, err := resolveCluster(rec.Cluster)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, deleteDeploymentResponse{ID: rec.ID, Namespace: rec.Namespace, Status: rec.Status,
+				Message: "Cannot reach the deployment's cluster: " + err.Error()})
+			return
+		}
+		ctx := withCluster(r.Context(), c)
+		unlock, err := lockNamespace(ctx, rec.Namespace)
+		if err != nil {
+			entry.Detail = "namespace busy"
+			writeJSON(w, http.StatusServiceUnavailable, deleteDeploymentResponse{ID: rec.ID, Namespace: rec.Namespace, Status: rec.Status,
+				Message: "Another operation on the deployment's namespace is still running; please retry shortly"})
+			return
+		}
+		err = deleteNamespace(ctx, logger, rec.Namespace)
+		unlock()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, deleteDeploymentResponse{ID: rec.ID, Namespace: rec.Namespace, Status: rec.Status,
+				Message: "Failed to delete namespace: " + err.Error()})
+			return
+		}
+	}
+	entry.Outcome = auditSucceeded
+	rec.Status = StatusDeleted
+	rec.UpdatedAt = time.Now().UTC()
+	if err := deploymentStore.Save(r.Context(), rec); err != nil {
+		logger.Error("Error persisting deleted deployment", "error", err)
+	}
+	writeJSON(w, http.StatusAccepted, deleteDeploymentResponse{ID: rec.ID, Namespace: rec.Namespace, Status: rec.Status,
+		Message: "Namespace deletion started"})
+}
+
+// maxDeploymentRequestBytes bounds the body of POST /deployments.
+const maxDeploymentRequestBytes = 1 << 20
+
+// createDeploymentResponse is returned by POST /deployments.
+type createDeploymentResponse struct {
+	ID        string `json:"id"`
+	StatusURL string `json:"statusURL"`
+	EventsURL string `json:"eventsURL"`
+	LogsURL   string `json:"logsURL"`
+}
+
+// createDeploymentHandler serves POST /deployments for clients that cannot use WebSockets.
+// It starts a deployment from a DeploymentPayload body and returns immediately; the
+// deployment's events are recorded for polling through GET /deployments/{id}/events.
+func createDeploymentHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := authenticate(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var payload DeploymentPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxDeploymentRequestBytes)).Decode(&payload); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Deploy as the authenticated user, regardless of what the payload claims.
+	payload.UserID = userID
+
+	ip := clientIP(r)
+	if wait, ok := allowDeployment(userID, ip); !ok {
+		auditDeployRequest(payload, ip, auditRejected, "rate limited")
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+		http.Error(w, "too many deployment requests", http.StatusTooManyRequests)
+		return
+	}
+	if !trackDeployment() {
+		auditDeployRequest(payload, ip, auditRejected, "server shutting down")
+		http.Error(w, "server is shutting down; please retry shortly", http.StatusServiceUnavailable)
+		return
+	}
+	deployment, err := startDeployment(traceContextFrom(context.Background(), r.Header), nil, payload, ip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	statusURL := "/deployments/" + deployment.ID
+	w.Header().Set("Location", statusURL)
+	writeJSON(w, http.StatusAccepted, createDeploymentResponse{
+		ID:        deployment.ID,
+		StatusURL: statusURL,
+		EventsURL: statusURL + "/events",
+		LogsURL:   statusURL + "/logs",
+	})
+}
+
+// ownedDeployment authenticates the request and loads the deployment named by its {id}
+// path value, writing an error response and returning ok=false unless the caller owns it.
+func ownedDeployment(w http.ResponseWriter, r *http.Request) (rec DeploymentRecord, ok bool) {
+	userID, err := authenticate(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return rec, false
+	}
+	rec, err = deploymentStore.Get(r.Context(), r.PathValue("id"))
+	if errors.Is(err, errDeploymentNotFound) {
+		http.Error(w, "deployment not found", http.StatusNotFound)
+		return rec, false
+	}
+	if err != nil {
+		log.Printf("Error loading deployment %s: %v", r.PathValue("id"), err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return rec, false
+	}
+	if rec.UserID != userID {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return rec, false
+	}
+	return rec, true
+}
+
+// afterParam parses the optional ?after=N sequence number of an events request, writing an
+// error response and returning ok=false if it is malformed.
+func afterParam(w http.ResponseWriter, r *http.Request) (after int, ok bool) {
+	v := r.URL.Query().Get("after")
+	if v == "" {
+		return 0, true
+	}
+	after, err := strconv.Atoi(v)
+	if err != nil || after < 0 {
+		http.Error(w, "after must be a non-negative integer", http.StatusBadRequest)
+		return 0, false
+	}
+	return after, true
+}
+
+// deploymentEventsHandler serves GET /deployments/{id}/events?after=N with the buffered events
+// of a deployment with sequence numbers greater than N, so clients can poll for new ones.
+func deploymentEventsHandler(w http.ResponseWriter, r *http.Request) {
+	rec, ok := ownedDeployment(w, r)
+	if !ok {
+		return
+	}
+	after, ok := afterParam(w, r)
+	if !ok {
+		return
+	}
+	events, err := eventLogFor(rec.ID, rec.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, events.since(after))
+}
+
+// deploymentLogsHandler serves GET /deployments/{id}/logs?after=N with every recorded event
+// of a deployment after sequence number N, including the log lines of its test pods, long
+// after the deployment finished. With follow=true the response is a text/event-stream that
+// continues with new events until the deployment finishes or the client goes away.
+func deploymentLogsHandler(w http.ResponseWriter, r *http.Request) {
+	rec, ok := ownedDeployment(w, r)
+	if !ok {
+		return
+	}
+	after, ok := afterParam(w, r)
+	if !ok {
+		return
+	}
+	if r.URL.Query().Get("follow") != "true" {
+		events, err := deploymentStore.Events(r.Context(), rec.ID, after)
+		if err != nil {
+			log.Printf("Error loading events of deployment %s: %v", rec.ID, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, events)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	sink := &sseSink{w: w, flusher: flusher}
+
+	// A deployment still buffering its events replays them from memory and streams the
+	// rest; an older one is replayed from the store.
+	if events, err := eventLogFor(rec.ID, rec.UserID); err == nil {
+		if events.subscribe(slog.Default(), sink, after, false) {
+			defer events.unsubscribe(slog.Default(), sink)
+			select {
+			case <-r.Context().Done():
+			case <-events.done:
+			}
+		}
+		return
+	}
+	stored, err := deploymentStore.Events(r.Context(), rec.ID, after)
+	if err != nil {
+		log.Printf("Error loading events of deployment %s: %v", rec.ID, err)
+		return
+	}
+	for _, e := range stored {
+		if err := sink.WriteJSON(e); err != nil {
+			return
+		}
+	}
+}
+
+// sseSink is an eventSink writing events to a server-sent events stream.
+type sseSink struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// WriteJSON writes v as an SSE message whose id is the event's sequence number.
+func (s *sseSink) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if e, ok := v.(Event); ok {
+		if _, err := fmt.Fprintf(s.w, "id: %d\n", e.Seq); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(s.w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveTestRequest serves a request for path as the user, or unauthenticated if user is
+// empty, through a mux routing pattern to handler.
+func serveTestRequest(t *testing.T, pattern string, handler http.HandlerFunc, method, path, user string) *httptest.ResponseRecorder {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc(pattern, handler)
+	req := httptest.NewRequest(method, path, nil)
+	if user != "" {
+		req.Header.Set("Authorization", "Bearer "+signTestToken(t, user, time.Hour))
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestDeploymentStatusHandlerRequiresOwner(t *testing.T) {
+	useTestStore(t)
+	jwtSecret = []byte("test-secret")
+	now := time.Now().UTC()
+	if err := deploymentStore.Save(context.Background(), DeploymentRecord{
+		ID: "dep-1", UserID: "alice", Status: StatusSucceeded, CreatedAt: now, UpdatedAt: now,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, user, path string
+		want             int
+	}{
+		{"unauthenticated", "", "/deployments/dep-1", http.StatusUnauthorized},
+		{"other user", "mallory", "/deployments/dep-1", http.StatusForbidden},
+		{"owner", "alice", "/deployments/dep-1", http.StatusOK},
+		{"unknown deployment", "alice", "/deployments/dep-2", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveTestRequest(t, "GET /deployments/{id}", deploymentStatusHandler, http.MethodGet, tt.path, tt.user)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeleteDeploymentHandlerNamespaceBusy(t *testing.T) {
+	useTestStore(t)
+	jwtSecret = []byte("test-secret")
+	previous := primaryCluster
+	primaryCluster = &cluster{Name: "test"}
+	t.Cleanup(func() { primaryCluster = previous })
+	now := time.Now().UTC()
+	if err := deploymentStore.Save(context.Background(), DeploymentRecord{
+		ID: "dep-1", UserID: "alice", Namespace: "ns-1", Status: StatusSucceeded, CreatedAt: now, UpdatedAt: now,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := lockNamespace(withCluster(context.Background(), primaryCluster), "ns-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("DELETE /deployments/{id}", deleteDeploymentHandler)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequestWithContext(ctx, http.MethodDelete, "/deployments/dep-1", nil)
+	req.Header.Set("Authorization", "Bearer "+signTestToken(t, "alice", time.Hour))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	stored, err := deploymentStore.Get(context.Background(), "dep-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != StatusSucceeded {
+		t.Errorf("stored status = %s, want it unchanged", stored.Status)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtSecret is the HMAC key used to verify client tokens, set from Config.JWTSecret.
+var jwtSecret []byte
+
+// bearerToken returns the token from the Authorization header, or the "token" query
+// parameter for clients (such as browsers) that cannot set headers on a WebSocket upgrade.
+func bearerToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// tokenClaims are the claims of client tokens. Roles grants extra privileges, such as
+// adminRole.
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	Roles []string `json:"roles,omitempty"`
+}
+
+// adminRole is the role that grants access to the /admin endpoints.
+const adminRole = "admin"
+
+// errNotAdmin is returned by authenticateAdmin for a valid token without adminRole.
+var errNotAdmin = errors.New("token does not grant the admin role")
+
+// parseToken validates the request's JWT and returns its claims.
+func parseToken(r *http.Request) (*tokenClaims, error) {
+	tokenString := bearerToken(r)
+	if tokenString == "" {
+		return nil, errors.New("missing bearer token")
+	}
+
+	claims := &tokenClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(*jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return claims, nil
+}
+
+// authenticate validates the request's JWT and returns the authenticated user ID from its subject claim.
+func authenticate(r *http.Request) (string, error) {
+	claims, err := parseToken(r)
+	if err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
+}
+
+// authenticateAdmin is like authenticate but also requires the token to grant adminRole,
+// returning errNotAdmin if it does not.
+func authenticateAdmin(r *http.Request) (string, error) {
+	claims, err := parseToken(r)
+	if err != nil {
+		return "", err
+	}
+	if !slices.Contains(claims.Roles, adminRole) {
+		return "", errNotAdmin
+	}
+	return claims.Subject, nil
+}
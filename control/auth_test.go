@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// tokenRequest returns a request carrying token as a bearer token.
+func tokenRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/deployments", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// signClaims signs claims with key using method.
+func signClaims(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.Claims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAuthenticate(t *testing.T) {
+	jwtSecret = []byte("test-secret")
+	valid := signTestToken(t, "alice", time.Hour)
+	// Swap the payload's subject without re-signing.
+	parts := strings.Split(valid, ".")
+	forged := signTestToken(t, "mallory", time.Hour)
+	tampered := parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2]
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"valid", valid, "alice"},
+		{"expired", signTestToken(t, "alice", -time.Minute), ""},
+		{"tampered", tampered, ""},
+		{"wrong key", signClaims(t, jwt.SigningMethodHS256, []byte("other-secret"), jwt.RegisteredClaims{
+			Subject: "alice", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}), ""},
+		{"unsigned", signClaims(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, jwt.RegisteredClaims{
+			Subject: "alice", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}), ""},
+		{"no expiry", signClaims(t, jwt.SigningMethodHS256, jwtSecret, jwt.RegisteredClaims{Subject: "alice"}), ""},
+		{"no subject", signTestToken(t, "", time.Hour), ""},
+		{"malformed", "not-a-token", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userID, err := authenticate(tokenRequest(tt.token))
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("authenticate accepted the token as %q", userID)
+				}
+				return
+			}
+			if err != nil || userID != tt.want {
+				t.Errorf("authenticate = %q, %v; want %q", userID, err, tt.want)
+			}
+		})
+	}
+
+	if _, err := authenticate(httptest.NewRequest(http.MethodGet, "/deployments", nil)); err == nil {
+		t.Error("authenticate accepted a request without a token")
+	}
+	query := httptest.NewRequest(http.MethodGet, "/ws?token="+valid, nil)
+	if userID, err := authenticate(query); err != nil || userID != "alice" {
+		t.Errorf("authenticate with a token query parameter = %q, %v; want alice", userID, err)
+	}
+}
+
+func TestAuthenticateAdmin(t *testing.T) {
+	jwtSecret = []byte("test-secret")
+	expiry := jwt.NewNumericDate(time.Now().Add(time.Hour))
+	admin := signClaims(t, jwt.SigningMethodHS256, jwtSecret, tokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "root", ExpiresAt: expiry}, Roles: []string{adminRole}})
+	if userID, err := authenticateAdmin(tokenRequest(admin)); err != nil || userID != "root" {
+		t.Errorf("authenticateAdmin = %q, %v; want root", userID, err)
+	}
+	if _, err := authenticateAdmin(tokenRequest(signTestToken(t, "alice", time.Hour))); !errors.Is(err, errNotAdmin) {
+		t.Errorf("authenticateAdmin without the admin role = %v, want errNotAdmin", err)
+	}
+}
+
+func TestWebSocketUpgradeRequiresToken(t *testing.T) {
+	srv := newWebSocketTestServer(t)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	for name, query := range map[string]string{
+		"missing": "",
+		"expired": "?token=" + signTestToken(t, "alice", -time.Minute),
+	} {
+		conn, resp, err := websocket.DefaultDialer.Dial(url+query, nil)
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s token: upgrade succeeded", name)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s token: upgrade answered %v, want 401", name, resp)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// hpaName names the HorizontalPodAutoscaler of the live production Deployment.
+const hpaName = "prod-app"
+
+// hpaTemplate is the path of the HorizontalPodAutoscaler template, set from Config.
+var hpaTemplate string
+
+// defaultTargetCPU is the CPU utilization percentage autoscaled deployments scale to hold
+// when the payload sets none.
+var defaultTargetCPU = envInt("DEFAULT_TARGET_CPU", 80)
+
+// autoscaleOptions is the validated autoscaling configuration of a deployment. A zero
+// MaxReplicas disables autoscaling.
+type autoscaleOptions struct {
+	MinReplicas int
+	MaxReplicas int
+	TargetCPU   int
+}
+
+// enabled reports whether the deployment is autoscaled.
+func (o autoscaleOptions) enabled() bool {
+	return o.MaxReplicas > 0
+}
+
+// resolveAutoscaleOptions validates the payload's autoscaling fields against maxReplicas.
+// Setting any of them enables autoscaling, which needs maxReplicas; minReplicas defaults to
+// the deployment's replicas and targetCPU to defaultTargetCPU. Helm charts bring their own
+// workloads, so they cannot be autoscaled this way.
+func resolveAutoscaleOptions(payload DeploymentPayload, resources prodResources, deployType string) (autoscaleOptions, error) {
+	if payload.MinReplicas == 0 && payload.MaxReplicas == 0 && payload.TargetCPU == 0 {
+		return autoscaleOptions{}, nil
+	}
+	if deployType == DeployTypeHelm {
+		return autoscaleOptions{}, errors.New("autoscaling is not supported for helm deployments")
+	}
+	if payload.MaxReplicas == 0 {
+		return autoscaleOptions{}, errors.New("maxReplicas is required to enable autoscaling")
+	}
+	o := autoscaleOptions{MinReplicas: payload.MinReplicas, MaxReplicas: payload.MaxReplicas, TargetCPU: payload.TargetCPU}
+	if o.MinReplicas == 0 {
+		o.MinReplicas = min(resources.Replicas, o.MaxReplicas)
+	}
+	if o.MinReplicas < 1 || o.MaxReplicas > maxReplicas || o.MinReplicas > o.MaxReplicas {
+		return o, fmt.Errorf("minReplicas and maxReplicas must satisfy 1 <= minReplicas <= maxReplicas <= %d", maxReplicas)
+	}
+	if o.TargetCPU == 0 {
+		o.TargetCPU = defaultTargetCPU
+	}
+	if o.TargetCPU < 1 || o.TargetCPU > 100 {
+		return o, errors.New("targetCPU must be a percentage between 1 and 100")
+	}
+	return o, nil
+}
+
+// hpaSubstitutions returns the substitutions for hpaTemplate scaling the color's Deployment.
+func hpaSubstitutions(namespace, color string, opts autoscaleOptions) map[string]string {
+	return map[string]string{
+		"Namespace":   namespace,
+		"Name":        hpaName,
+		"Deployment":  prodDeploymentFor(color),
+		"MinReplicas": strconv.Itoa(opts.MinReplicas),
+		"MaxReplicas": strconv.Itoa(opts.MaxReplicas),
+		"TargetCPU":   strconv.Itoa(opts.TargetCPU),
+	}
+}
+
+// applyAutoscaling points the namespace's HorizontalPodAutoscaler at the color's Deployment
+// and reports hpa_created, or, if the deployment is not autoscaled, removes one left by an
+// earlier deployment into the namespace.
+func applyAutoscaling(ctx context.Context, deployment *Deployment, namespace, color string, opts autoscaleOptions) error {
+	if !opts.enabled() {
+		err := kubeFor(ctx).AutoscalingV2().HorizontalPodAutoscalers(namespace).Delete(ctx, hpaName, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("removing autoscaler: %w", err)
+		}
+		return nil
+	}
+	if err := applyK8sTemplate(ctx, hpaTemplate, namespace, hpaSubstitutions(namespace, color, opts)); err != nil {
+		return err
+	}
+	deployment.send("hpa_created", fmt.Sprintf("Autoscaling %s between %d and %d replicas at %d%% CPU",
+		prodDeploymentFor(color), opts.MinReplicas, opts.MaxReplicas, opts.TargetCPU))
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// monitorPollMinInterval, set from Config, is the first delay of a monitor poll backoff.
+// Delays double from it up to the poll interval, so pods that finish quickly are noticed
+// quickly while long builds put less and less load on the API server.
+var monitorPollMinInterval time.Duration
+
+// pollJitter is the fraction by which each backoff delay is randomly shortened or lengthened,
+// so deployments that started together do not poll the API server in lockstep.
+const pollJitter = 0.2
+
+// pollBackoff yields exponentially growing, jittered delays between polls, capped at max.
+type pollBackoff struct {
+	delay time.Duration
+	max   time.Duration
+}
+
+// newPollBackoff returns a backoff starting at monitorPollMinInterval, or at max if that is
+// smaller, and growing to max.
+func newPollBackoff(max time.Duration) *pollBackoff {
+	return &pollBackoff{delay: min(monitorPollMinInterval, max), max: max}
+}
+
+// next returns the delay before the next poll and doubles the one after it.
+func (b *pollBackoff) next() time.Duration {
+	delay := b.delay
+	b.delay = min(b.delay*2, b.max)
+	jitter := time.Duration((rand.Float64()*2 - 1) * pollJitter * float64(delay))
+	return max(delay+jitter, 0)
+}
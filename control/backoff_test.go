@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// useMonitorPollMinInterval sets monitorPollMinInterval for the test.
+func useMonitorPollMinInterval(t *testing.T, d time.Duration) {
+	t.Helper()
+	old := monitorPollMinInterval
+	monitorPollMinInterval = d
+	t.Cleanup(func() { monitorPollMinInterval = old })
+}
+
+func TestPollBackoffGrowsToMax(t *testing.T) {
+	useMonitorPollMinInterval(t, 500*time.Millisecond)
+
+	b := newPollBackoff(5 * time.Second)
+	want := []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, base := range want {
+		got := b.next()
+		low, high := time.Duration(float64(base)*(1-pollJitter)), time.Duration(float64(base)*(1+pollJitter))
+		if got < low || got > high {
+			t.Errorf("delay %d = %s, want within [%s, %s]", i, got, low, high)
+		}
+	}
+}
+
+func TestPollBackoffStartsAtMaxWhenSmaller(t *testing.T) {
+	useMonitorPollMinInterval(t, 500*time.Millisecond)
+	b := newPollBackoff(100 * time.Millisecond)
+	if b.delay != 100*time.Millisecond {
+		t.Errorf("first delay = %s, want 100ms", b.delay)
+	}
+}
+
+func TestPollBackoffJitters(t *testing.T) {
+	useMonitorPollMinInterval(t, 500*time.Millisecond)
+	seen := map[time.Duration]bool{}
+	for range 20 {
+		seen[newPollBackoff(time.Second).next()] = true
+	}
+	if len(seen) < 2 {
+		t.Error("20 first delays were all equal; want them jittered")
+	}
+}
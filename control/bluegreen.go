@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Production versions alternate between two colors, so a new version can be brought up
+// and checked next to the live one before traffic is switched over.
+const (
+	colorBlue  = "blue"
+	colorGreen = "green"
+)
+
+// prodServiceName is the Service that routes traffic to the live production version,
+// defined by prodServiceTemplate.
+const prodServiceName = "prod-service"
+
+// versionLabel selects the color of a production version.
+const versionLabel = "version"
+
+// Blue-green settings. The previous version, or the previous release's namespace when the
+// new release is in another, is kept for blueGreenRetention after traffic moves off it, so
+// it can be switched back to quickly. rolloutTimeout is set from Config.
+var (
+	rolloutTimeout     time.Duration
+	blueGreenRetention = envDuration("BLUE_GREEN_RETENTION", 5*time.Minute)
+)
+
+// prodDeploymentFor returns the name of the production Deployment of the given color. The
+// empty color names the single Deployment used before blue-green deployments.
+func prodDeploymentFor(color string) string {
+	if color == "" {
+		return prodDeploymentName
+	}
+	return prodDeploymentName + "-" + color
+}
+
+// otherColor returns the color the next version should be deployed as.
+func otherColor(live string) string {
+	if live == colorBlue {
+		return colorGreen
+	}
+	return colorBlue
+}
+
+// liveProdVersion returns the color of the version the production Service routes to, and
+// whether there is a live version at all. A Service created before blue-green
+// deployments routes to the uncolored Deployment and reports the empty color.
+func liveProdVersion(ctx context.Context, namespace string) (color string, live bool, err error) {
+	svc, err := kubeFor(ctx).CoreV1().Services(namespace).Get(ctx, prodServiceName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return svc.Spec.Selector[versionLabel], true, nil
+}
+
+// rolloutError reports a production rollout that did not complete, with diagnostics.
+type rolloutError struct {
+	Deployment string
+	Err        error
+	Details    string
+}
+
+func (e *rolloutError) Error() string {
+	return fmt.Sprintf("rollout of %s did not complete: %v", e.Deployment, e.Err)
+}
+
+func (e *rolloutError) Unwrap() error { return e.Err }
+
+// waitForProdRollout runs kubectl rollout status on the color's Deployment until every
+// replica is updated and available, which requires passing its readiness probe, or
+// rolloutTimeout elapses, passing each status line to progress. A
+// rollout that does not complete is reported as a *rolloutError carrying the kubectl
+// output and a description of the Deployment, and one the namespace quota keeps from
+// creating pods as a *quotaExceededError as soon as the quota refuses them.
+func waitForProdRollout(ctx context.Context, namespace, color string, progress func(line string)) error {
+	name := prodDeploymentFor(color)
+	parent := ctx
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go watchQuotaFailures(ctx, namespace, name, time.Now().Truncate(time.Second), func(err *quotaExceededError) { cancel(err) })
+	selector := labels.SelectorFromSet(labels.Set{"app": prodDeploymentName, versionLabel: color}).String()
+	go watchUnschedulable(ctx, namespace, metav1.ListOptions{LabelSelector: selector}, func(err *unschedulableError) { cancel(err) })
+
+	args := append(clusterArgs(ctx, "kubectl"), "rollout", "status", "deployment/"+name, "-n", namespace, "--timeout="+rolloutTimeout.String())
+	output, err := commandRunner.Run(ctx, rolloutTimeout+30*time.Second, Command{
+		Name:   "kubectl",
+		Args:   args,
+		OnLine: progress,
+	})
+	if err == nil {
+		return nil
+	}
+	var qerr *quotaExceededError
+	if errors.As(context.Cause(ctx), &qerr) {
+		return qerr
+	}
+	var uerr *unschedulableError
+	if errors.As(context.Cause(ctx), &uerr) {
+		return uerr
+	}
+	if parent.Err() != nil {
+		return err
+	}
+	ctx = parent
+	describe, derr := runKubectl(ctx, 30*time.Second, "describe", "deployment", name, "-n", namespace)
+	if derr != nil {
+		describe = fmt.Sprintf("kubectl describe failed: %v\n%s", derr, describe)
+	}
+	details := fmt.Sprintf("=== kubectl rollout status ===\n%s\n=== kubectl describe deployment %s ===\n%s", output, name, describe)
+	if len(details) > maxDiagnosticBytes {
+		details = details[:maxDiagnosticBytes] + "\n... (truncated)"
+	}
+	return &rolloutError{Deployment: name, Err: err, Details: details}
+}
+
+// waitForProdVersionHealthy polls the health of the color's version until it answers or
+// healthCheckTimeout elapses.
+func waitForProdVersionHealthy(ctx context.Context, namespace, color string, hc healthCheck) error {
+	var lastErr error
+	err := wait.PollUntilContextTimeout(ctx, healthCheckInterval, healthCheckTimeout, true, func(ctx context.Context) (bool, error) {
+		lastErr = checkProdVersionHealthy(ctx, namespace, color, hc)
+		if lastErr != nil {
+			loggerFrom(ctx).Info("New version not healthy yet", "color", color, "error", lastErr)
+		}
+		return lastErr == nil, nil
+	})
+	if err != nil && lastErr != nil {
+		return fmt.Errorf("%s version not healthy after %s: %w", color, healthCheckTimeout, lastErr)
+	}
+	return err
+}
+
+// checkProdVersionHealthy requests the health path of a ready pod of the color's version
+// through the API server's pod proxy, since the version is not reachable through the
+// ingress until traffic is switched to it.
+func checkProdVersionHealthy(ctx context.Context, namespace, color string, hc healthCheck) error {
+	selector := labels.SelectorFromSet(labels.Set{"app": prodDeploymentName, versionLabel: color}).String()
+	pods, err := kubeFor(ctx).CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods.Items {
+		if podReady(&pod) {
+			_, err := kubeFor(ctx).CoreV1().Pods(namespace).ProxyGet("http", pod.Name, strconv.Itoa(hc.Port), hc.httpPath(), nil).DoRaw(ctx)
+			return err
+		}
+	}
+	return fmt.Errorf("no ready pods match %s", selector)
+}
+
+// podReady reports whether the pod's Ready condition is true.
+func podReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// scheduleOldVersionCleanup deletes the production Deployment of the old color once
+// blueGreenRetention has passed, unless traffic has been switched back to it meanwhile.
+func scheduleOldVersionCleanup(ctx context.Context, deployment *Deployment, namespace, oldColor string) {
+	go func() {
+		time.Sleep(blueGreenRetention)
+		unlock, err := lockNamespace(context.WithoutCancel(ctx), namespace)
+		if err != nil {
+			return
+		}
+		defer unlock()
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+
+		if color, live, err := liveProdVersion(ctx, namespace); err != nil {
+			deployment.logger.Error("Error checking live version before cleanup", "error", err)
+			return
+		} else if live && color == oldColor {
+			deployment.logger.Info("Old version is live again, keeping it", "color", oldColor)
+			return
+		}
+		name := prodDeploymentFor(oldColor)
+		err = kubeFor(ctx).AppsV1().Deployments(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			deployment.logger.Error("Error deleting old version", "deployment", name, "error", err)
+			return
+		}
+		deployment.send("old_version_cleaned", fmt.Sprintf("Removed previous version %s", name))
+	}()
+}
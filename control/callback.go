@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Completion callback settings, set from Config. callbackSecret signs every callback, and
+// callbacks are refused while it is empty. A failed callback is retried up to
+// callbackAttempts attempts in all, the delay between them doubling from callbackRetryDelay.
+var (
+	callbackSecret     []byte
+	callbackAttempts   int
+	callbackRetryDelay time.Duration
+)
+
+// maxCallbackURLLength bounds callback URLs.
+const maxCallbackURLLength = 2048
+
+// Headers of callback requests. The signature is "sha256=" and the hex HMAC-SHA256, keyed
+// with callbackSecret, of the timestamp header's value, a period, and the request body.
+// Receivers should recompute it, and may reject stale timestamps to prevent replays.
+const (
+	callbackSignatureHeader = "X-Signature-256"
+	callbackTimestampHeader = "X-Callback-Timestamp"
+)
+
+// validateCallbackURL checks that a callback URL is an https URL of a public host.
+func validateCallbackURL(raw string) error {
+	if len(callbackSecret) == 0 {
+		return errors.New("completion callbacks are not enabled on this server")
+	}
+	if len(raw) > maxCallbackURLLength {
+		return fmt.Errorf("callback URL exceeds %d characters", maxCallbackURLLength)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("malformed callback URL: %w", err)
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("unsupported callback URL scheme %q: only https is allowed", u.Scheme)
+	}
+	if u.User != nil {
+		return errors.New("callback URL must not contain credentials")
+	}
+	return validateRepoHost(u.Hostname())
+}
+
+// publicDialer refuses connections to internal addresses, so a public hostname resolving
+// to one cannot be used to reach the cluster network from the control server.
+var publicDialer = &net.Dialer{
+	Timeout: 10 * time.Second,
+	Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		return validateRepoHost(host)
+	},
+}
+
+// callbackClient sends callbacks. It connects only to public addresses and does not follow
+// redirects, which could point anywhere.
+var callbackClient = &http.Client{
+	Timeout:   15 * time.Second,
+	Transport: &http.Transport{DialContext: publicDialer.DialContext, TLSHandshakeTimeout: 10 * time.Second},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// callbackPayload is the body of a completion callback.
+type callbackPayload struct {
+	// Event is deployment_finished when the deployment finishes, and ttl_expired when its
+	// namespace is deleted for reaching its TTL.
+	Event        string           `json:"event"`
+	DeploymentID string           `json:"deploymentID"`
+	Status       DeploymentStatus `json:"status"`
+	RepoURL      string           `json:"repoURL"`
+	CommitHash   string           `json:"commitHash"`
+	Endpoint     string           `json:"endpoint,omitempty"`
+	// ErrorCode and Error describe why a failed deployment failed.
+	ErrorCode  errorCode `json:"errorCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// sendCallback delivers the finished deployment's outcome to its callback URL, if it has
+// one, in the background.
+func (d *Deployment) sendCallback() {
+	if d.callbackURL == "" {
+		return
+	}
+	rec := deployments.Record(d)
+	payload := callbackPayload{
+		Event:        "deployment_finished",
+		DeploymentID: rec.ID,
+		Status:       rec.Status,
+		RepoURL:      rec.RepoURL,
+		CommitHash:   rec.CommitHash,
+		Endpoint:     rec.Endpoint,
+		FinishedAt:   rec.UpdatedAt,
+	}
+	if rec.Status == StatusFailed {
+		events := d.events.since(0)
+		for i := len(events) - 1; i >= 0; i-- {
+			if events[i].Code != "" {
+				payload.ErrorCode, payload.Error = events[i].Code, events[i].Message
+				break
+			}
+		}
+	}
+	go deliverCallback(context.Background(), d.logger, d.callbackURL, payload)
+}
+
+// deliverCallback POSTs the signed payload to target, retrying network errors, 429 and 5xx
+// responses with exponential backoff. Other responses are final.
+func deliverCallback(ctx context.Context, logger *slog.Logger, target string, payload callbackPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	delay := callbackRetryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := postCallback(ctx, target, body)
+		if err == nil {
+			logger.Info("Delivered completion callback", "attempt", attempt)
+			return nil
+		}
+		if !retry || attempt >= callbackAttempts {
+			logger.Error("Failed to deliver completion callback", "attempt", attempt, "error", err)
+			return err
+		}
+		logger.Warn("Completion callback failed, retrying", "attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// postCallback makes one delivery attempt, reporting whether a failure is worth retrying.
+func postCallback(ctx context.Context, target string, body []byte) (retry bool, err error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(callbackTimestampHeader, timestamp)
+	req.Header.Set(callbackSignatureHeader, signCallback(timestamp, body))
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("callback answered %s", resp.Status)
+	}
+	return false, fmt.Errorf("callback answered %s", resp.Status)
+}
+
+// signCallback returns the signature header value of a callback body sent at timestamp.
+func signCallback(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, callbackSecret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
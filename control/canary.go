@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Canary rollouts send a share of the app's stable hostname traffic to the new version
+// through a weighted canary ingress and service in the new release's namespace, watch its
+// health for a bake period, then promote or roll back. The rest of the traffic stays with
+// the release the hostname already serves, which may be in another namespace.
+const (
+	canaryServiceName = "prod-service-canary"
+	canaryIngressName = "prod-ingress-canary"
+)
+
+// canaryIngressTemplate is the path of the canary ingress template, set from Config.
+var canaryIngressTemplate string
+
+// Canary bake time default and maximum, and how often the canary's health is checked,
+// which is set from Config.
+var (
+	defaultCanaryBakeTime = envDuration("CANARY_BAKE_TIME", 5*time.Minute)
+	maxCanaryBakeTime     = envDuration("MAX_CANARY_BAKE_TIME", time.Hour)
+	canaryCheckInterval   time.Duration
+)
+
+// canaryOptions is the validated canary configuration of a deployment. A zero Percent
+// disables the canary.
+type canaryOptions struct {
+	Percent  int
+	BakeTime time.Duration
+}
+
+// resolveCanaryOptions validates the payload's canary fields and applies the default bake time.
+func resolveCanaryOptions(payload DeploymentPayload) (canaryOptions, error) {
+	opts := canaryOptions{Percent: payload.CanaryPercent, BakeTime: defaultCanaryBakeTime}
+	if opts.Percent < 0 || opts.Percent > 99 {
+		return opts, errors.New("canaryPercent must be between 1 and 99, or 0 to disable the canary")
+	}
+	if payload.CanaryBakeSeconds < 0 {
+		return opts, errors.New("canaryBakeSeconds must not be negative")
+	}
+	if payload.CanaryBakeSeconds > 0 {
+		opts.BakeTime = time.Duration(payload.CanaryBakeSeconds) * time.Second
+	}
+	if opts.BakeTime > maxCanaryBakeTime {
+		return opts, fmt.Errorf("canary bake time %s exceeds the maximum of %s", opts.BakeTime, maxCanaryBakeTime)
+	}
+	return opts, nil
+}
+
+// canaryIngressSubstitutions returns the substitutions for canaryIngressTemplate, splitting
+// the traffic of host.
+func canaryIngressSubstitutions(namespace, host string, percent int) map[string]string {
+	return map[string]string{
+		"Namespace":   namespace,
+		"IngressName": canaryIngressName,
+		"ServiceName": canaryServiceName,
+		"Host":        host,
+		"Weight":      strconv.Itoa(percent),
+	}
+}
+
+// canaryBaseline returns the release the app's stable hostname serves, for a canary of a
+// new release in cluster c to share its traffic with. It fails if the app has no release
+// yet, if that release is in another cluster, whose ingress the canary cannot join, or if
+// its production version is no longer ready.
+func canaryBaseline(ctx context.Context, userID, repoURL string, c *cluster) (release, error) {
+	live, ok := currentRelease(userID, repoURL)
+	if !ok {
+		return live, errors.New("the app has no live release to compare against")
+	}
+	if live.Cluster.Name != c.Name {
+		return live, fmt.Errorf("the live release %s runs in cluster %s", live.DeploymentID, live.Cluster.Name)
+	}
+	if err := checkProdDeploymentReady(withCluster(ctx, live.Cluster), live.Namespace); err != nil {
+		return live, fmt.Errorf("the live release %s is not ready: %w", live.DeploymentID, err)
+	}
+	return live, nil
+}
+
+// runCanary routes opts.Percent of the traffic of the live release's hostname to the
+// color's version and checks its health every canaryCheckInterval for the bake time,
+// reporting canary_progress events. The canary routing is removed afterwards whether or not
+// the canary stayed healthy; the caller promotes or rolls back the version depending on the
+// returned error.
+func runCanary(ctx context.Context, deployment *Deployment, namespace, color string, live release, hc healthCheck, opts canaryOptions) error {
+	defer removeCanary(ctx, deployment, namespace)
+
+	if err := applyK8sTemplate(ctx, prodServiceTemplate, namespace, prodServiceSubstitutions(namespace, canaryServiceName, color)); err != nil {
+		return fmt.Errorf("creating canary service: %w", err)
+	}
+	if err := applyK8sTemplate(ctx, canaryIngressTemplate, namespace, canaryIngressSubstitutions(namespace, live.Host, opts.Percent)); err != nil {
+		return fmt.Errorf("creating canary ingress: %w", err)
+	}
+	deployment.send("canary_progress", fmt.Sprintf("Canary started: %d%% of https://%s traffic goes to the %s version for %s, the rest to deployment %s",
+		opts.Percent, live.Host, color, opts.BakeTime, live.DeploymentID))
+
+	startedAt := time.Now()
+	ticker := time.NewTicker(canaryCheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := checkProdVersionHealthy(ctx, namespace, color, hc); err != nil {
+			return fmt.Errorf("canary became unhealthy after %s: %w", time.Since(startedAt).Round(time.Second), err)
+		}
+		elapsed := time.Since(startedAt)
+		if elapsed >= opts.BakeTime {
+			return nil
+		}
+		deployment.send("canary_progress", fmt.Sprintf("Canary healthy for %s of %s", elapsed.Round(time.Second), opts.BakeTime))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// removeCanary deletes the canary ingress and service, logging failures.
+func removeCanary(ctx context.Context, deployment *Deployment, namespace string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	err := kubeFor(ctx).NetworkingV1().Ingresses(namespace).Delete(ctx, canaryIngressName, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		deployment.logger.Error("Error deleting canary ingress", "error", err)
+	}
+	err = kubeFor(ctx).CoreV1().Services(namespace).Delete(ctx, canaryServiceName, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		deployment.logger.Error("Error deleting canary service", "error", err)
+	}
+}
+
+// rollBackCanary deletes the Deployment of a canary version that failed, leaving the live
+// release serving all traffic.
+func rollBackCanary(ctx context.Context, deployment *Deployment, namespace, color string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	err := kubeFor(ctx).AppsV1().Deployments(namespace).Delete(ctx, prodDeploymentFor(color), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		deployment.logger.Error("Error deleting failed canary version", "error", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// useTestReleaseHistory replaces the release history for the test.
+func useTestReleaseHistory(t *testing.T, history map[string][]release) {
+	t.Helper()
+	releaseHistoryMu.Lock()
+	previous := releaseHistory
+	releaseHistory = history
+	releaseHistoryMu.Unlock()
+	t.Cleanup(func() {
+		releaseHistoryMu.Lock()
+		releaseHistory = previous
+		releaseHistoryMu.Unlock()
+	})
+}
+
+// liveProdObjects returns the service and ready deployment of a namespace whose blue
+// production version is live.
+func liveProdObjects(namespace string) []runtime.Object {
+	return []runtime.Object{
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: prodServiceName, Namespace: namespace},
+			Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": prodDeploymentName, versionLabel: colorBlue}},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: prodDeploymentFor(colorBlue), Namespace: namespace},
+			Status:     appsv1.DeploymentStatus{Replicas: 1, ReadyReplicas: 1},
+		},
+	}
+}
+
+func TestCanaryBaselineIsTheLiveRelease(t *testing.T) {
+	c := &cluster{Name: "test", Client: fake.NewSimpleClientset(liveProdObjects("app-old")...)}
+	live := release{DeploymentID: "dep-old", Cluster: c, Namespace: "app-old", Host: "app.example.com"}
+	useTestReleaseHistory(t, map[string][]release{appKey("alice", "https://github.com/a/app"): {live}})
+
+	got, err := canaryBaseline(context.Background(), "alice", "https://github.com/a/app", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Namespace != "app-old" || got.Host != "app.example.com" {
+		t.Errorf("baseline = %+v, want the live release", got)
+	}
+	// The canary splits the stable hostname the live release serves, not the new
+	// namespace's own hostname.
+	if host := canaryIngressSubstitutions("app-new", got.Host, 10)["Host"]; host != "app.example.com" {
+		t.Errorf("canary ingress host = %q, want app.example.com", host)
+	}
+}
+
+func TestCanaryBaselineUnavailable(t *testing.T) {
+	c := &cluster{Name: "test", Client: fake.NewSimpleClientset(liveProdObjects("app-old")...)}
+	other := &cluster{Name: "other", Client: fake.NewSimpleClientset()}
+	tests := []struct {
+		name    string
+		history []release
+		want    string
+	}{
+		{"first release", nil, "no live release"},
+		{"other cluster", []release{{DeploymentID: "dep-old", Cluster: other, Namespace: "app-old"}}, "runs in cluster other"},
+		{"not ready", []release{{DeploymentID: "dep-old", Cluster: c, Namespace: "app-gone"}}, "is not ready"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestReleaseHistory(t, map[string][]release{appKey("alice", "repo"): tt.history})
+			_, err := canaryBaseline(context.Background(), "alice", "repo", c)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("canaryBaseline error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Namespace capacity settings, set from Config. maxNamespaces caps the managed namespaces
+// active in each cluster at once, 0 leaving them unlimited; deployments that would create
+// one more wait, rechecking every capacityPollInterval, until one is deleted.
+var (
+	maxNamespaces        int
+	capacityPollInterval time.Duration
+)
+
+// namespaceCapacity admits deployments to create namespaces while each cluster is under
+// maxNamespaces, in the order they asked. Admitted deployments hold a reservation until
+// their namespace has been created and is counted by the cluster itself.
+type namespaceCapacity struct {
+	mu       sync.Mutex
+	reserved map[string]int
+	waiting  map[string][]*Deployment
+}
+
+var namespaceCapacityGate = &namespaceCapacity{reserved: map[string]int{}, waiting: map[string][]*Deployment{}}
+
+// countManagedNamespaces counts the managed namespaces of the cluster selected for ctx,
+// leaving out those already being deleted.
+func countManagedNamespaces(ctx context.Context) (int, error) {
+	list, err := kubeFor(ctx).CoreV1().Namespaces().List(ctx, metav1.ListOptions{
+		LabelSelector: managedByLabel + "=" + managedByValue,
+	})
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, ns := range list.Items {
+		if ns.Status.Phase != corev1.NamespaceTerminating {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// waitForNamespaceCapacity waits until the deployment may create a namespace in the cluster
+// selected for ctx, sending capacity_wait to its client if it has to. The returned function
+// releases the reservation and must be called once the namespace has been created, or its
+// creation has failed.
+func (d *Deployment) waitForNamespaceCapacity(ctx context.Context) (release func(), err error) {
+	if maxNamespaces <= 0 {
+		return func() {}, nil
+	}
+	g := namespaceCapacityGate
+	cluster := clusterFrom(ctx).Name
+	g.mu.Lock()
+	g.waiting[cluster] = append(g.waiting[cluster], d)
+	g.mu.Unlock()
+	defer g.leave(cluster, d)
+
+	ticker := time.NewTicker(capacityPollInterval)
+	defer ticker.Stop()
+	notified := false
+	for {
+		count, err := countManagedNamespaces(ctx)
+		if err != nil {
+			d.logger.Error("Error counting managed namespaces", "error", err)
+		} else if g.admit(cluster, d, count) {
+			return g.releaser(cluster), nil
+		} else if !notified {
+			notified = true
+			d.logger.Info("Waiting for namespace capacity", "namespaces", count, "limit", maxNamespaces)
+			d.send("capacity_wait", fmt.Sprintf("The cluster is at its limit of %d namespaces; your deployment will start once one frees up", maxNamespaces))
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// admit reserves a namespace for d if the cluster, with count namespaces, has room for it
+// and for every deployment that has waited longer.
+func (g *namespaceCapacity) admit(cluster string, d *Deployment, count int) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	position := slices.Index(g.waiting[cluster], d)
+	if position < 0 || count+g.reserved[cluster]+position >= maxNamespaces {
+		return false
+	}
+	g.reserved[cluster]++
+	return true
+}
+
+// leave removes d from the cluster's waiting deployments.
+func (g *namespaceCapacity) leave(cluster string, d *Deployment) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if i := slices.Index(g.waiting[cluster], d); i >= 0 {
+		g.waiting[cluster] = slices.Delete(g.waiting[cluster], i, i+1)
+	}
+	if len(g.waiting[cluster]) == 0 {
+		delete(g.waiting, cluster)
+	}
+}
+
+func (g *namespaceCapacity) releaser(cluster string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			if g.reserved[cluster]--; g.reserved[cluster] == 0 {
+				delete(g.reserved, cluster)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/kubernetes"
+)
+
+// defaultClusterName names the single cluster used when CLUSTERS is not set.
+const defaultClusterName = "default"
+
+// cluster is a Kubernetes cluster deployments can be sent to.
+type cluster struct {
+	Name string
+	// Context is the kubeconfig context selecting the cluster, or empty for the in-cluster
+	// config or the kubeconfig's current context.
+	Context string
+	// Kubeconfig is the kubeconfig file holding Context, or empty for the ambient one.
+	Kubeconfig string
+	Client     kubernetes.Interface
+}
+
+// kubeconfigPath and kubeContext are the explicitly configured kubeconfig file and, for the
+// single cluster used without CLUSTERS, its context. Both are set from Config.
+var (
+	kubeconfigPath string
+	kubeContext    string
+)
+
+// clusters holds the configured clusters by name, and primaryCluster is the one that
+// deployments target when they name none. Both are initialized by loadClusters.
+var (
+	clusters       = map[string]*cluster{}
+	primaryCluster *cluster
+)
+
+// parseClusterContexts parses a comma-separated list of name=context pairs.
+func parseClusterContexts(value string) (map[string]string, error) {
+	contexts := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, kubeContext, ok := strings.Cut(entry, "=")
+		name, kubeContext = strings.TrimSpace(name), strings.TrimSpace(kubeContext)
+		if !ok || name == "" || kubeContext == "" {
+			return nil, fmt.Errorf("malformed CLUSTERS entry %q: want name=context", entry)
+		}
+		if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+			return nil, fmt.Errorf("cluster name %q is invalid: %s", name, strings.Join(errs, "; "))
+		}
+		if _, dup := contexts[name]; dup {
+			return nil, fmt.Errorf("cluster %q is listed twice in CLUSTERS", name)
+		}
+		contexts[name] = kubeContext
+	}
+	return contexts, nil
+}
+
+// loadClusters builds a client for each cluster in CLUSTERS, a comma-separated list of
+// name=context pairs mapping cluster names to contexts of kubeconfigPath, and selects
+// PRIMARY_CLUSTER as the default. Without CLUSTERS there is one cluster, reached through
+// kubeContext, or else the in-cluster config or the kubeconfig's current context.
+// kubeClient is set to the primary cluster's client.
+func loadClusters() error {
+	contexts, err := parseClusterContexts(os.Getenv("CLUSTERS"))
+	if err != nil {
+		return err
+	}
+	if len(contexts) == 0 {
+		contexts[defaultClusterName] = kubeContext
+	} else if kubeContext != "" {
+		return errors.New("KUBE_CONTEXT cannot be combined with CLUSTERS, which names each cluster's context")
+	}
+	primary := os.Getenv("PRIMARY_CLUSTER")
+	if primary == "" {
+		if len(contexts) > 1 {
+			return errors.New("PRIMARY_CLUSTER must be set when CLUSTERS lists more than one cluster")
+		}
+		for name := range contexts {
+			primary = name
+		}
+	}
+	if _, ok := contexts[primary]; !ok {
+		return fmt.Errorf("PRIMARY_CLUSTER %q is not listed in CLUSTERS", primary)
+	}
+
+	for name, kubeContext := range contexts {
+		client, err := newKubeClient(kubeconfigPath, kubeContext)
+		if err != nil {
+			return fmt.Errorf("cluster %s: %w", name, err)
+		}
+		clusters[name] = &cluster{Name: name, Context: kubeContext, Kubeconfig: kubeconfigPath, Client: client}
+	}
+	primaryCluster = clusters[primary]
+	kubeClient = primaryCluster.Client
+	return nil
+}
+
+// checkClusters makes sure the Kubernetes API of every cluster is reachable with the
+// configured credentials, logging the version each one runs.
+func checkClusters(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	var errs []error
+	for _, name := range clusterNames() {
+		version, err := clusters[name].serverVersion(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cluster %s: %w", name, err))
+			continue
+		}
+		log.Printf("Connected to cluster %s (context %q), Kubernetes %s", name, clusters[name].Context, version.GitVersion)
+	}
+	return errors.Join(errs...)
+}
+
+// serverVersion asks the cluster's Kubernetes API for its version.
+func (c *cluster) serverVersion(ctx context.Context) (*version.Info, error) {
+	body, err := c.Client.Discovery().RESTClient().Get().AbsPath("/version").DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var info version.Info
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, fmt.Errorf("decoding server version: %w", err)
+	}
+	return &info, nil
+}
+
+// clusterNames returns the names of the configured clusters, sorted.
+func clusterNames() []string {
+	names := make([]string, 0, len(clusters))
+	for name := range clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolveCluster returns the named cluster, or the primary cluster when name is empty.
+func resolveCluster(name string) (*cluster, error) {
+	if name == "" {
+		return primaryCluster, nil
+	}
+	c, ok := clusters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster %q: must be one of %s", name, strings.Join(clusterNames(), ", "))
+	}
+	return c, nil
+}
+
+type clusterKey struct{}
+
+// withCluster returns a context whose Kubernetes calls and kubectl and helm commands target c.
+func withCluster(ctx context.Context, c *cluster) context.Context {
+	return context.WithValue(ctx, clusterKey{}, c)
+}
+
+// clusterFrom returns the cluster selected for ctx, or the primary cluster if none is.
+func clusterFrom(ctx context.Context) *cluster {
+	if c, ok := ctx.Value(clusterKey{}).(*cluster); ok {
+		return c
+	}
+	return primaryCluster
+}
+
+// kubeFor returns the Kubernetes client of the cluster selected for ctx.
+func kubeFor(ctx context.Context) kubernetes.Interface {
+	if c := clusterFrom(ctx); c != nil {
+		return c.Client
+	}
+	return kubeClient
+}
+
+// clusterArgs returns the flags pointing a kubectl or helm command at the kubeconfig and
+// context of the cluster selected for ctx. Other commands need none.
+func clusterArgs(ctx context.Context, command string) []string {
+	c := clusterFrom(ctx)
+	if c == nil {
+		return nil
+	}
+	var contextFlag string
+	switch command {
+	case "kubectl":
+		contextFlag = "--context"
+	case "helm":
+		contextFlag = "--kube-context"
+	default:
+		return nil
+	}
+	var args []string
+	if c.Kubeconfig != "" {
+		args = append(args, "--kubeconfig", c.Kubeconfig)
+	}
+	if c.Context != "" {
+		args = append(args, contextFlag, c.Context)
+	}
+	return args
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the control server's configuration, loaded once at startup by loadConfig. Each
+// setting starts at its default, may be set in the JSON or YAML file named by CONFIG_FILE,
+// and is overridden by the environment variable in its env tag.
+//
+// Settings that only tune a single feature, such as canary bake times or quota tiers, are
+// read from their own environment variables instead.
+type Config struct {
+	// Server settings.
+	ListenAddr   string `json:"listenAddr" env:"LISTEN_ADDR"`
+	BaseDomain   string `json:"baseDomain" env:"BASE_DOMAIN"`
+	DatabasePath string `json:"databasePath" env:"DATABASE_PATH"`
+	JWTSecret    string `json:"jwtSecret" env:"JWT_SECRET"`
+
+	// Completion callbacks. CallbackSecret signs completion callbacks; deployments may only ask for callbacks
+	// while it is set. CallbackAttempts and CallbackRetryDelay control their retries.
+	CallbackSecret     string   `json:"callbackSecret" env:"CALLBACK_SECRET"`
+	CallbackAttempts   int      `json:"callbackAttempts" env:"CALLBACK_ATTEMPTS"`
+	CallbackRetryDelay duration `json:"callbackRetryDelay" env:"CALLBACK_RETRY_DELAY"`
+
+	// Concurrency limits.
+	WorkerPoolSize        int `json:"workerPoolSize" env:"WORKER_POOL_SIZE"`
+	MaxDeploymentsPerUser int `json:"maxDeploymentsPerUser" env:"MAX_DEPLOYMENTS_PER_USER"`
+
+	// Namespace capacity. MaxNamespaces caps the managed namespaces active in each cluster,
+	// 0 leaving them unlimited; CapacityPollInterval is how often waiting deployments recheck.
+	MaxNamespaces        int      `json:"maxNamespaces" env:"MAX_NAMESPACES"`
+	CapacityPollInterval duration `json:"capacityPollInterval" env:"CAPACITY_POLL_INTERVAL"`
+
+	// Deployment rate limits. Each user and each client IP may start a burst of deployments
+	// at once, after which they may start the given number per minute; a rate of 0 disables
+	// the limit.
+	DeployRatePerUser  int `json:"deployRatePerUser" env:"DEPLOY_RATE_PER_USER"`
+	DeployBurstPerUser int `json:"deployBurstPerUser" env:"DEPLOY_BURST_PER_USER"`
+	DeployRatePerIP    int `json:"deployRatePerIP" env:"DEPLOY_RATE_PER_IP"`
+	DeployBurstPerIP   int `json:"deployBurstPerIP" env:"DEPLOY_BURST_PER_IP"`
+
+	// ImageCheck makes deployments of prebuilt images check that the image exists in its
+	// registry, giving up on the registry after ImageCheckTimeout.
+	ImageCheck        bool     `json:"imageCheck" env:"IMAGE_CHECK"`
+	ImageCheckTimeout duration `json:"imageCheckTimeout" env:"IMAGE_CHECK_TIMEOUT"`
+
+	// Timeouts.
+	DeploymentTimeout    duration `json:"deploymentTimeout" env:"DEPLOYMENT_TIMEOUT"`
+	MonitorTimeout       duration `json:"monitorTimeout" env:"MONITOR_TIMEOUT"`
+	MaxMonitorTimeout    duration `json:"maxMonitorTimeout" env:"MAX_MONITOR_TIMEOUT"`
+	RolloutTimeout       duration `json:"rolloutTimeout" env:"ROLLOUT_TIMEOUT"`
+	ReplicasReadyTimeout duration `json:"replicasReadyTimeout" env:"REPLICAS_READY_TIMEOUT"`
+	UnschedulableGrace   duration `json:"unschedulableGrace" env:"UNSCHEDULABLE_GRACE"`
+	MaxDeploymentTTL     duration `json:"maxDeploymentTTL" env:"MAX_DEPLOYMENT_TTL"`
+	IngressTimeout       duration `json:"ingressTimeout" env:"INGRESS_TIMEOUT"`
+	HealthCheckTimeout   duration `json:"healthCheckTimeout" env:"HEALTH_CHECK_TIMEOUT"`
+	HelmTimeout          duration `json:"helmTimeout" env:"HELM_TIMEOUT"`
+	CertificateTimeout   duration `json:"certificateTimeout" env:"CERTIFICATE_TIMEOUT"`
+	RefResolveTimeout    duration `json:"refResolveTimeout" env:"REF_RESOLVE_TIMEOUT"`
+	ShutdownGracePeriod  duration `json:"shutdownGracePeriod" env:"SHUTDOWN_GRACE_PERIOD"`
+
+	// Poll intervals. Monitor polls back off from MonitorPollMinInterval to
+	// MonitorPollInterval.
+	MonitorPollMinInterval duration `json:"monitorPollMinInterval" env:"MONITOR_POLL_MIN_INTERVAL"`
+	MonitorPollInterval    duration `json:"monitorPollInterval" env:"MONITOR_POLL_INTERVAL"`
+	HealthCheckInterval    duration `json:"healthCheckInterval" env:"HEALTH_CHECK_INTERVAL"`
+	CanaryCheckInterval    duration `json:"canaryCheckInterval" env:"CANARY_CHECK_INTERVAL"`
+	NamespaceGCInterval    duration `json:"namespaceGCInterval" env:"NAMESPACE_GC_INTERVAL"`
+
+	// Log tails. LogTailLines is how many existing log lines of each pod are sent before new
+	// ones, and LogRescanInterval how often a followed deployment is checked for new pods.
+	LogTailLines      int      `json:"logTailLines" env:"LOG_TAIL_LINES"`
+	LogRescanInterval duration `json:"logRescanInterval" env:"LOG_RESCAN_INTERVAL"`
+
+	// WebSocket keepalive. The server pings clients every WSPingInterval and drops those it
+	// hears nothing from for WSPongWait, which must leave time for a ping to be answered.
+	WSPingInterval duration `json:"wsPingInterval" env:"WS_PING_INTERVAL"`
+	WSPongWait     duration `json:"wsPongWait" env:"WS_PONG_WAIT"`
+	// WSMaxMessageBytes bounds the size of a client message.
+	WSMaxMessageBytes int `json:"wsMaxMessageBytes" env:"WS_MAX_MESSAGE_BYTES"`
+
+	// Manifest template paths. The test and production pod templates may each name several
+	// templates, applied in order: see expandTemplates.
+	TestPodTemplate             string `json:"testPodTemplate" env:"TEST_POD_TEMPLATE"`
+	ProdPodTemplate             string `json:"prodPodTemplate" env:"PROD_POD_TEMPLATE"`
+	ProdServiceTemplate         string `json:"prodServiceTemplate" env:"PROD_SERVICE_TEMPLATE"`
+	IngressTemplate             string `json:"ingressTemplate" env:"INGRESS_TEMPLATE"`
+	CanaryIngressTemplate       string `json:"canaryIngressTemplate" env:"CANARY_INGRESS_TEMPLATE"`
+	CustomDomainIngressTemplate string `json:"customDomainIngressTemplate" env:"CUSTOM_DOMAIN_INGRESS_TEMPLATE"`
+	NetworkPolicyTemplate       string `json:"networkPolicyTemplate" env:"NETWORK_POLICY_TEMPLATE"`
+	HPATemplate                 string `json:"hpaTemplate" env:"HPA_TEMPLATE"`
+	PrebuiltPodTemplate         string `json:"prebuiltPodTemplate" env:"PREBUILT_POD_TEMPLATE"`
+	SmokeTestPodTemplate        string `json:"smokeTestPodTemplate" env:"SMOKE_TEST_POD_TEMPLATE"`
+
+	// TLS settings. TLSCertDir names a directory holding tls.crt and tls.key, such as a
+	// mounted kubernetes.io/tls Secret, and takes precedence over TLSCertFile and TLSKeyFile.
+	// When none are set the server falls back to plain HTTP.
+	TLSCertFile string `json:"tlsCertFile" env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `json:"tlsKeyFile" env:"TLS_KEY_FILE"`
+	TLSCertDir  string `json:"tlsCertDir" env:"TLS_CERT_DIR"`
+
+	// Kubernetes connection settings. Kubeconfig names the kubeconfig file that kubectl, helm
+	// and the API clients use, and KubeContext the context in it selecting the cluster when
+	// CLUSTERS is not set. When neither is set the in-cluster config is used, falling back
+	// to the ambient kubeconfig.
+	Kubeconfig  string `json:"kubeconfig" env:"KUBECONFIG_PATH"`
+	KubeContext string `json:"kubeContext" env:"KUBE_CONTEXT"`
+
+	// Hooks are operator commands and webhooks run at points of every deployment; see
+	// hookConfig. They can only be set in the config file.
+	Hooks []hookConfig `json:"hooks"`
+}
+
+// defaultConfig returns the configuration used for settings that are not set elsewhere.
+func defaultConfig() Config {
+	return Config{
+		ListenAddr:   ":8080",
+		BaseDomain:   "yourdomain.com",
+		DatabasePath: "deployments.db",
+
+		CallbackAttempts:   5,
+		CallbackRetryDelay: duration(2 * time.Second),
+
+		WorkerPoolSize:        10,
+		MaxDeploymentsPerUser: 3,
+
+		CapacityPollInterval: duration(10 * time.Second),
+
+		DeployRatePerUser:  5,
+		DeployBurstPerUser: 5,
+		DeployRatePerIP:    20,
+		DeployBurstPerIP:   20,
+
+		ImageCheck:        true,
+		ImageCheckTimeout: duration(15 * time.Second),
+
+		DeploymentTimeout:    duration(30 * time.Minute),
+		MonitorTimeout:       duration(2 * time.Minute),
+		MaxMonitorTimeout:    duration(30 * time.Minute),
+		RolloutTimeout:       duration(5 * time.Minute),
+		ReplicasReadyTimeout: duration(5 * time.Minute),
+		UnschedulableGrace:   duration(30 * time.Second),
+		MaxDeploymentTTL:     duration(7 * 24 * time.Hour),
+		IngressTimeout:       duration(2 * time.Minute),
+		HealthCheckTimeout:   duration(2 * time.Minute),
+		HelmTimeout:          duration(10 * time.Minute),
+		CertificateTimeout:   duration(5 * time.Minute),
+		RefResolveTimeout:    duration(30 * time.Second),
+		ShutdownGracePeriod:  duration(2 * time.Minute),
+
+		MonitorPollMinInterval: duration(500 * time.Millisecond),
+		MonitorPollInterval:    duration(5 * time.Second),
+		HealthCheckInterval:    duration(5 * time.Second),
+		CanaryCheckInterval:    duration(15 * time.Second),
+		NamespaceGCInterval:    duration(10 * time.Minute),
+
+		LogTailLines:      100,
+		LogRescanInterval: duration(5 * time.Second),
+
+		WSPingInterval: duration(30 * time.Second),
+		WSPongWait:     duration(60 * time.Second),
+
+		WSMaxMessageBytes: 64 << 10,
+
+		TestPodTemplate:             "/templates/test-pod.yaml",
+		ProdPodTemplate:             "/templates/prod-pod.yaml",
+		ProdServiceTemplate:         "/templates/prod-service.yaml",
+		IngressTemplate:             "/templates/ingress.yaml",
+		CanaryIngressTemplate:       "/templates/canary-ingress.yaml",
+		CustomDomainIngressTemplate: "/templates/custom-domain-ingress.yaml",
+		NetworkPolicyTemplate:       "/templates/network-policy.yaml",
+		HPATemplate:                 "/templates/hpa.yaml",
+		PrebuiltPodTemplate:         "/templates/prebuilt-pod.yaml",
+		SmokeTestPodTemplate:        "/templates/smoke-test-pod.yaml",
+	}
+}
+
+// loadConfig returns the default configuration overlaid with the config file at path, if
+// path is not empty, and then with the environment. It does not validate the result.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		data, err = yaml.YAMLToJSON(data)
+		if err != nil {
+			return Config{}, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return Config{}, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+	if err := cfg.overrideFromEnv(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// overrideFromEnv sets each field whose env variable is set to that variable's value.
+func (c *Config) overrideFromEnv() error {
+	var errs []error
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("env")
+		value, ok := os.LookupEnv(name)
+		if name == "" || !ok {
+			continue
+		}
+		field := v.Field(i)
+		switch {
+		case field.Type() == reflect.TypeOf(duration(0)):
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				continue
+			}
+			field.SetInt(int64(d))
+		case field.Kind() == reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not an integer", name, value))
+				continue
+			}
+			field.SetInt(int64(n))
+		case field.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a boolean", name, value))
+				continue
+			}
+			field.SetBool(b)
+		default:
+			field.SetString(value)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validate reports every setting that is missing or out of range.
+func (c Config) validate() error {
+	var errs []error
+	check := func(setting string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", setting, err))
+		}
+	}
+	check("listenAddr", validateListenAddr(c.ListenAddr))
+	check("baseDomain", validateBaseDomain(c.BaseDomain))
+	if c.DatabasePath == "" {
+		check("databasePath", errors.New("must be set"))
+	}
+	if c.JWTSecret == "" {
+		check("jwtSecret", errors.New("must be set"))
+	}
+	if c.CallbackAttempts < 1 {
+		check("callbackAttempts", errors.New("must be at least 1"))
+	}
+	if c.WorkerPoolSize < 1 {
+		check("workerPoolSize", errors.New("must be at least 1"))
+	}
+	if c.MaxDeploymentsPerUser < 1 {
+		check("maxDeploymentsPerUser", errors.New("must be at least 1"))
+	}
+	if c.MaxNamespaces < 0 {
+		check("maxNamespaces", errors.New("must not be negative"))
+	}
+	if c.DeployRatePerUser < 0 {
+		check("deployRatePerUser", errors.New("must not be negative"))
+	}
+	if c.DeployBurstPerUser < 1 {
+		check("deployBurstPerUser", errors.New("must be at least 1"))
+	}
+	if c.DeployRatePerIP < 0 {
+		check("deployRatePerIP", errors.New("must not be negative"))
+	}
+	if c.DeployBurstPerIP < 1 {
+		check("deployBurstPerIP", errors.New("must be at least 1"))
+	}
+
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		if d, ok := v.Field(i).Interface().(duration); ok && d <= 0 {
+			check(v.Type().Field(i).Tag.Get("json"), errors.New("must be positive"))
+		}
+	}
+	if c.MonitorTimeout > c.MaxMonitorTimeout {
+		check("monitorTimeout", fmt.Errorf("must not exceed maxMonitorTimeout (%s)", c.MaxMonitorTimeout))
+	}
+	if c.MonitorPollMinInterval > c.MonitorPollInterval {
+		check("monitorPollMinInterval", fmt.Errorf("must not exceed monitorPollInterval (%s)", c.MonitorPollInterval))
+	}
+	if c.LogTailLines < 0 {
+		check("logTailLines", errors.New("must not be negative"))
+	}
+	if c.WSPongWait <= c.WSPingInterval {
+		check("wsPongWait", fmt.Errorf("must exceed wsPingInterval (%s)", c.WSPingInterval))
+	}
+	if c.WSMaxMessageBytes < 1 {
+		check("wsMaxMessageBytes", errors.New("must be at least 1"))
+	}
+	if _, _, err := c.tlsFiles(); err != nil {
+		check("tls", err)
+	}
+	check("hooks", validateHooks(c.Hooks))
+	if c.Kubeconfig != "" {
+		if _, err := os.Stat(c.Kubeconfig); err != nil {
+			check("kubeconfig", err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// tlsFiles returns the certificate and key paths to serve with, or empty strings if TLS is disabled.
+func (c Config) tlsFiles() (certFile, keyFile string, err error) {
+	if c.TLSCertDir != "" {
+		return filepath.Join(c.TLSCertDir, "tls.crt"), filepath.Join(c.TLSCertDir, "tls.key"), nil
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return "", "", errors.New("tlsCertFile and tlsKeyFile must be set together")
+	}
+	return c.TLSCertFile, c.TLSKeyFile, nil
+}
+
+// apply sets the package settings that the deployment workflow reads.
+func (c Config) apply() {
+	baseDomain = c.BaseDomain
+	jwtSecret = []byte(c.JWTSecret)
+	callbackSecret = []byte(c.CallbackSecret)
+	callbackAttempts = c.CallbackAttempts
+	callbackRetryDelay = time.Duration(c.CallbackRetryDelay)
+	maxDeploymentsPerUser = c.MaxDeploymentsPerUser
+	maxNamespaces = c.MaxNamespaces
+	capacityPollInterval = time.Duration(c.CapacityPollInterval)
+	userDeployLimiter = newRateLimiter(c.DeployRatePerUser, c.DeployBurstPerUser)
+	ipDeployLimiter = newRateLimiter(c.DeployRatePerIP, c.DeployBurstPerIP)
+	imageCheckEnabled = c.ImageCheck
+	imageCheckTimeout = time.Duration(c.ImageCheckTimeout)
+
+	deploymentTimeout = time.Duration(c.DeploymentTimeout)
+	monitorTimeout = time.Duration(c.MonitorTimeout)
+	maxMonitorTimeout = time.Duration(c.MaxMonitorTimeout)
+	rolloutTimeout = time.Duration(c.RolloutTimeout)
+	replicasReadyTimeout = time.Duration(c.ReplicasReadyTimeout)
+	unschedulableGrace = time.Duration(c.UnschedulableGrace)
+	maxDeploymentTTL = time.Duration(c.MaxDeploymentTTL)
+	ingressTimeout = time.Duration(c.IngressTimeout)
+	healthCheckTimeout = time.Duration(c.HealthCheckTimeout)
+	helmTimeout = time.Duration(c.HelmTimeout)
+	certificateTimeout = time.Duration(c.CertificateTimeout)
+	refResolveTimeout = time.Duration(c.RefResolveTimeout)
+	shutdownGracePeriod = time.Duration(c.ShutdownGracePeriod)
+
+	monitorPollMinInterval = time.Duration(c.MonitorPollMinInterval)
+	monitorPollInterval = time.Duration(c.MonitorPollInterval)
+	healthCheckInterval = time.Duration(c.HealthCheckInterval)
+	canaryCheckInterval = time.Duration(c.CanaryCheckInterval)
+	namespaceGCInterval = time.Duration(c.NamespaceGCInterval)
+	logTailLines = int64(c.LogTailLines)
+	logRescanInterval = time.Duration(c.LogRescanInterval)
+	wsPingInterval = time.Duration(c.WSPingInterval)
+	wsPongWait = time.Duration(c.WSPongWait)
+	wsMaxMessageBytes = int64(c.WSMaxMessageBytes)
+
+	testPodTemplate = c.TestPodTemplate
+	prodPodTemplate = c.ProdPodTemplate
+	prodServiceTemplate = c.ProdServiceTemplate
+	ingressTemplate = c.IngressTemplate
+	canaryIngressTemplate = c.CanaryIngressTemplate
+	customDomainIngressTemplate = c.CustomDomainIngressTemplate
+	networkPolicyTemplate = c.NetworkPolicyTemplate
+	hpaTemplate = c.HPATemplate
+	hooks = c.Hooks
+	prebuiltPodTemplate = c.PrebuiltPodTemplate
+	smokeTestPodTemplate = c.SmokeTestPodTemplate
+
+	kubeconfigPath = c.Kubeconfig
+	kubeContext = c.KubeContext
+}
+
+// redacted renders the configuration for logging, with secrets masked.
+func (c Config) redacted() string {
+	if c.JWTSecret != "" {
+		c.JWTSecret = "[redacted]"
+	}
+	if c.CallbackSecret != "" {
+		c.CallbackSecret = "[redacted]"
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// duration is a time.Duration written in config files as a string such as "90s" or "5m".
+type duration time.Duration
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
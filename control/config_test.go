@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// validTestConfig returns the default configuration with the settings it lacks filled in.
+func validTestConfig() Config {
+	cfg := defaultConfig()
+	cfg.JWTSecret = "test-secret"
+	return cfg
+}
+
+func TestConfigValidateLimits(t *testing.T) {
+	if err := validTestConfig().validate(); err != nil {
+		t.Fatalf("default configuration is invalid: %v", err)
+	}
+	tests := []struct {
+		setting string
+		modify  func(c *Config)
+	}{
+		{"maxNamespaces", func(c *Config) { c.MaxNamespaces = -1 }},
+		{"capacityPollInterval", func(c *Config) { c.CapacityPollInterval = 0 }},
+		{"deployRatePerUser", func(c *Config) { c.DeployRatePerUser = -1 }},
+		{"deployBurstPerUser", func(c *Config) { c.DeployBurstPerUser = 0 }},
+		{"deployRatePerIP", func(c *Config) { c.DeployRatePerIP = -5 }},
+		{"deployBurstPerIP", func(c *Config) { c.DeployBurstPerIP = -1 }},
+		{"imageCheckTimeout", func(c *Config) { c.ImageCheckTimeout = -1 }},
+		{"monitorPollMinInterval", func(c *Config) { c.MonitorPollMinInterval = 0 }},
+		{"monitorPollMinInterval", func(c *Config) { c.MonitorPollMinInterval = c.MonitorPollInterval + 1 }},
+		{"logTailLines", func(c *Config) { c.LogTailLines = -1 }},
+		{"logRescanInterval", func(c *Config) { c.LogRescanInterval = 0 }},
+		{"wsPingInterval", func(c *Config) { c.WSPingInterval = 0 }},
+		{"wsPongWait", func(c *Config) { c.WSPongWait = -1 }},
+		{"wsPongWait", func(c *Config) { c.WSPongWait = c.WSPingInterval }},
+		{"wsMaxMessageBytes", func(c *Config) { c.WSMaxMessageBytes = 0 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.setting, func(t *testing.T) {
+			cfg := validTestConfig()
+			tt.modify(&cfg)
+			if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), tt.setting) {
+				t.Errorf("validate = %v, want an error naming %s", err, tt.setting)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsInvalidEnvironment(t *testing.T) {
+	for name, value := range map[string]string{
+		"MAX_NAMESPACES":         "lots",
+		"CAPACITY_POLL_INTERVAL": "10",
+		"DEPLOY_RATE_PER_USER":   "5/min",
+		"DEPLOY_BURST_PER_IP":    "twenty",
+		"IMAGE_CHECK":            "maybe",
+		"LOG_RESCAN_INTERVAL":    "5",
+		"WS_PING_INTERVAL":       "often",
+		"WS_MAX_MESSAGE_BYTES":   "64KiB",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := loadConfig(""); err == nil || !strings.Contains(err.Error(), name) {
+				t.Errorf("loadConfig = %v, want an error naming %s", err, name)
+			}
+		})
+	}
+}
+
+func TestLoadConfigReadsEnvironment(t *testing.T) {
+	t.Setenv("MAX_NAMESPACES", "50")
+	t.Setenv("IMAGE_CHECK", "false")
+	cfg, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxNamespaces != 50 {
+		t.Errorf("MaxNamespaces = %d, want 50", cfg.MaxNamespaces)
+	}
+	if cfg.ImageCheck {
+		t.Error("IMAGE_CHECK=false left the image check enabled")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// credentialTTL is how long an uploaded repository credential may be referenced by deployments.
+var credentialTTL = envDuration("CREDENTIAL_TTL", time.Hour)
+
+// maxCredentialBytes bounds the size of a credential upload.
+const maxCredentialBytes = 64 << 10
+
+// repoCredentialSecret is the Secret mounted into the test pod so git clone can
+// authenticate, referenced by the test pod template.
+const repoCredentialSecret = "repo-credentials"
+
+// Keys of repoCredentialSecret, which the test pod template checks for.
+const (
+	repoCredentialTokenKey  = "token"
+	repoCredentialSSHKeyKey = "ssh-privatekey"
+)
+
+// repoCredential is a deploy token or SSH private key for cloning a private repository.
+// Credentials are only kept in memory and are never persisted or returned by the API.
+type repoCredential struct {
+	ID            string
+	UserID        string
+	Token         SecretString
+	SSHPrivateKey SecretString
+	ExpiresAt     time.Time
+}
+
+// credentials holds uploaded credentials keyed by ID.
+var (
+	credentialsMu sync.Mutex
+	credentials   = map[string]repoCredential{}
+)
+
+// errCredentialNotFound is returned for unknown, expired, or foreign credential IDs.
+var errCredentialNotFound = errors.New("credential not found")
+
+// lookupCredential returns the user's unexpired credential with the given ID.
+func lookupCredential(id, userID string) (repoCredential, error) {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	cred, ok := credentials[id]
+	if ok && time.Now().After(cred.ExpiresAt) {
+		delete(credentials, id)
+		ok = false
+	}
+	if !ok || cred.UserID != userID {
+		return repoCredential{}, errCredentialNotFound
+	}
+	return cred, nil
+}
+
+// createCredentialRequest is the body of POST /credentials. Exactly one field must be set.
+type createCredentialRequest struct {
+	Token         SecretString `json:"token"`
+	SSHPrivateKey SecretString `json:"sshPrivateKey"`
+}
+
+// createCredentialResponse is returned by POST /credentials.
+type createCredentialResponse struct {
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// createCredentialHandler serves POST /credentials, storing a repository credential for the
+// authenticated user. Deployments reference it by the returned ID through credentialID, so
+// the credential itself never travels in a deployment payload.
+func createCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := authenticate(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req createCredentialRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCredentialBytes)).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if (req.Token == "") == (req.SSHPrivateKey == "") {
+		http.Error(w, "exactly one of token and sshPrivateKey is required", http.StatusBadRequest)
+		return
+	}
+	if req.SSHPrivateKey != "" && !strings.Contains(string(req.SSHPrivateKey), "PRIVATE KEY") {
+		http.Error(w, "sshPrivateKey must be a PEM or OpenSSH private key", http.StatusBadRequest)
+		return
+	}
+
+	cred := repoCredential{
+		ID:            uuid.NewString(),
+		UserID:        userID,
+		Token:         req.Token,
+		SSHPrivateKey: req.SSHPrivateKey,
+		ExpiresAt:     time.Now().Add(credentialTTL).UTC(),
+	}
+	credentialsMu.Lock()
+	credentials[cred.ID] = cred
+	credentialsMu.Unlock()
+	kind := "token"
+	if cred.SSHPrivateKey != "" {
+		kind = "ssh key"
+	}
+	recordAudit(auditEntry{UserID: userID, Action: "create_credential", Outcome: auditSucceeded, SourceIP: clientIP(r),
+		Detail: fmt.Sprintf("credential %s (%s)", cred.ID, kind)})
+	writeJSON(w, http.StatusCreated, createCredentialResponse{ID: cred.ID, ExpiresAt: cred.ExpiresAt})
+}
+
+// deleteCredentialHandler serves DELETE /credentials/{id}, forgetting one of the user's credentials.
+func deleteCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := authenticate(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id := r.PathValue("id")
+	if _, err := lookupCredential(id, userID); err != nil {
+		http.Error(w, "credential not found", http.StatusNotFound)
+		return
+	}
+	credentialsMu.Lock()
+	delete(credentials, id)
+	credentialsMu.Unlock()
+	recordAudit(auditEntry{UserID: userID, Action: "delete_credential", Outcome: auditSucceeded, SourceIP: clientIP(r),
+		Detail: "credential " + id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// applyRepoCredentialSecret creates or updates the namespace's repository credential Secret.
+// It lives in the deployment namespace, so it is deleted along with it.
+func applyRepoCredentialSecret(ctx context.Context, namespace string, cred repoCredential) error {
+	data := map[string]string{}
+	if cred.Token != "" {
+		data[repoCredentialTokenKey] = string(cred.Token)
+	}
+	if cred.SSHPrivateKey != "" {
+		data[repoCredentialSSHKeyKey] = string(cred.SSHPrivateKey)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: repoCredentialSecret, Namespace: namespace},
+		Type:       corev1.SecretTypeOpaque,
+		StringData: data,
+	}
+	client := kubeFor(ctx).CoreV1().Secrets(namespace)
+	_, err := client.Create(ctx, secret, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = client.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// gitCredentialEnv returns environment variables that make git authenticate with cred,
+// and a function removing any temporary files they refer to. The credential is passed
+// through the environment rather than arguments so it does not show up in process listings.
+func gitCredentialEnv(cred repoCredential) ([]string, func(), error) {
+	if cred.Token != "" {
+		basic := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + string(cred.Token)))
+		return []string{
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic " + basic,
+		}, func() {}, nil
+	}
+
+	keyFile, err := os.CreateTemp("", "repo-key-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	remove := func() { os.Remove(keyFile.Name()) }
+	key := strings.TrimRight(string(cred.SSHPrivateKey), "\n") + "\n"
+	if _, err := keyFile.WriteString(key); err != nil {
+		keyFile.Close()
+		remove()
+		return nil, nil, err
+	}
+	if err := keyFile.Close(); err != nil {
+		remove()
+		return nil, nil, err
+	}
+	return []string{
+		fmt.Sprintf("GIT_SSH_COMMAND=ssh -i %s -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new", keyFile.Name()),
+	}, remove, nil
+}
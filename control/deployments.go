@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DeploymentStatus is the lifecycle phase of a deployment.
+type DeploymentStatus string
+
+const (
+	StatusPending   DeploymentStatus = "pending"
+	StatusTesting   DeploymentStatus = "testing"
+	StatusDeploying DeploymentStatus = "deploying"
+	StatusSucceeded DeploymentStatus = "succeeded"
+	StatusFailed    DeploymentStatus = "failed"
+	StatusCancelled DeploymentStatus = "cancelled"
+	StatusDeleted   DeploymentStatus = "deleted"
+	// StatusDuplicate marks a request that was deduplicated against an identical deployment.
+	StatusDuplicate DeploymentStatus = "duplicate"
+	// StatusDryRun marks a dry run that passed validation without changing the cluster.
+	StatusDryRun DeploymentStatus = "dry_run"
+)
+
+// Deployment tracks a single in-flight deployment. Every change to its record is
+// written through to deploymentStore.
+type Deployment struct {
+	DeploymentRecord
+	events *eventLog
+	cancel context.CancelFunc
+	logger *slog.Logger
+	// callbackURL is sent the deployment's outcome when it finishes, if not empty.
+	callbackURL string
+}
+
+// finished reports whether the status is terminal.
+func (s DeploymentStatus) finished() bool {
+	return s == StatusSucceeded || s == StatusFailed || s == StatusCancelled || s == StatusDeleted || s == StatusDuplicate || s == StatusDryRun
+}
+
+// registerDeployment creates a cancellable context for a new deployment, records it in the
+// registry, and persists its initial record. sink, if not nil, is subscribed to its events.
+func registerDeployment(parent context.Context, sink eventSink, payload DeploymentPayload) (*Deployment, context.Context) {
+	ctx, cancel := context.WithCancel(parent)
+	now := time.Now().UTC()
+	d := &Deployment{
+		DeploymentRecord: DeploymentRecord{
+			ID:         uuid.NewString(),
+			UserID:     payload.UserID,
+			RepoURL:    payload.RepoURL,
+			CommitHash: payload.CommitHash,
+			Status:     StatusPending,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		},
+		cancel:      cancel,
+		callbackURL: payload.CallbackURL,
+	}
+	d.events = newEventLog(d.ID, payload.UserID, sink, cancel)
+	d.logger = slog.Default().With("deploymentID", d.ID, "userID", payload.UserID)
+	ctx = withLogger(ctx, d.logger)
+
+	deployments.Add(d)
+	d.save(deployments.Record(d))
+	return d, ctx
+}
+
+// finishDeployment releases the deployment's context and removes it from the registry.
+// Its final record remains available from deploymentStore.
+func finishDeployment(d *Deployment) {
+	deployments.Delete(d)
+	d.events.finish()
+	d.cancel()
+}
+
+// cancelDeployment cancels the in-flight deployment with the given ID, reporting whether it was found.
+func cancelDeployment(id string) bool {
+	d, ok := deployments.Get(id)
+	inFlight := ok && !d.status().finished()
+	if inFlight {
+		d.cancel()
+	}
+	return inFlight
+}
+
+// cancelAllDeployments cancels every in-flight deployment.
+func cancelAllDeployments() {
+	for _, d := range deployments.List() {
+		d.cancel()
+	}
+}
+
+// update applies fn to the deployment's record through the registry and persists the result.
+func (d *Deployment) update(fn func(rec *DeploymentRecord)) {
+	d.save(deployments.Update(d, fn))
+}
+
+// save writes a snapshot of the deployment's record to the store, logging failures.
+func (d *Deployment) save(rec DeploymentRecord) {
+	if err := deploymentStore.Save(context.Background(), rec); err != nil {
+		d.logger.Error("Error persisting deployment record", "error", err)
+	}
+}
+
+// namespaceKey identifies a namespace in a cluster.
+func namespaceKey(cluster, namespace string) string {
+	return cluster + "/" + namespace
+}
+
+// claimNamespace records the cluster and namespace the deployment runs in and adds them to
+// the deployment's logger. If another in-flight deployment already owns the namespace in
+// that cluster, nothing is recorded and that deployment's ID is returned with ok=false.
+// It must be called before the deployment starts any goroutines that log.
+func (d *Deployment) claimNamespace(cluster, namespace string) (existingID string, ok bool) {
+	if id, ok := deployments.ClaimNamespace(namespaceKey(cluster, namespace), d.ID); !ok {
+		return id, false
+	}
+
+	d.logger = d.logger.With("cluster", cluster, "namespace", namespace)
+	d.update(func(rec *DeploymentRecord) {
+		rec.Cluster = cluster
+		rec.Namespace = namespace
+	})
+	return "", true
+}
+
+// status returns the deployment's current lifecycle phase.
+func (d *Deployment) status() DeploymentStatus {
+	return deployments.Record(d).Status
+}
+
+// setStatus records the deployment's current lifecycle phase.
+func (d *Deployment) setStatus(status DeploymentStatus) {
+	d.update(func(rec *DeploymentRecord) { rec.Status = status })
+}
+
+// setEndpoint records the public endpoint of a successful deployment.
+func (d *Deployment) setEndpoint(endpoint string) {
+	d.update(func(rec *DeploymentRecord) { rec.Endpoint = endpoint })
+}
+
+// emit tags an event with the deployment ID and sends it to the clients subscribed to the deployment.
+func (d *Deployment) emit(e Event) {
+	e.DeploymentID = d.ID
+	d.events.publish(d.logger, e)
+}
+
+// send sends a message to the clients subscribed to the deployment.
+func (d *Deployment) send(event, message string) {
+	d.emit(Event{Event: event, Message: message})
+}
+
+// Progress milestones reported to the client as the deployment moves through its lifecycle.
+const (
+	progressNamespaceCreated = 10
+	progressTestDeployed     = 25
+	progressTestsPassed      = 60
+	progressProdDeployed     = 85
+	progressHealthy          = 100
+)
+
+// progress reports how far the deployment has got, as a percentage and the name of the phase reached.
+func (d *Deployment) progress(percent int, phase string) {
+	d.emit(Event{
+		Event:    "progress",
+		Message:  fmt.Sprintf("%d%% (%s)", percent, phase),
+		Phase:    phase,
+		Progress: percent,
+	})
+}
+
+// fail marks the deployment as failed and reports the failure to the client.
+func (d *Deployment) fail(event string, code errorCode, message string) {
+	d.failWithDetails(event, code, message, "")
+}
+
+// failWithDetails is like fail but attaches diagnostic output to the event.
+func (d *Deployment) failWithDetails(event string, code errorCode, message, details string) {
+	d.setStatus(StatusFailed)
+	failure := Event{Event: event, Code: code, Message: message, Details: details}
+	d.emit(failure)
+	// The deployment may have failed because its context is done; hooks get their own.
+	d.runHooks(context.Background(), hookOnFailure, &failure)
+}
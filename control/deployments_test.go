@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// waitForFinish waits for a deployment started by startTestDeployment to finish.
+func waitForFinish(t *testing.T, done <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deployment did not finish")
+	}
+}
+
+func TestConcurrentIdenticalDeploymentsAreDeduplicated(t *testing.T) {
+	useTestEnvironment(t)
+	payload := DeploymentPayload{UserID: "alice", RepoURL: "https://github.com/a/app", CommitHash: "abcdef1"}
+
+	first, _ := startTestDeployment(t, nil, payload)
+	// The first deployment holds its namespace while its tests run.
+	waitForEvent(t, first, "manifests_applied")
+	second, done := startTestDeployment(t, nil, payload)
+	waitForFinish(t, done)
+
+	if status := second.status(); status != StatusDuplicate {
+		t.Errorf("second deployment status = %s, want %s", status, StatusDuplicate)
+	}
+	if e := waitForEvent(t, second, "deployment_already_exists"); !containsAll(e.Message, first.ID, "in progress") {
+		t.Errorf("deployment_already_exists message %q does not name the deployment in progress", e.Message)
+	}
+	if status := first.status(); status.finished() {
+		t.Errorf("first deployment finished with %s, want it still running", status)
+	}
+}
+
+func TestRecentlySucceededDeploymentIsDeduplicated(t *testing.T) {
+	useTestEnvironment(t)
+	payload := DeploymentPayload{UserID: "alice", RepoURL: "https://github.com/a/app", CommitHash: "abcdef1234"}
+	namespace, err := generateNamespace(payload.UserID, payload.RepoURL, payload.CommitHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	if err := deploymentStore.Save(context.Background(), DeploymentRecord{
+		ID: "dep-live", UserID: "alice", RepoURL: payload.RepoURL, CommitHash: "abcdef1", Namespace: namespace,
+		Cluster: "test", Status: StatusSucceeded, Endpoint: "https://live.example.com", CreatedAt: now, UpdatedAt: now,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	d, done := startTestDeployment(t, nil, payload)
+	waitForFinish(t, done)
+	if status := d.status(); status != StatusDuplicate {
+		t.Errorf("status = %s, want %s", status, StatusDuplicate)
+	}
+	if e := waitForEvent(t, d, "deployment_already_exists"); !containsAll(e.Message, "dep-live", "https://live.example.com") {
+		t.Errorf("deployment_already_exists message %q does not point at the live deployment", e.Message)
+	}
+}
+
+func TestSequentialIdenticalDeploymentRedeploys(t *testing.T) {
+	cs, runner := useTestEnvironment(t)
+	previousKeep := keepFailedNamespaces
+	keepFailedNamespaces = true
+	t.Cleanup(func() { keepFailedNamespaces = previousKeep })
+	// Each deployment finishes once its test pod fails.
+	runTestPodsAs(cs, runner, terminatedPod(corev1.PodFailed, 1).Status)
+	payload := DeploymentPayload{UserID: "alice", RepoURL: "https://github.com/a/app", CommitHash: "abcdef1"}
+	namespace, _ := generateNamespace(payload.UserID, payload.RepoURL, payload.CommitHash)
+
+	var ids []string
+	for run := range 2 {
+		d, done := startTestDeployment(t, nil, payload)
+		waitForFinish(t, done)
+		events := sentEvents(d)
+		if redeployed := slices.Contains(events, "redeploy"); redeployed != (run == 1) {
+			t.Errorf("deployment %d: redeploy sent = %t, want %t; events %v", run+1, redeployed, run == 1, events)
+		}
+		if !slices.Contains(events, "test_failure") {
+			t.Errorf("deployment %d did not reach its tests; events %v", run+1, events)
+		}
+		ids = append(ids, d.ID)
+	}
+
+	ns, err := cs.CoreV1().Namespaces().Get(context.Background(), namespace, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := ns.Annotations[deploymentIDAnnotation]; owner != ids[1] {
+		t.Errorf("namespace is annotated with deployment %s, want the redeploy %s", owner, ids[1])
+	}
+}
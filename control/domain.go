@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// A custom domain is served by an ingress in the release's namespace whose certificate
+// cert-manager issues into customDomainTLSSecret.
+const (
+	customDomainIngressName = "custom-domain"
+	customDomainTLSSecret   = "custom-domain-tls"
+)
+
+// customDomainIngressTemplate is the path of the custom domain ingress template, set from Config.
+var customDomainIngressTemplate string
+
+// domainChallengePrefix is prepended to a custom domain to name the TXT record proving
+// that its owner may deploy to it.
+const domainChallengePrefix = "_backend-im-challenge."
+
+// Custom domain settings: the cert-manager ClusterIssuer that signs certificates, how long
+// a deployment waits for its certificate, which is set from Config, and how long DNS
+// verification may take.
+var (
+	certIssuer         = envString("CERT_MANAGER_ISSUER", "letsencrypt")
+	certificateTimeout time.Duration
+	dnsCheckTimeout    = envDuration("DNS_CHECK_TIMEOUT", 10*time.Second)
+)
+
+// validateCustomDomain checks that domain is a fully qualified DNS name outside the base
+// domain, whose own subdomains are chosen with the subdomain field instead.
+func validateCustomDomain(domain string) error {
+	if errs := validation.IsDNS1123Subdomain(domain); len(errs) > 0 {
+		return fmt.Errorf("custom domain %q is invalid: %s", domain, strings.Join(errs, "; "))
+	}
+	if !strings.Contains(domain, ".") || net.ParseIP(domain) != nil {
+		return fmt.Errorf("custom domain %q must be a fully qualified domain name", domain)
+	}
+	if domain == baseDomain || strings.HasSuffix(domain, "."+baseDomain) {
+		return fmt.Errorf("custom domain %q is under %s; use the subdomain field instead", domain, baseDomain)
+	}
+	return nil
+}
+
+// domainVerificationToken is the TXT record value that proves a user controls domain.
+func domainVerificationToken(userID, domain string) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(userID + "\x00" + domain))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// verifyDomainDNS checks that the user has pointed domain at the platform, either with a
+// CNAME to a hostname under the base domain or with a TXT record at
+// _backend-im-challenge.<domain> holding their verification token. The error explains what
+// to configure.
+func verifyDomainDNS(ctx context.Context, userID, domain, target string) error {
+	ctx, cancel := context.WithTimeout(ctx, dnsCheckTimeout)
+	defer cancel()
+
+	if cname, err := net.DefaultResolver.LookupCNAME(ctx, domain); err == nil {
+		cname = strings.TrimSuffix(cname, ".")
+		if cname == baseDomain || strings.HasSuffix(cname, "."+baseDomain) {
+			return nil
+		}
+	}
+	token := domainVerificationToken(userID, domain)
+	if records, err := net.DefaultResolver.LookupTXT(ctx, domainChallengePrefix+domain); err == nil {
+		for _, record := range records {
+			if record == token {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("DNS for %s is not configured: add a CNAME record pointing it at %s, or a TXT record %s%s with the value %s",
+		domain, target, domainChallengePrefix, domain, token)
+}
+
+// customDomainSubstitutions returns the substitutions for the custom domain ingress template.
+func customDomainSubstitutions(namespace, domain string) map[string]string {
+	return map[string]string{
+		"Namespace":     namespace,
+		"IngressName":   customDomainIngressName,
+		"Host":          domain,
+		"Issuer":        certIssuer,
+		"TLSSecretName": customDomainTLSSecret,
+	}
+}
+
+// waitForCertificate waits until cert-manager reports the custom domain's Certificate
+// Ready or certificateTimeout elapses, sending its status to the client as
+// provisioning_certificate whenever it changes.
+func waitForCertificate(ctx context.Context, deployment *Deployment, namespace string) error {
+	const jsonPath = `jsonpath={.status.conditions[?(@.type=="Ready")].status}|{.status.conditions[?(@.type=="Ready")].message}`
+	var last string
+	err := wait.PollUntilContextTimeout(ctx, 5*time.Second, certificateTimeout, true, func(ctx context.Context) (bool, error) {
+		output, err := runKubectl(ctx, 30*time.Second, "get", "certificate", customDomainTLSSecret, "-n", namespace, "-o", jsonPath)
+		ready, message, _ := strings.Cut(strings.TrimSpace(output), "|")
+		if err != nil {
+			// cert-manager creates the Certificate shortly after the ingress.
+			ready, message = "", "waiting for cert-manager to create the certificate"
+		} else if message == "" {
+			message = "waiting for cert-manager to report the certificate status"
+		}
+		if message != last {
+			last = message
+			deployment.send("provisioning_certificate", "Certificate: "+message)
+		}
+		return ready == "True", nil
+	})
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("certificate not ready after %s: %s: %w", certificateTimeout, last, err)
+	}
+	return err
+}
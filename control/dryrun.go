@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// dryRunPlan is what a deployment would create, resolved from its validated payload.
+type dryRunPlan struct {
+	Namespace   string
+	TestPodName string
+	TestPods    []string
+	Resources   prodResources
+	HealthCheck healthCheck
+	Autoscale   autoscaleOptions
+	DeployType  string
+}
+
+// plannedManifest is a template and the substitutions it would be applied with.
+type plannedManifest struct {
+	Template      string
+	Substitutions map[string]string
+}
+
+// dryRunDeployment renders every manifest the deployment would apply and validates them with
+// dry-run applies, then reports what a real deployment would do. Nothing is created and the
+// test pod is not monitored.
+//
+// Namespaced objects can only be validated by the API server once their namespace exists,
+// so for a deployment that would create a new namespace they are validated client-side.
+func dryRunDeployment(ctx context.Context, deployment *Deployment, payload DeploymentPayload, plan dryRunPlan) {
+	fail := func(err error) {
+		if ctx.Err() != nil {
+			reportStopped(ctx, deployment)
+			return
+		}
+		reportApplyFailure(deployment, codeApplyFailed, "Dry run failed: ", err)
+	}
+
+	namespaceExists := true
+	if _, err := kubeFor(ctx).CoreV1().Namespaces().Get(ctx, plan.Namespace, metav1.GetOptions{}); apierrors.IsNotFound(err) {
+		namespaceExists = false
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: plan.Namespace}}
+		if _, err := kubeFor(ctx).CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}}); err != nil {
+			fail(fmt.Errorf("creating namespace: %w", err))
+			return
+		}
+	} else if err != nil {
+		fail(fmt.Errorf("looking up namespace: %w", err))
+		return
+	}
+	mode := "server"
+	if !namespaceExists {
+		mode = "client"
+	}
+	liveColor := ""
+	if namespaceExists {
+		var err error
+		if liveColor, _, err = liveProdVersion(ctx, plan.Namespace); err != nil {
+			fail(fmt.Errorf("looking up the live version: %w", err))
+			return
+		}
+	}
+	color := otherColor(liveColor)
+
+	var manifests []plannedManifest
+	if template, substitutions, ok := testManifest(plan.Namespace, plan.TestPodName, payload); ok {
+		manifests = append(manifests, plannedManifest{template, substitutions})
+	}
+	if networkPolicyEnabled {
+		manifests = append(manifests, plannedManifest{networkPolicyTemplate, networkPolicySubstitutions(plan.Namespace)})
+	}
+	if plan.DeployType == DeployTypeTemplate {
+		prodTemplate, prodSubs := prodManifest(plan.Namespace, plan.Resources, plan.HealthCheck, color, payload)
+		manifests = append(manifests,
+			plannedManifest{prodTemplate, prodSubs},
+			plannedManifest{prodServiceTemplate, prodServiceSubstitutions(plan.Namespace, prodServiceName, color)},
+			plannedManifest{ingressTemplate, ingressSubstitutions(plan.Namespace, prodIngressName, generateHost(plan.Namespace))},
+		)
+		if plan.Autoscale.enabled() {
+			manifests = append(manifests, plannedManifest{hpaTemplate, hpaSubstitutions(plan.Namespace, color, plan.Autoscale)})
+		}
+		if payload.CustomDomain != "" {
+			manifests = append(manifests, plannedManifest{customDomainIngressTemplate, customDomainSubstitutions(plan.Namespace, payload.CustomDomain)})
+		}
+	}
+
+	objects := []string{"Namespace/" + plan.Namespace}
+	if payload.CredentialID != "" {
+		objects = append(objects, "Secret/"+repoCredentialSecret)
+	}
+	for _, m := range manifests {
+		applied, err := dryRunK8sTemplate(ctx, m.Template, plan.Namespace, m.Substitutions, mode)
+		if err != nil {
+			fail(err)
+			return
+		}
+		for _, obj := range applied {
+			objects = append(objects, obj.String())
+		}
+	}
+	if plan.DeployType == DeployTypeHelm {
+		args := append(helmUpgradeArgs(plan.Namespace, payload), "--dry-run")
+		if output, err := runCommand(ctx, helmTimeout, "helm", args...); err != nil {
+			fail(fmt.Errorf("helm dry run: %w\nOutput: %s", err, output))
+			return
+		}
+		objects = append(objects, "HelmRelease/"+helmReleaseName)
+	} else {
+		objects = append(objects, "ConfigMap/"+appEnvConfigMap, "Secret/"+appSecret)
+	}
+
+	var summary strings.Builder
+	if payload.Image != "" {
+		fmt.Fprintf(&summary, "Dry run passed. A deployment of prebuilt image %s would ", payload.Image)
+	} else {
+		fmt.Fprintf(&summary, "Dry run passed. A deployment of commit %s from %s would ", payload.CommitHash, payload.RepoURL)
+	}
+	if namespaceExists {
+		fmt.Fprintf(&summary, "redeploy into existing namespace %s", plan.Namespace)
+	} else {
+		fmt.Fprintf(&summary, "create namespace %s", plan.Namespace)
+	}
+	if len(plan.TestPods) > 0 {
+		fmt.Fprintf(&summary, ", run tests in pod(s) %s", strings.Join(plan.TestPods, ", "))
+	}
+	if plan.DeployType == DeployTypeHelm {
+		fmt.Fprintf(&summary, ", and install Helm chart %s as release %s.", payload.HelmChart, helmReleaseName)
+	} else {
+		replicas := fmt.Sprintf("%d replica(s)", plan.Resources.Replicas)
+		if a := plan.Autoscale; a.enabled() {
+			replicas = fmt.Sprintf("%d to %d replicas autoscaled at %d%% CPU", a.MinReplicas, a.MaxReplicas, a.TargetCPU)
+		}
+		fmt.Fprintf(&summary, ", and serve %s limited to %s CPU and %s memory at %s.",
+			replicas, plan.Resources.CPULimit, plan.Resources.MemoryLimit, generateEndpoint(plan.Namespace))
+	}
+	fmt.Fprintf(&summary, " Objects (validated %s-side): %s", mode, strings.Join(objects, ", "))
+
+	deployment.setStatus(StatusDryRun)
+	deployment.send("dry_run_result", summary.String())
+}
+
+// dryRunK8sTemplate renders the templates named by spec and validates them with kubectl
+// apply --dry-run in the given mode ("server" or "client"), returning the objects they contain.
+func dryRunK8sTemplate(ctx context.Context, spec, namespace string, substitutions map[string]string, mode string) ([]manifestObject, error) {
+	rendered, err := renderK8sTemplates(spec, substitutions)
+	if err != nil {
+		return nil, err
+	}
+	var objects []manifestObject
+	for _, t := range rendered {
+		if err := dryRunManifest(ctx, t.Path, namespace, t.Manifest, mode); err != nil {
+			return nil, err
+		}
+		found, err := manifestObjects([]byte(t.Manifest))
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, found...)
+	}
+	return objects, nil
+}
+
+// dryRunManifest validates a rendered manifest with kubectl apply --dry-run in the given
+// mode. A rejected manifest is reported as a *manifestInvalidError.
+func dryRunManifest(ctx context.Context, templatePath, namespace, manifest, mode string) error {
+	output, err := kubectlApply(ctx, namespace, manifest, "--dry-run="+mode)
+	if err == nil {
+		return nil
+	}
+	loggerFrom(ctx).Error("Manifest failed dry-run validation", "template", templatePath, "mode", mode, "error", err, "output", output)
+	if isTransientKubectlError(output, err) || ctx.Err() != nil {
+		return fmt.Errorf("%w\nOutput: %s", err, output)
+	}
+	return &manifestInvalidError{Template: templatePath, Message: strings.TrimSpace(output)}
+}
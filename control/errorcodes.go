@@ -0,0 +1,49 @@
+package main
+
+// errorCode is the stable, machine-readable code sent with every error event, for clients to
+// branch on instead of parsing the message. Codes are never renamed once published.
+type errorCode string
+
+// Error codes of the deployment workflow.
+const (
+	codeValidationError       errorCode = "VALIDATION_ERROR"
+	codeRefResolveFailed      errorCode = "REF_RESOLVE_FAILED"
+	codeSubdomainInUse        errorCode = "SUBDOMAIN_IN_USE"
+	codeDomainInUse           errorCode = "DOMAIN_IN_USE"
+	codeDomainNotVerified     errorCode = "DOMAIN_NOT_VERIFIED"
+	codeNamespaceConflict     errorCode = "NAMESPACE_CONFLICT"
+	codeNamespaceCreateFailed errorCode = "NAMESPACE_CREATE_FAILED"
+	codeQuotaApplyFailed      errorCode = "QUOTA_APPLY_FAILED"
+	codeQuotaExceeded         errorCode = "QUOTA_EXCEEDED"
+	codeManifestInvalid       errorCode = "MANIFEST_INVALID"
+	codeApplyFailed           errorCode = "APPLY_FAILED"
+	codeCredentialsFailed     errorCode = "CREDENTIALS_FAILED"
+	codeHelmInstallFailed     errorCode = "HELM_INSTALL_FAILED"
+	codeTestTimeout           errorCode = "TEST_TIMEOUT"
+	codeTestFailed            errorCode = "TEST_FAILED"
+	codeImagePullError        errorCode = "IMAGE_PULL_ERROR"
+	codeImageNotFound         errorCode = "IMAGE_NOT_FOUND"
+	codeCrashLoop             errorCode = "CRASH_LOOP"
+	codeUnschedulable         errorCode = "UNSCHEDULABLE"
+	codeRolloutFailed         errorCode = "ROLLOUT_FAILED"
+	codeHealthCheckFailed     errorCode = "HEALTH_CHECK_FAILED"
+	codeCanaryFailed          errorCode = "CANARY_FAILED"
+	codeIngressFailed         errorCode = "INGRESS_FAILED"
+	codeCertificateFailed     errorCode = "CERTIFICATE_FAILED"
+	codeDeploymentTimeout     errorCode = "DEPLOYMENT_TIMEOUT"
+	codeHookFailed            errorCode = "HOOK_FAILED"
+	codeInternalError         errorCode = "INTERNAL_ERROR"
+)
+
+// Error codes of requests that are rejected or cannot be served.
+const (
+	codePayloadTooLarge      errorCode = "PAYLOAD_TOO_LARGE"
+	codeRateLimited          errorCode = "RATE_LIMITED"
+	codeTooManyDeployments   errorCode = "TOO_MANY_DEPLOYMENTS"
+	codeServerShuttingDown   errorCode = "SERVER_SHUTTING_DOWN"
+	codeDeploymentNotFound   errorCode = "DEPLOYMENT_NOT_FOUND"
+	codeNoPreviousDeployment errorCode = "NO_PREVIOUS_DEPLOYMENT"
+	codeRollbackFailed       errorCode = "ROLLBACK_FAILED"
+	codeScaleFailed          errorCode = "SCALE_FAILED"
+	codeRestartFailed        errorCode = "RESTART_FAILED"
+)
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Event is a message sent to clients, serialized as JSON. Event and Message are always
+// present; the other fields are set when they apply.
+type Event struct {
+	// Event names what happened, such as "progress" or "deployment_success".
+	Event   string `json:"event"`
+	Message string `json:"message"`
+	// DeploymentID is set on events about a deployment.
+	DeploymentID string `json:"deploymentID,omitempty"`
+	// Seq numbers a deployment's events from 1, for replay on reconnect.
+	Seq int `json:"seq,omitempty"`
+	// Phase and Progress are set on progress events: the phase reached and the
+	// percentage of the deployment complete.
+	Phase     string    `json:"phase,omitempty"`
+	Progress  int       `json:"progress,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	// Details carries diagnostic output, such as logs, for failure events.
+	Details string `json:"details,omitempty"`
+	// Reason and Object are set on k8s_event events: the Kubernetes event's reason, such as
+	// "Pulling" or "FailedScheduling", and the object it is about, such as "Pod/test-app".
+	Reason string `json:"reason,omitempty"`
+	Object string `json:"object,omitempty"`
+	// RetryAfter is set on rate_limited events: the seconds to wait before retrying.
+	RetryAfter int `json:"retryAfter,omitempty"`
+	// Code is set on error events: the errorCode identifying what went wrong.
+	Code errorCode `json:"code,omitempty"`
+	// Image and ImageDigest are set on deployment_success events: the image reference the
+	// app runs and, when the container runtime reports it, the digest of the exact image.
+	Image       string `json:"image,omitempty"`
+	ImageDigest string `json:"imageDigest,omitempty"`
+	// Timings is set on deployment_success events: how long each phase took.
+	Timings []PhaseTiming `json:"timings,omitempty"`
+}
+
+// eventSink receives the events of a deployment, such as a client's WebSocket connection.
+type eventSink interface {
+	WriteJSON(v interface{}) error
+}
+
+// eventRetention is how long a finished deployment's events stay available for replay.
+var eventRetention = envDuration("EVENT_RETENTION", time.Hour)
+
+// reconnectGrace is how long a deployment keeps running after its last subscribed connection
+// drops, giving the client time to reconnect and subscribe again before it is cancelled.
+var reconnectGrace = envDuration("WS_RECONNECT_GRACE", 2*time.Minute)
+
+// errNoEvents is returned when a deployment has no buffered events the user may see.
+var errNoEvents = errors.New("no events recorded for this deployment")
+
+// eventLog buffers a deployment's events, numbered by a monotonic sequence starting at 1,
+// and forwards each to the connections subscribed to the deployment. A client that
+// reconnects subscribes with the last sequence number it saw to replay the events it missed.
+//
+// Every event is also written to deploymentStore so it can be fetched after the log is
+// pruned. Subscribers that hold the deployment keep it running: it is cancelled once the
+// last of them has been gone for reconnectGrace.
+type eventLog struct {
+	mu           sync.Mutex
+	deploymentID string
+	userID       string
+	cancel       func()
+	events       []Event
+	// sinks maps each subscriber to whether it holds the deployment.
+	sinks      map[eventSink]bool
+	orphaned   *time.Timer
+	finishedAt time.Time
+	done       chan struct{}
+}
+
+// eventLogs holds the event logs of in-flight deployments and of deployments that finished
+// within eventRetention, keyed by deployment ID.
+var (
+	eventLogsMu sync.Mutex
+	eventLogs   = map[string]*eventLog{}
+)
+
+// newEventLog creates and registers the event log of a deployment, subscribing sink as a
+// holder if it is not nil. cancel is called if every holder disconnects and none returns in time.
+func newEventLog(id, userID string, sink eventSink, cancel func()) *eventLog {
+	l := &eventLog{deploymentID: id, userID: userID, cancel: cancel, sinks: map[eventSink]bool{}, done: make(chan struct{})}
+	if sink != nil {
+		l.sinks[sink] = true
+	}
+	eventLogsMu.Lock()
+	defer eventLogsMu.Unlock()
+	pruneEventLogsLocked()
+	eventLogs[id] = l
+	return l
+}
+
+// eventLogFor returns the event log of a deployment owned by userID.
+func eventLogFor(id, userID string) (*eventLog, error) {
+	eventLogsMu.Lock()
+	l, ok := eventLogs[id]
+	eventLogsMu.Unlock()
+	if !ok || l.userID != userID {
+		return nil, errNoEvents
+	}
+	return l, nil
+}
+
+// pruneEventLogsLocked drops the logs of deployments that finished more than eventRetention
+// ago. eventLogsMu must be held.
+func pruneEventLogsLocked() {
+	for id, l := range eventLogs {
+		l.mu.Lock()
+		expired := !l.finishedAt.IsZero() && time.Since(l.finishedAt) > eventRetention
+		l.mu.Unlock()
+		if expired {
+			delete(eventLogs, id)
+		}
+	}
+}
+
+// publish numbers and timestamps an event, buffers and persists it, and writes it to every subscriber.
+func (l *eventLog) publish(logger *slog.Logger, event Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	event.Seq = len(l.events) + 1
+	event.Timestamp = time.Now().UTC()
+	l.events = append(l.events, event)
+	if err := deploymentStore.AppendEvent(context.Background(), l.deploymentID, event); err != nil {
+		logger.Error("Error persisting deployment event", "error", err)
+	}
+	logger.Info("Sending WebSocket message", "event", event.Event, "message", event.Message, "seq", event.Seq)
+	for sink := range l.sinks {
+		if err := sink.WriteJSON(event); err != nil {
+			logger.Error("Error sending websocket message", "error", err)
+		}
+	}
+}
+
+// since returns the buffered events with sequence numbers greater than after.
+func (l *eventLog) since(after int) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sinceLocked(after)
+}
+
+func (l *eventLog) sinceLocked(after int) []Event {
+	if after < 0 {
+		after = 0
+	}
+	if after >= len(l.events) {
+		return []Event{}
+	}
+	return append([]Event(nil), l.events[after:]...)
+}
+
+// subscribe replays the events after the given sequence number to sink and, if the
+// deployment is still running, subscribes it to the events that follow. A sink that holds
+// the deployment keeps it from being cancelled as abandoned. It reports whether sink was
+// subscribed.
+func (l *eventLog) subscribe(logger *slog.Logger, sink eventSink, after int, holds bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, event := range l.sinceLocked(after) {
+		if err := sink.WriteJSON(event); err != nil {
+			logger.Error("Error replaying websocket message", "error", err)
+			return false
+		}
+	}
+	if !l.finishedAt.IsZero() {
+		return false
+	}
+	l.sinks[sink] = holds
+	if holds && l.orphaned != nil {
+		l.orphaned.Stop()
+		l.orphaned = nil
+	}
+	return true
+}
+
+// holdersLocked reports how many subscribers hold the deployment. l.mu must be held.
+func (l *eventLog) holdersLocked() int {
+	n := 0
+	for _, holds := range l.sinks {
+		if holds {
+			n++
+		}
+	}
+	return n
+}
+
+// unsubscribe stops forwarding events to sink. When the last holder of a running deployment
+// goes, the deployment is cancelled unless a holder subscribes within reconnectGrace.
+func (l *eventLog) unsubscribe(logger *slog.Logger, sink eventSink) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	holds, ok := l.sinks[sink]
+	if !ok {
+		return
+	}
+	delete(l.sinks, sink)
+	if !holds || l.holdersLocked() > 0 || !l.finishedAt.IsZero() || l.orphaned != nil {
+		return
+	}
+	logger.Info("Client disconnected; waiting for it to reconnect", "grace", reconnectGrace)
+	l.orphaned = time.AfterFunc(reconnectGrace, func() {
+		l.mu.Lock()
+		abandoned := l.holdersLocked() == 0 && l.orphaned != nil
+		l.mu.Unlock()
+		if abandoned {
+			logger.Info("Client did not reconnect; cancelling deployment")
+			l.cancel()
+		}
+	})
+}
+
+// finish marks the deployment as done, dropping its subscribers and starting the
+// retention period of its events.
+func (l *eventLog) finish() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.finishedAt = time.Now()
+	l.sinks = map[eventSink]bool{}
+	if l.orphaned != nil {
+		l.orphaned.Stop()
+		l.orphaned = nil
+	}
+	close(l.done)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Namespace garbage collection settings: managed namespaces older than namespaceTTL, or past
+// the expiry their deployment's TTL set, are deleted, checked every namespaceGCInterval.
+var (
+	namespaceTTL        = envDuration("NAMESPACE_TTL", 7*24*time.Hour)
+	namespaceGCInterval time.Duration
+)
+
+// runNamespaceGC periodically deletes expired managed namespaces in every cluster until ctx
+// is cancelled.
+func runNamespaceGC(ctx context.Context) {
+	ticker := time.NewTicker(namespaceGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, c := range clusters {
+				collectExpiredNamespaces(withCluster(ctx, c))
+			}
+		}
+	}
+}
+
+// collectExpiredNamespaces deletes managed namespaces in the cluster selected for ctx whose
+// creation annotation is older than namespaceTTL or whose expiry annotation has passed,
+// reporting those that reached their deployment's TTL. Namespaces without the management
+// label are never listed, so never touched, and those already being deleted are skipped.
+func collectExpiredNamespaces(ctx context.Context) {
+	list, err := kubeFor(ctx).CoreV1().Namespaces().List(ctx, metav1.ListOptions{
+		LabelSelector: managedByLabel + "=" + managedByValue,
+	})
+	if err != nil {
+		log.Printf("Error listing managed namespaces in cluster %s: %v", clusterFrom(ctx).Name, err)
+		return
+	}
+	for i := range list.Items {
+		ns := &list.Items[i]
+		if ns.Status.Phase == corev1.NamespaceTerminating {
+			continue
+		}
+		expiresAt, hasTTL := namespaceExpiry(ns)
+		ttlExpired := hasTTL && time.Now().After(expiresAt)
+		if !ttlExpired {
+			createdAt, err := time.Parse(time.RFC3339, ns.Annotations[createdAtAnnotation])
+			if err != nil {
+				log.Printf("Skipping namespace %s with missing or invalid %s annotation", ns.Name, createdAtAnnotation)
+				continue
+			}
+			if time.Since(createdAt) < namespaceTTL {
+				continue
+			}
+		}
+		// A namespace in use is collected on a later pass instead of waiting for it.
+		unlock, ok := namespaceLocks.tryLock(namespaceKey(clusterFrom(ctx).Name, ns.Name))
+		if !ok {
+			log.Printf("Namespace %s expired but is in use, deleting it later", ns.Name)
+			continue
+		}
+		if ttlExpired {
+			log.Printf("Namespace %s reached its TTL (expired %s), deleting", ns.Name, expiresAt.Format(time.RFC3339))
+		} else {
+			log.Printf("Namespace %s expired (created %s), deleting", ns.Name, ns.Annotations[createdAtAnnotation])
+		}
+		err := deleteNamespace(ctx, slog.Default(), ns.Name)
+		unlock()
+		if err == nil && ttlExpired {
+			reportTTLExpired(ctx, ns)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// refPattern matches branch and tag names, optionally fully qualified under refs/.
+var refPattern = regexp.MustCompile(`^[A-Za-z0-9._][A-Za-z0-9._/-]*$`)
+
+// refResolveTimeout bounds the git ls-remote used to resolve a ref to a commit.
+var refResolveTimeout time.Duration
+
+// validateRevision checks that the payload names exactly one revision, either a commit hash or a ref.
+func validateRevision(payload DeploymentPayload) error {
+	switch {
+	case payload.CommitHash != "" && payload.Ref != "":
+		return errors.New("only one of commitHash and ref may be set")
+	case payload.Ref != "":
+		return validateRef(payload.Ref)
+	case payload.CommitHash != "":
+		return validateCommitHash(payload.CommitHash)
+	default:
+		return errors.New("one of commitHash or ref is required")
+	}
+}
+
+// validateRef checks that ref is a legal git branch or tag name.
+func validateRef(ref string) error {
+	if !refPattern.MatchString(ref) || strings.Contains(ref, "..") || strings.Contains(ref, "//") ||
+		strings.HasSuffix(ref, "/") || strings.HasSuffix(ref, ".") || strings.HasSuffix(ref, ".lock") {
+		return fmt.Errorf("ref %q is not a valid branch or tag name", ref)
+	}
+	return nil
+}
+
+// resolveRef resolves a branch or tag of the repository to the commit it points at, so the
+// deployment's namespace stays tied to a concrete commit. Annotated tags resolve to the
+// commit they tag. A name that matches both a branch and a tag is rejected as ambiguous.
+// cred, if not nil, authenticates git against a private repository.
+func resolveRef(ctx context.Context, repoURL, ref string, cred *repoCredential) (string, error) {
+	candidates := []string{ref}
+	if !strings.HasPrefix(ref, "refs/") {
+		candidates = []string{"refs/heads/" + ref, "refs/tags/" + ref}
+	}
+	args := []string{"ls-remote", "--", repoURL}
+	for _, c := range candidates {
+		args = append(args, c, c+"^{}")
+	}
+	var env []string
+	if cred != nil {
+		credEnv, cleanup, err := gitCredentialEnv(*cred)
+		if err != nil {
+			return "", fmt.Errorf("preparing repository credentials: %w", err)
+		}
+		defer cleanup()
+		env = credEnv
+	}
+	output, err := runCommandEnv(ctx, refResolveTimeout, env, "git", args...)
+	if err != nil {
+		return "", fmt.Errorf("git ls-remote failed: %w\nOutput: %s", err, output)
+	}
+
+	// Map each ref to its commit, letting a peeled tag override the tag object itself.
+	commits := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		hash, name, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		if peeled, isPeeled := strings.CutSuffix(name, "^{}"); isPeeled {
+			commits[peeled] = hash
+		} else if _, seen := commits[name]; !seen {
+			commits[name] = hash
+		}
+	}
+
+	var matched []string
+	for _, c := range candidates {
+		if _, ok := commits[c]; ok {
+			matched = append(matched, c)
+		}
+	}
+	switch len(matched) {
+	case 0:
+		return "", fmt.Errorf("ref %q not found in repository", ref)
+	case 1:
+		commit := commits[matched[0]]
+		if err := validateCommitHash(commit); err != nil {
+			return "", fmt.Errorf("git ls-remote returned an unexpected object name: %w", err)
+		}
+		return commit, nil
+	default:
+		return "", fmt.Errorf("ref %q is ambiguous: matches %s", ref, strings.Join(matched, " and "))
+	}
+}
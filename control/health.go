@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Production endpoint readiness check settings.
+var (
+	healthCheckPath     = envString("HEALTH_CHECK_PATH", "/")
+	healthCheckTimeout  time.Duration
+	healthCheckInterval time.Duration
+)
+
+// healthCheckClient does not follow redirects, so a 3xx response counts as healthy.
+var healthCheckClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// waitForEndpointHealthy polls the given path of the endpoint until it answers with a 2xx
+// or 3xx status, or healthCheckTimeout elapses.
+func waitForEndpointHealthy(ctx context.Context, endpoint, path string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	url := strings.TrimSuffix(endpoint, "/") + "/" + strings.TrimPrefix(path, "/")
+	logger := loggerFrom(ctx)
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		lastErr = checkEndpoint(ctx, url)
+		if lastErr == nil {
+			return nil
+		}
+		logger.Info("Endpoint not healthy yet", "url", url, "error", lastErr)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("endpoint %s not healthy after %s: %w", url, healthCheckTimeout, lastErr)
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkEndpoint performs a single health check request.
+func checkEndpoint(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := healthCheckClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
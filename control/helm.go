@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Deployment types selectable with DeploymentPayload.DeployType.
+const (
+	// DeployTypeTemplate deploys the built-in production templates. It is the default.
+	DeployTypeTemplate = "template"
+	// DeployTypeHelm installs a user-supplied Helm chart instead.
+	DeployTypeHelm = "helm"
+)
+
+// helmTimeout bounds a helm upgrade --install, including waiting for the release to roll out.
+var helmTimeout time.Duration
+
+// helmReleaseName is the name of the Helm release installed in each deployment namespace.
+const helmReleaseName = "prod-app"
+
+// helmChartPattern matches chart references such as "bitnami/nginx", "nginx", or an
+// OCI reference with the oci:// prefix removed.
+var helmChartPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+// helmValueKeyPattern matches Helm --set keys such as "image.tag" or "ingress.hosts[0].host".
+var helmValueKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+(\[[0-9]+\])?(\.[A-Za-z0-9_-]+(\[[0-9]+\])?)*$`)
+
+// helmChartVersionPattern matches semantic versions and version constraints Helm accepts.
+var helmChartVersionPattern = regexp.MustCompile(`^[A-Za-z0-9.+~^<>=*-]+$`)
+
+// resolveDeployType applies the default to the payload's deploy type and validates it,
+// along with the Helm fields when a Helm deployment is requested.
+func resolveDeployType(payload DeploymentPayload) (string, error) {
+	switch payload.DeployType {
+	case "", DeployTypeTemplate:
+		return DeployTypeTemplate, nil
+	case DeployTypeHelm:
+		return DeployTypeHelm, validateHelmPayload(payload)
+	default:
+		return "", fmt.Errorf("deploy type %q must be %q or %q", payload.DeployType, DeployTypeTemplate, DeployTypeHelm)
+	}
+}
+
+// validateHelmPayload checks the chart reference, repository, version, and value overrides of a Helm deployment.
+func validateHelmPayload(payload DeploymentPayload) error {
+	chart := strings.TrimPrefix(payload.HelmChart, "oci://")
+	if chart == "" {
+		return errors.New("helmChart is required for helm deployments")
+	}
+	if !helmChartPattern.MatchString(chart) || strings.Contains(chart, "..") {
+		return fmt.Errorf("helm chart %q is invalid", payload.HelmChart)
+	}
+	if strings.HasPrefix(payload.HelmChart, "oci://") {
+		if payload.HelmRepo != "" {
+			return errors.New("helmRepo must not be set for oci:// charts")
+		}
+		if err := validateRepoHost(strings.SplitN(chart, "/", 2)[0]); err != nil {
+			return err
+		}
+	}
+	if payload.HelmRepo != "" {
+		u, err := url.Parse(payload.HelmRepo)
+		if err != nil {
+			return fmt.Errorf("malformed helm repository URL: %w", err)
+		}
+		if u.Scheme != "https" {
+			return errors.New("helm repository URL must use https")
+		}
+		if u.User != nil {
+			return errors.New("helm repository URL must not contain credentials")
+		}
+		if err := validateRepoHost(u.Hostname()); err != nil {
+			return err
+		}
+	}
+	if payload.HelmChartVersion != "" && !helmChartVersionPattern.MatchString(payload.HelmChartVersion) {
+		return fmt.Errorf("helm chart version %q is invalid", payload.HelmChartVersion)
+	}
+	for key := range payload.HelmValues {
+		if !helmValueKeyPattern.MatchString(key) {
+			return fmt.Errorf("helm value key %q is invalid", key)
+		}
+	}
+	return nil
+}
+
+// helmUpgradeArgs builds the helm upgrade --install arguments for a payload's chart and value overrides.
+func helmUpgradeArgs(namespace string, payload DeploymentPayload) []string {
+	args := []string{
+		"upgrade", "--install", helmReleaseName, payload.HelmChart,
+		"--namespace", namespace,
+		"--wait",
+		"--timeout", helmTimeout.String(),
+	}
+	if payload.HelmRepo != "" {
+		args = append(args, "--repo", payload.HelmRepo)
+	}
+	if payload.HelmChartVersion != "" {
+		args = append(args, "--version", payload.HelmChartVersion)
+	}
+
+	keys := make([]string, 0, len(payload.HelmValues))
+	for key := range payload.HelmValues {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "--set-string", key+"="+escapeHelmValue(payload.HelmValues[key]))
+	}
+	return args
+}
+
+// escapeHelmValue escapes the characters helm --set treats as separators so the value is taken literally.
+func escapeHelmValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `,`, `\,`).Replace(value)
+}
+
+// deployHelmRelease installs or upgrades the payload's chart in namespace and waits for it
+// to roll out, reporting the release status to the client.
+func deployHelmRelease(ctx context.Context, deployment *Deployment, namespace string, payload DeploymentPayload) error {
+	deployment.send("helm_install", fmt.Sprintf("Installing Helm chart %s as release %s", payload.HelmChart, helmReleaseName))
+	// Allow a little longer than helm's own --timeout so it can report why the rollout stalled.
+	output, err := runCommand(ctx, helmTimeout+time.Minute, "helm", helmUpgradeArgs(namespace, payload)...)
+	if err != nil {
+		return fmt.Errorf("%w\nOutput: %s", err, output)
+	}
+
+	status, err := runCommand(ctx, 30*time.Second, "helm", "status", helmReleaseName, "--namespace", namespace)
+	if err != nil {
+		loggerFrom(ctx).Error("Error reading helm release status", "error", err, "output", status)
+		status = output
+	}
+	deployment.send("helm_status", status)
+	return nil
+}
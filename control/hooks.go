@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// hookPoint is a point of the deployment workflow at which operator hooks run.
+type hookPoint string
+
+const (
+	// hookPreNamespace runs before the deployment's namespace is created.
+	hookPreNamespace hookPoint = "pre_namespace"
+	// hookPostTest runs once the tests have passed, or were skipped.
+	hookPostTest hookPoint = "post_test"
+	// hookPreProd runs before the production version is deployed.
+	hookPreProd hookPoint = "pre_prod"
+	// hookPostSuccess runs once the deployment has succeeded.
+	hookPostSuccess hookPoint = "post_success"
+	// hookOnFailure runs once the deployment has failed.
+	hookOnFailure hookPoint = "on_failure"
+)
+
+// hookPointsBeforeOutcome maps each hook point to whether it comes before the deployment's
+// outcome is known, so a failing hook there may still fail it.
+var hookPointsBeforeOutcome = map[hookPoint]bool{
+	hookPreNamespace: true,
+	hookPostTest:     true,
+	hookPreProd:      true,
+	hookPostSuccess:  false,
+	hookOnFailure:    false,
+}
+
+// defaultHookTimeout bounds hooks that set no timeout of their own.
+const defaultHookTimeout = time.Minute
+
+// maxHookOutputBytes bounds the output of a hook command quoted in events.
+const maxHookOutputBytes = 2 << 10
+
+// hookConfig is an operator hook, set in the hooks list of the config file. Each runs either
+// a command, given the deployment's metadata as JSON on its standard input and as
+// environment variables, or a webhook, sent the metadata as a JSON POST.
+type hookConfig struct {
+	Name  string    `json:"name"`
+	Point hookPoint `json:"point"`
+	// Command is the program and arguments to run.
+	Command []string `json:"command,omitempty"`
+	// URL is the http or https URL to POST to; a response other than 2xx fails the hook.
+	URL     string   `json:"url,omitempty"`
+	Timeout duration `json:"timeout,omitempty"`
+	// FailDeployment makes a failing hook fail the deployment instead of only warning. It
+	// defaults to true at pre_namespace and pre_prod and to false elsewhere, and may only be
+	// set at the points before the deployment's outcome is known.
+	FailDeployment *bool `json:"failDeployment,omitempty"`
+}
+
+// hooks holds the configured hooks in the order they run, set from Config.
+var hooks []hookConfig
+
+// failsDeployment reports whether the hook failing fails the deployment.
+func (h hookConfig) failsDeployment() bool {
+	if h.FailDeployment != nil {
+		return *h.FailDeployment
+	}
+	return h.Point == hookPreNamespace || h.Point == hookPreProd
+}
+
+// validateHooks reports every hook that is malformed.
+func validateHooks(list []hookConfig) error {
+	var errs []error
+	for i, h := range list {
+		label := fmt.Sprintf("hook %d (%s)", i, h.Name)
+		if h.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: name must be set", label))
+		}
+		beforeOutcome, ok := hookPointsBeforeOutcome[h.Point]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown point %q", label, h.Point))
+		}
+		if (len(h.Command) > 0) == (h.URL != "") {
+			errs = append(errs, fmt.Errorf("%s: exactly one of command and url must be set", label))
+		}
+		if h.URL != "" {
+			if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Errorf("%s: url must be an absolute http or https URL", label))
+			}
+		}
+		if h.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("%s: timeout must not be negative", label))
+		}
+		if ok && !beforeOutcome && h.FailDeployment != nil && *h.FailDeployment {
+			errs = append(errs, fmt.Errorf("%s: failDeployment cannot be set at %s, after the deployment has finished", label, h.Point))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// hookPayload is the deployment metadata hooks are given.
+type hookPayload struct {
+	Point        hookPoint        `json:"point"`
+	DeploymentID string           `json:"deploymentID"`
+	UserID       string           `json:"userID"`
+	RepoURL      string           `json:"repoURL"`
+	CommitHash   string           `json:"commitHash"`
+	Namespace    string           `json:"namespace,omitempty"`
+	Cluster      string           `json:"cluster,omitempty"`
+	Status       DeploymentStatus `json:"status"`
+	Endpoint     string           `json:"endpoint,omitempty"`
+	// ErrorCode and Error describe the failure of a deployment at on_failure.
+	ErrorCode errorCode `json:"errorCode,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// env returns the metadata as environment variables for hook commands.
+func (p hookPayload) env() []string {
+	return []string{
+		"HOOK_POINT=" + string(p.Point),
+		"DEPLOYMENT_ID=" + p.DeploymentID,
+		"DEPLOYMENT_USER_ID=" + p.UserID,
+		"DEPLOYMENT_REPO_URL=" + p.RepoURL,
+		"DEPLOYMENT_COMMIT_HASH=" + p.CommitHash,
+		"DEPLOYMENT_NAMESPACE=" + p.Namespace,
+		"DEPLOYMENT_CLUSTER=" + p.Cluster,
+		"DEPLOYMENT_STATUS=" + string(p.Status),
+		"DEPLOYMENT_ENDPOINT=" + p.Endpoint,
+		"DEPLOYMENT_ERROR_CODE=" + string(p.ErrorCode),
+		"DEPLOYMENT_ERROR=" + p.Error,
+	}
+}
+
+// runHooks runs the hooks configured at point, in order. A failing hook that fails the
+// deployment stops the rest and its error is returned, for the caller to fail the
+// deployment with; any other failing hook is reported to the client as hook_warning.
+// failure describes the deployment's failure at on_failure, and is nil elsewhere.
+func (d *Deployment) runHooks(ctx context.Context, point hookPoint, failure *Event) error {
+	var payload *hookPayload
+	for _, h := range hooks {
+		if h.Point != point {
+			continue
+		}
+		if payload == nil {
+			rec := deployments.Record(d)
+			payload = &hookPayload{
+				Point:        point,
+				DeploymentID: rec.ID,
+				UserID:       rec.UserID,
+				RepoURL:      rec.RepoURL,
+				CommitHash:   rec.CommitHash,
+				Namespace:    rec.Namespace,
+				Cluster:      rec.Cluster,
+				Status:       rec.Status,
+				Endpoint:     rec.Endpoint,
+			}
+			if failure != nil {
+				payload.ErrorCode, payload.Error = failure.Code, failure.Message
+			}
+		}
+		started := time.Now()
+		err := runHook(ctx, h, *payload)
+		if err == nil {
+			d.logger.Info("Hook succeeded", "hook", h.Name, "point", point, "duration", time.Since(started))
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = fmt.Errorf("hook %s failed: %w", h.Name, err)
+		if h.failsDeployment() {
+			d.logger.Error("Hook failed", "hook", h.Name, "point", point, "error", err)
+			return err
+		}
+		d.logger.Warn("Hook failed", "hook", h.Name, "point", point, "error", err)
+		d.send("hook_warning", fmt.Sprintf("The %s hook %s failed; continuing: %v", point, h.Name, err))
+	}
+	return nil
+}
+
+// runHook runs one hook with the given metadata, within its timeout.
+func runHook(ctx context.Context, h hookConfig, payload hookPayload) error {
+	timeout := time.Duration(h.Timeout)
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if len(h.Command) > 0 {
+		output, err := commandRunner.Run(ctx, timeout, Command{
+			Name:  h.Command[0],
+			Args:  h.Command[1:],
+			Env:   payload.env(),
+			Stdin: string(body),
+		})
+		if err != nil && output != "" {
+			if len(output) > maxHookOutputBytes {
+				output = output[len(output)-maxHookOutputBytes:]
+			}
+			err = fmt.Errorf("%w\nOutput: %s", err, output)
+		}
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
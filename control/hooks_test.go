@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func withHooks(t *testing.T, list ...hookConfig) {
+	t.Helper()
+	if err := validateHooks(list); err != nil {
+		t.Fatal(err)
+	}
+	old := hooks
+	hooks = list
+	t.Cleanup(func() { hooks = old })
+}
+
+func TestValidateHooks(t *testing.T) {
+	yes := true
+	tests := []struct {
+		name string
+		hook hookConfig
+		want string
+	}{
+		{"command", hookConfig{Name: "notify", Point: hookPostSuccess, Command: []string{"notify"}}, ""},
+		{"webhook", hookConfig{Name: "notify", Point: hookPreProd, URL: "https://hooks.example.com/x"}, ""},
+		{"no name", hookConfig{Point: hookPreProd, Command: []string{"x"}}, "name must be set"},
+		{"unknown point", hookConfig{Name: "x", Point: "post_deploy", Command: []string{"x"}}, "unknown point"},
+		{"neither", hookConfig{Name: "x", Point: hookPreProd}, "exactly one of"},
+		{"both", hookConfig{Name: "x", Point: hookPreProd, Command: []string{"x"}, URL: "https://example.com"}, "exactly one of"},
+		{"bad url", hookConfig{Name: "x", Point: hookPreProd, URL: "ftp://example.com"}, "absolute http"},
+		{"fail after outcome", hookConfig{Name: "x", Point: hookOnFailure, Command: []string{"x"}, FailDeployment: &yes}, "cannot be set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateHooks([]hookConfig{tt.hook})
+			if tt.want == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+				t.Errorf("error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunHooksPassesMetadata(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "payload.json")
+	withHooks(t, hookConfig{Name: "record", Point: hookPreNamespace, Command: []string{"sh", "-c", `cat > "$0" && test "$HOOK_POINT" = pre_namespace`, out}})
+	d, ctx := newTestDeployment(t, DeploymentPayload{UserID: "user-1", RepoURL: "https://github.com/org/app", CommitHash: "abc123"})
+
+	if err := d.runHooks(ctx, hookPreNamespace, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got hookPayload
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Point != hookPreNamespace || got.DeploymentID != d.ID || got.RepoURL != "https://github.com/org/app" || got.CommitHash != "abc123" {
+		t.Errorf("hook got %+v", got)
+	}
+}
+
+func TestRunHooksPreHookFailureAborts(t *testing.T) {
+	withHooks(t,
+		hookConfig{Name: "migrate", Point: hookPreProd, Command: []string{"false"}},
+		hookConfig{Name: "never", Point: hookPreProd, Command: []string{"sh", "-c", "exit 3"}},
+	)
+	d, ctx := newTestDeployment(t, DeploymentPayload{UserID: "user-1"})
+	err := d.runHooks(ctx, hookPreProd, nil)
+	if err == nil || !strings.Contains(err.Error(), "hook migrate failed") {
+		t.Errorf("err = %v, want the migrate hook's failure", err)
+	}
+}
+
+func TestRunHooksPostHookFailureWarns(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	withHooks(t, hookConfig{Name: "slack", Point: hookPostSuccess, URL: srv.URL})
+	d, ctx := newTestDeployment(t, DeploymentPayload{UserID: "user-1"})
+	if err := d.runHooks(ctx, hookPostSuccess, nil); err != nil {
+		t.Errorf("post_success hook failure failed the deployment: %v", err)
+	}
+	if !slices.Contains(sentEvents(d), "hook_warning") {
+		t.Errorf("events = %v, want a hook_warning", sentEvents(d))
+	}
+}
+
+func TestFailRunsFailureHooks(t *testing.T) {
+	var got hookPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+	withHooks(t, hookConfig{Name: "page", Point: hookOnFailure, URL: srv.URL})
+	d, _ := newTestDeployment(t, DeploymentPayload{UserID: "user-1"})
+	d.fail("deployment_error", codeApplyFailed, "boom")
+	if got.Point != hookOnFailure || got.ErrorCode != codeApplyFailed || got.Error != "boom" || got.Status != StatusFailed {
+		t.Errorf("hook got %+v", got)
+	}
+}
+
+func TestRunHooksSkipsOtherPoints(t *testing.T) {
+	withHooks(t, hookConfig{Name: "x", Point: hookPreProd, Command: []string{"false"}})
+	d, _ := newTestDeployment(t, DeploymentPayload{UserID: "user-1"})
+	if err := d.runHooks(context.Background(), hookPostTest, nil); err != nil {
+		t.Errorf("a pre_prod hook ran at post_test: %v", err)
+	}
+}
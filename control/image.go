@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// prodContainerName is the container of the production pods that runs the app.
+const prodContainerName = "prod-container"
+
+// runningImage is the image a container is running: the reference it was started from and,
+// when the runtime reports one, the digest identifying the exact image pulled.
+type runningImage struct {
+	Image  string
+	Digest string
+}
+
+// prodVersionImage returns the image the app container of the color's ready pods runs, as
+// reported in the pods' container statuses.
+func prodVersionImage(ctx context.Context, namespace, color string) (runningImage, error) {
+	selector := labels.SelectorFromSet(labels.Set{"app": prodDeploymentName, versionLabel: color}).String()
+	pods, err := kubeFor(ctx).CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return runningImage{}, err
+	}
+	for i := range pods.Items {
+		if !podReady(&pods.Items[i]) {
+			continue
+		}
+		for _, status := range pods.Items[i].Status.ContainerStatuses {
+			if status.Name == prodContainerName {
+				return runningImage{Image: status.Image, Digest: imageDigest(status.ImageID)}, nil
+			}
+		}
+	}
+	return runningImage{}, fmt.Errorf("no ready pod matching %s reports a %s container", selector, prodContainerName)
+}
+
+// imageDigest extracts the digest from a container status imageID, such as
+// "docker-pullable://registry/app@sha256:..." or "sha256:...", or returns "" if it has none.
+func imageDigest(imageID string) string {
+	if _, digest, ok := strings.Cut(imageID, "@"); ok {
+		return digest
+	}
+	if strings.HasPrefix(imageID, "sha256:") {
+		return imageID
+	}
+	return ""
+}
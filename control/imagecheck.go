@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Image existence check settings. With imageCheckEnabled, set from Config along with
+// imageCheckTimeout, deployments of prebuilt images first ask the image's registry for its
+// manifest, signing in with the credentials for the registry in registryCredentialsFile, a
+// Docker config.json such as a mounted kubernetes.io/dockerconfigjson Secret.
+// insecureRegistries lists, comma-separated, the registry hosts that are reached over plain
+// HTTP.
+var (
+	imageCheckEnabled       bool
+	imageCheckTimeout       time.Duration
+	registryCredentialsFile = envString("REGISTRY_CREDENTIALS_FILE", "")
+	insecureRegistries      = envString("INSECURE_REGISTRIES", "")
+)
+
+// Docker Hub is named docker.io in image references and credentials, but serves the
+// registry API from registry-1.docker.io.
+const (
+	dockerHubRegistry = "docker.io"
+	dockerHubAPIHost  = "registry-1.docker.io"
+)
+
+// manifestMediaTypes are the manifest formats the check accepts, in the registry's Accept
+// header: registries answer 404 for a manifest they hold only in formats not listed.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// registryClient talks to registries and their token services. It connects only to public
+// addresses, except for insecureRegistries, and does not follow redirects, which could
+// point anywhere.
+var registryClient = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: &http.Transport{DialContext: dialRegistry, TLSHandshakeTimeout: 10 * time.Second},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// insecureRegistryDialer connects to the registries listed in insecureRegistries, which may
+// be internal.
+var insecureRegistryDialer = &net.Dialer{Timeout: 10 * time.Second}
+
+// dialRegistry connects to address for registryClient. Hosts named by image references and
+// token challenges may resolve to anything, so unless the operator listed the registry in
+// insecureRegistries the resolved address is checked with publicDialer.
+func dialRegistry(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if insecureRegistry(address) || insecureRegistry(host) {
+		return insecureRegistryDialer.DialContext(ctx, network, address)
+	}
+	return publicDialer.DialContext(ctx, network, address)
+}
+
+// errImageNotFound is returned when the registry reports that an image does not exist.
+var errImageNotFound = errors.New("image not found")
+
+// imageLocation is where an image reference's manifest is served from.
+type imageLocation struct {
+	// Registry is the registry host as the reference names it, docker.io if it names none.
+	Registry string
+	// Repository is the repository path in the registry, such as library/nginx.
+	Repository string
+	// Reference is the digest the reference pins, or else its tag, latest if it has none.
+	Reference string
+}
+
+// parseImageLocation splits an image reference accepted by validateImage as a container
+// runtime does: the first path component is a registry host only if it has a dot or a port,
+// or is localhost, and single-component Docker Hub repositories are official images.
+func parseImageLocation(image string) imageLocation {
+	name, digest, pinned := strings.Cut(image, "@")
+	loc := imageLocation{Registry: dockerHubRegistry, Repository: imageRepository(name), Reference: "latest"}
+	if pinned {
+		loc.Reference = digest
+	} else if tag := strings.TrimPrefix(name, loc.Repository); tag != "" {
+		loc.Reference = strings.TrimPrefix(tag, ":")
+	}
+	if host, path, ok := strings.Cut(loc.Repository, "/"); ok && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		loc.Registry, loc.Repository = host, path
+	}
+	if loc.Registry == dockerHubRegistry && !strings.Contains(loc.Repository, "/") {
+		loc.Repository = "library/" + loc.Repository
+	}
+	return loc
+}
+
+// insecureRegistry reports whether the registry is listed in insecureRegistries.
+func insecureRegistry(registry string) bool {
+	for _, insecure := range strings.Split(insecureRegistries, ",") {
+		if strings.TrimSpace(insecure) == registry {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRegistryHost refuses to contact a host named by a user's image reference or by a
+// registry's token challenge if it is internal, unless the operator listed it in
+// insecureRegistries, so the check cannot be used to probe the cluster network.
+func checkRegistryHost(hostport string) error {
+	if insecureRegistry(hostport) {
+		return nil
+	}
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	return validateRepoHost(strings.Trim(host, "[]"))
+}
+
+// manifestURL returns the URL of the location's manifest in the registry API.
+func (loc imageLocation) manifestURL() string {
+	scheme, host := "https", loc.Registry
+	if host == dockerHubRegistry {
+		host = dockerHubAPIHost
+	}
+	if insecureRegistry(loc.Registry) {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, host, loc.Repository, loc.Reference)
+}
+
+// registryCredential is a user name and password for a registry.
+type registryCredential struct {
+	Username string
+	Password string
+}
+
+// dockerConfig is the part of a Docker config.json holding registry credentials.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+}
+
+// registryCredentialFor returns the credential registryCredentialsFile holds for the
+// registry, or nil if there is none. The file is read on every check, so rotated
+// credentials are picked up without a restart.
+func registryCredentialFor(registry string) (*registryCredential, error) {
+	if registryCredentialsFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(registryCredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var config dockerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", registryCredentialsFile, err)
+	}
+	keys := []string{registry}
+	if registry == dockerHubRegistry {
+		keys = append(keys, "https://index.docker.io/v1/", "index.docker.io", dockerHubAPIHost)
+	}
+	for key, entry := range config.Auths {
+		// Keys may be written as URLs, such as https://ghcr.io or https://ghcr.io/v1/.
+		host := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+		host, _, _ = strings.Cut(host, "/")
+		for _, want := range keys {
+			if key != want && host != want {
+				continue
+			}
+			if entry.Auth == "" {
+				return &registryCredential{Username: entry.Username, Password: entry.Password}, nil
+			}
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("credential for %s in %s is not valid base64", key, registryCredentialsFile)
+			}
+			user, password, _ := strings.Cut(string(decoded), ":")
+			return &registryCredential{Username: user, Password: password}, nil
+		}
+	}
+	return nil, nil
+}
+
+// checkImageExists asks the image's registry whether its manifest exists, returning
+// errImageNotFound if the registry says it does not. Any other error means the check could
+// not tell, such as when the registry is unreachable or refuses the credentials.
+func checkImageExists(ctx context.Context, image string) error {
+	ctx, cancel := context.WithTimeout(ctx, imageCheckTimeout)
+	defer cancel()
+	loc := parseImageLocation(image)
+	if err := checkRegistryHost(loc.Registry); err != nil {
+		return fmt.Errorf("registry %s: %w", loc.Registry, err)
+	}
+	cred, err := registryCredentialFor(loc.Registry)
+	if err != nil {
+		return err
+	}
+
+	resp, err := headManifest(ctx, loc, "")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		authorization, err := registryAuthorization(ctx, resp.Header.Get("WWW-Authenticate"), loc, cred)
+		if err != nil {
+			return err
+		}
+		if resp, err = headManifest(ctx, loc, authorization); err != nil {
+			return err
+		}
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%w: %s has no manifest %s in %s", errImageNotFound, loc.Repository, loc.Reference, loc.Registry)
+	default:
+		return fmt.Errorf("registry %s answered %s for %s", loc.Registry, resp.Status, image)
+	}
+}
+
+// headManifest sends a HEAD request for the location's manifest with the given
+// Authorization header, if any.
+func headManifest(ctx context.Context, loc imageLocation, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, loc.manifestURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// registryAuthorization answers a registry's WWW-Authenticate challenge, returning the
+// Authorization header to retry with: the credential itself for a Basic challenge, and for
+// a Bearer challenge a pull token for the repository from the registry's token service,
+// which hands out anonymous tokens for public images when there is no credential.
+func registryAuthorization(ctx context.Context, challenge string, loc imageLocation, cred *registryCredential) (string, error) {
+	scheme, params := parseAuthChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if cred == nil {
+			return "", fmt.Errorf("registry %s requires credentials", loc.Registry)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(cred.Username+":"+cred.Password)), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("registry %s sent an unsupported authentication challenge %q", loc.Registry, challenge)
+	}
+
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("registry %s sent a token challenge without a valid realm", loc.Registry)
+	}
+	if tokenURL.Scheme != "https" && tokenURL.Scheme != "http" {
+		return "", fmt.Errorf("registry %s sent a token realm with unsupported scheme %q", loc.Registry, tokenURL.Scheme)
+	}
+	if err := checkRegistryHost(tokenURL.Host); err != nil {
+		return "", fmt.Errorf("token realm of registry %s: %w", loc.Registry, err)
+	}
+	query := tokenURL.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", "repository:"+loc.Repository+":pull")
+	tokenURL.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if cred != nil {
+		req.SetBasicAuth(cred.Username, cred.Password)
+	}
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token service of registry %s answered %s", loc.Registry, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return "", fmt.Errorf("parsing token of registry %s: %w", loc.Registry, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", fmt.Errorf("token service of registry %s returned no token", loc.Registry)
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// parseAuthChallenge splits a WWW-Authenticate header such as
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"` into its
+// scheme and parameters.
+func parseAuthChallenge(header string) (scheme string, params map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params = map[string]string{}
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key], rest = value[1:1+end], value[2+end:]
+		} else {
+			params[key], rest, _ = strings.Cut(value, ",")
+		}
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+		rest = strings.TrimSpace(rest)
+	}
+	return scheme, params
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// useTestRegistry serves the registry API from handler and lists it as an insecure
+// registry, returning its host.
+func useTestRegistry(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+	useTestConfig()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	previous := insecureRegistries
+	insecureRegistries = host
+	t.Cleanup(func() { insecureRegistries = previous })
+	return host
+}
+
+func TestCheckImageExists(t *testing.T) {
+	host := useTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/team/app/manifests/v1" {
+			http.NotFound(w, r)
+		}
+	})
+	if err := checkImageExists(context.Background(), host+"/team/app:v1"); err != nil {
+		t.Errorf("existing image: %v", err)
+	}
+	if err := checkImageExists(context.Background(), host+"/team/app:v2"); !errors.Is(err, errImageNotFound) {
+		t.Errorf("missing image: got %v, want errImageNotFound", err)
+	}
+}
+
+func TestCheckImageExistsRefusesInternalRegistries(t *testing.T) {
+	for _, image := range []string{
+		"127.0.0.1:5000/app:v1",
+		"10.0.0.7/app:v1",
+		"[::1]:5000/app:v1",
+		"localhost:5000/app:v1",
+		"registry.cluster.internal/app:v1",
+	} {
+		if err := checkImageExists(context.Background(), image); err == nil || !strings.Contains(err.Error(), "not allowed") && !strings.Contains(err.Error(), "internal address") {
+			t.Errorf("%s: got %v, want the host refused", image, err)
+		}
+	}
+}
+
+// useFakeDNS makes publicDialer resolve every name to the IPv4 address ip for the test.
+func useFakeDNS(t *testing.T, ip net.IP) {
+	t.Helper()
+	previous := publicDialer.Resolver
+	publicDialer.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go answerDNS(server, [4]byte(ip.To4()))
+			return client, nil
+		},
+	}
+	t.Cleanup(func() { publicDialer.Resolver = previous })
+}
+
+// answerDNS answers the DNS queries sent over conn, framed as over TCP, with an A record of
+// ip for every name, until conn is closed.
+func answerDNS(conn net.Conn, ip [4]byte) {
+	defer conn.Close()
+	for {
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		var parser dnsmessage.Parser
+		header, err := parser.Start(query)
+		if err != nil {
+			return
+		}
+		question, err := parser.Question()
+		if err != nil {
+			return
+		}
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true})
+		b.EnableCompression()
+		b.StartQuestions()
+		b.Question(question)
+		b.StartAnswers()
+		if question.Type == dnsmessage.TypeA {
+			b.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: ip})
+		}
+		response, err := b.Finish()
+		if err != nil {
+			return
+		}
+		if binary.Write(conn, binary.BigEndian, uint16(len(response))) != nil {
+			return
+		}
+		if _, err := conn.Write(response); err != nil {
+			return
+		}
+	}
+}
+
+func TestCheckImageExistsRefusesNamesResolvingToInternalAddresses(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { requests.Add(1) }))
+	t.Cleanup(srv.Close)
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "https://"))
+	useTestConfig()
+	useFakeDNS(t, net.IPv4(127, 0, 0, 1))
+
+	err := checkImageExists(context.Background(), "registry.example.com:"+port+"/team/app:v1")
+	if err == nil || !strings.Contains(err.Error(), "internal address") {
+		t.Errorf("got %v, want the resolved address refused", err)
+	}
+	if n := requests.Load(); n > 0 {
+		t.Errorf("registry at a loopback address was sent %d requests", n)
+	}
+}
+
+func TestCheckImageExistsRefusesInternalTokenRealm(t *testing.T) {
+	host := useTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="http://169.254.169.254/token",service="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	err := checkImageExists(context.Background(), host+"/team/app:v1")
+	if err == nil || !strings.Contains(err.Error(), "token realm") {
+		t.Errorf("got %v, want the token realm refused", err)
+	}
+}
+
+func TestCheckImageExistsDoesNotFollowRedirects(t *testing.T) {
+	var redirected atomic.Bool
+	target := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		redirected.Store(true)
+	}))
+	t.Cleanup(target.Close)
+	host := useTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+r.URL.Path, http.StatusTemporaryRedirect)
+	})
+	if err := checkImageExists(context.Background(), host+"/team/app:v1"); err == nil {
+		t.Error("redirected check succeeded")
+	}
+	if redirected.Load() {
+		t.Error("the check followed the registry's redirect")
+	}
+}
+
+func TestParseImageLocation(t *testing.T) {
+	tests := []struct {
+		image string
+		want  imageLocation
+	}{
+		{"nginx", imageLocation{"docker.io", "library/nginx", "latest"}},
+		{"team/app:v1", imageLocation{"docker.io", "team/app", "v1"}},
+		{"ghcr.io/team/app:v1", imageLocation{"ghcr.io", "team/app", "v1"}},
+		{"localhost:5000/app@sha256:abc", imageLocation{"localhost:5000", "app", "sha256:abc"}},
+	}
+	for _, tt := range tests {
+		if got := parseImageLocation(tt.image); got != tt.want {
+			t.Errorf("parseImageLocation(%q) = %+v, want %+v", tt.image, got, tt.want)
+		}
+	}
+}
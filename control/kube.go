@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// kubeClient is the Kubernetes API client of the primary cluster, initialized by loadClusters.
+// Deployment steps use kubeFor to reach the cluster selected for the deployment.
+var kubeClient kubernetes.Interface
+
+// Test pod monitoring defaults. monitorPollInterval is the longest wait before
+// re-establishing a closed or failed watch: waits back off to it, see pollBackoff.
+// Deployments may override both, up to maxMonitorTimeout.
+var (
+	monitorTimeout      time.Duration
+	monitorPollInterval time.Duration
+	maxMonitorTimeout   time.Duration
+)
+
+// monitorOptions controls how long monitorTestPod waits, how long it waits at most before
+// re-establishing its watch, and how it decides whether the tests passed.
+type monitorOptions struct {
+	Timeout          time.Duration
+	PollInterval     time.Duration
+	SuccessCriterion string
+}
+
+// resolveMonitorOptions applies the payload's optional overrides to the configured defaults.
+func resolveMonitorOptions(payload DeploymentPayload) (monitorOptions, error) {
+	opts := monitorOptions{Timeout: monitorTimeout, PollInterval: monitorPollInterval, SuccessCriterion: testSuccessCriterion}
+	if payload.MonitorTimeoutSeconds < 0 || payload.PollIntervalSeconds < 0 {
+		return opts, fmt.Errorf("monitor timeout and poll interval must not be negative")
+	}
+	if payload.MonitorTimeoutSeconds > 0 {
+		opts.Timeout = time.Duration(payload.MonitorTimeoutSeconds) * time.Second
+	}
+	if payload.PollIntervalSeconds > 0 {
+		opts.PollInterval = time.Duration(payload.PollIntervalSeconds) * time.Second
+	}
+	if opts.Timeout > maxMonitorTimeout {
+		return opts, fmt.Errorf("monitor timeout %s exceeds the maximum of %s", opts.Timeout, maxMonitorTimeout)
+	}
+	if opts.PollInterval > opts.Timeout {
+		return opts, fmt.Errorf("poll interval %s exceeds the monitor timeout %s", opts.PollInterval, opts.Timeout)
+	}
+	if payload.TestSuccessCriterion != "" {
+		opts.SuccessCriterion = payload.TestSuccessCriterion
+	}
+	return opts, validateTestCriterion(opts.SuccessCriterion)
+}
+
+// newKubeClient builds a clientset for the given context of the given kubeconfig file, or
+// of the file found by the default loading rules (KUBECONFIG or ~/.kube/config) if none is
+// given. With neither it uses the in-cluster config, falling back to the kubeconfig's
+// current context.
+func newKubeClient(kubeconfig, kubeContext string) (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if kubeconfig != "" || kubeContext != "" || err != nil {
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		loadingRules.ExplicitPath = kubeconfig
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("loading kubeconfig: %w", err)
+		}
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// Metadata identifying namespaces created by this service and what they hold.
+const (
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "backend-im"
+	userIDLabel    = "backend.im/user-id"
+	repoHashLabel  = "backend.im/repo-hash"
+
+	createdAtAnnotation    = "backend.im/created-at"
+	userIDAnnotation       = "backend.im/user-id"
+	repoURLAnnotation      = "backend.im/repo-url"
+	commitHashAnnotation   = "backend.im/commit-hash"
+	deploymentIDAnnotation = "backend.im/deployment-id"
+	expiresAtAnnotation    = "backend.im/expires-at"
+	callbackURLAnnotation  = "backend.im/callback-url"
+)
+
+// namespaceOwner describes the deployment a namespace is created for.
+type namespaceOwner struct {
+	DeploymentID string
+	UserID       string
+	RepoURL      string
+	CommitHash   string
+	// ExpiresAt is when the namespace is deleted by the garbage collector, if not zero, and
+	// CallbackURL where that is reported, if not empty.
+	ExpiresAt   time.Time
+	CallbackURL string
+}
+
+// labels returns the namespace labels for the owner. Label values are limited to 63
+// characters, so the user ID is normalized and the repository is identified by its hash;
+// the annotations carry the exact values.
+func (o namespaceOwner) labels() map[string]string {
+	labels := map[string]string{
+		managedByLabel: managedByValue,
+		repoHashLabel:  repoHash(o.RepoURL),
+	}
+	if v := dnsLabel(o.UserID); v != "" {
+		labels[userIDLabel] = v
+	}
+	return labels
+}
+
+// annotations returns the namespace annotations for the owner, excluding the creation time.
+func (o namespaceOwner) annotations() map[string]string {
+	annotations := map[string]string{
+		userIDAnnotation:       o.UserID,
+		repoURLAnnotation:      o.RepoURL,
+		commitHashAnnotation:   o.CommitHash,
+		deploymentIDAnnotation: o.DeploymentID,
+	}
+	if !o.ExpiresAt.IsZero() {
+		annotations[expiresAtAnnotation] = o.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if o.CallbackURL != "" {
+		annotations[callbackURLAnnotation] = o.CallbackURL
+	}
+	return annotations
+}
+
+// createNamespace creates a namespace labeled as managed by this service and annotated
+// with its owner and creation time, so the garbage collector and list operations can find
+// and expire it.
+func createNamespace(ctx context.Context, name string, owner namespaceOwner) error {
+	annotations := owner.annotations()
+	annotations[createdAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	ns := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      owner.labels(),
+			Annotations: annotations,
+		},
+	}
+	_, err := kubeFor(ctx).CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{})
+	return err
+}
+
+// errNamespaceConflict reports that a deployment's namespace already exists but belongs to
+// another user, or was not created by this service at all.
+var errNamespaceConflict = errors.New("namespace conflict")
+
+// checkNamespaceOwner reports whether the namespace exists, returning an error wrapping
+// errNamespaceConflict if it does and does not belong to userID. Ownership is decided by the
+// exact user ID annotation, or by the user ID label on namespaces created before the
+// annotation was recorded.
+func checkNamespaceOwner(ctx context.Context, name, userID string) (exists bool, err error) {
+	ns, err := kubeFor(ctx).CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if ns.Labels[managedByLabel] != managedByValue {
+		return true, fmt.Errorf("%w: namespace %s already exists and is not managed by this service", errNamespaceConflict, name)
+	}
+	owner, annotated := ns.Annotations[userIDAnnotation]
+	if (annotated && owner != userID) || (!annotated && ns.Labels[userIDLabel] != dnsLabel(userID)) {
+		return true, fmt.Errorf("%w: namespace %s already exists and belongs to another user", errNamespaceConflict, name)
+	}
+	return true, nil
+}
+
+// updateNamespaceOwner records a new owner on an existing namespace, as when a deployment
+// redeploys into it. The namespace keeps its original creation time.
+func updateNamespaceOwner(ctx context.Context, name string, owner namespaceOwner) error {
+	// The new owner's expiry and callback replace the previous owner's, or remove them.
+	annotations := map[string]interface{}{expiresAtAnnotation: nil, callbackURLAnnotation: nil}
+	for k, v := range owner.annotations() {
+		annotations[k] = v
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      owner.labels(),
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = kubeFor(ctx).CoreV1().Namespaces().Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// monitorTestPod watches the test pod until the success criterion decides whether the tests
+// passed, or times out. On timeout the returned error wraps context.DeadlineExceeded.
+func monitorTestPod(ctx context.Context, namespace, podName string, opts monitorOptions) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+	ctx, fail := context.WithCancelCause(ctx)
+	defer fail(nil)
+	selector := metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", podName).String()}
+	go watchUnschedulable(ctx, namespace, selector, func(err *unschedulableError) { fail(err) })
+
+	ok, err := waitForPod(ctx, namespace, podName, opts.PollInterval, func(pod *corev1.Pod) (bool, error) {
+		loggerFrom(ctx).Info("Test pod status", "pod", podName, "phase", pod.Status.Phase)
+		if err := checkContainerWaiting(pod); err != nil {
+			return true, err
+		}
+		return evaluateTestPod(ctx, pod, opts.SuccessCriterion)
+	})
+	var uerr *unschedulableError
+	if errors.As(context.Cause(ctx), &uerr) {
+		return false, uerr
+	}
+	return ok, err
+}
+
+// monitorTestPods monitors the test pods concurrently, reporting each pod's result as a
+// test_progress event. It succeeds once every pod has passed; the first failure stops
+// monitoring the rest and is returned along with the name of the pod that failed.
+func monitorTestPods(ctx context.Context, deployment *Deployment, namespace string, pods []string, opts monitorOptions) (string, error) {
+	g, gctx := errgroup.WithContext(ctx)
+	var (
+		mu        sync.Mutex
+		passed    int
+		failedPod string
+	)
+	for _, pod := range pods {
+		g.Go(func() error {
+			ok, err := monitorTestPod(gctx, namespace, pod, opts)
+			if err == nil && !ok {
+				err = fmt.Errorf("pod %s in namespace %s did not pass", pod, namespace)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				// Pods stopped because another one failed are not reported.
+				if failedPod == "" && ctx.Err() == nil {
+					failedPod = pod
+					deployment.send("test_progress", fmt.Sprintf("Test pod %s failed: %v", pod, err))
+				}
+				return err
+			}
+			passed++
+			deployment.send("test_progress", fmt.Sprintf("Test pod %s passed (%d/%d)", pod, passed, len(pods)))
+			return nil
+		})
+	}
+	err := g.Wait()
+	if failedPod == "" {
+		failedPod = pods[0]
+	}
+	return failedPod, err
+}
+
+// Container waiting reasons that will not resolve without user intervention.
+const (
+	reasonImagePullBackOff = "ImagePullBackOff"
+	reasonErrImagePull     = "ErrImagePull"
+	reasonCrashLoopBackOff = "CrashLoopBackOff"
+)
+
+// containerWaitingError reports a container stuck waiting for a reason that needs user action.
+type containerWaitingError struct {
+	Pod       string
+	Container string
+	Reason    string
+	Message   string
+}
+
+func (e *containerWaitingError) Error() string {
+	msg := fmt.Sprintf("container %s in pod %s is in %s", e.Container, e.Pod, e.Reason)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// isImagePull reports whether the container is stuck pulling its image.
+func (e *containerWaitingError) isImagePull() bool {
+	return e.Reason == reasonImagePullBackOff || e.Reason == reasonErrImagePull
+}
+
+// checkContainerWaiting returns a containerWaitingError if any container of the pod is
+// waiting on an image pull failure or crash loop.
+func checkContainerWaiting(pod *corev1.Pod) error {
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, cs := range statuses {
+		if cs.State.Waiting == nil {
+			continue
+		}
+		switch cs.State.Waiting.Reason {
+		case reasonImagePullBackOff, reasonErrImagePull, reasonCrashLoopBackOff:
+			return &containerWaitingError{
+				Pod:       pod.Name,
+				Container: cs.Name,
+				Reason:    cs.State.Waiting.Reason,
+				Message:   cs.State.Waiting.Message,
+			}
+		}
+	}
+	return nil
+}
+
+// podCondition inspects a pod update and reports whether waiting is over, and with what error.
+type podCondition func(pod *corev1.Pod) (bool, error)
+
+// waitForPod watches the pod until condition reports done or ctx expires, re-establishing
+// the watch whenever it is closed by the server after a delay that backs off to
+// maxRetryInterval. It returns true only if condition finished without error.
+func waitForPod(ctx context.Context, namespace, podName string, maxRetryInterval time.Duration, condition podCondition) (bool, error) {
+	backoff := newPollBackoff(maxRetryInterval)
+	for {
+		done, err := watchPodOnce(ctx, namespace, podName, condition)
+		if done || err != nil {
+			return err == nil, err
+		}
+		// The watch was closed by the server or could not be established; start a new one.
+		select {
+		case <-ctx.Done():
+			return false, fmt.Errorf("timeout waiting for pod %s in namespace %s: %w", podName, namespace, ctx.Err())
+		case <-time.After(backoff.next()):
+		}
+	}
+}
+
+// watchPodOnce consumes a single watch on the pod. It returns done=true once condition
+// is satisfied, and done=false if the watch ended and should be re-established.
+func watchPodOnce(ctx context.Context, namespace, podName string, condition podCondition) (bool, error) {
+	w, err := kubeFor(ctx).CoreV1().Pods(namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", podName).String(),
+	})
+	if err != nil {
+		loggerFrom(ctx).Error("Error watching pod", "pod", podName, "error", err)
+		return false, nil
+	}
+	defer w.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return true, fmt.Errorf("timeout waiting for pod %s in namespace %s: %w", podName, namespace, ctx.Err())
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				loggerFrom(ctx).Info("Pod watch closed, re-establishing", "pod", podName)
+				return false, nil
+			}
+			switch event.Type {
+			case watch.Error:
+				loggerFrom(ctx).Error("Pod watch error", "pod", podName, "object", event.Object)
+				return false, nil
+			case watch.Deleted:
+				return true, fmt.Errorf("pod %s in namespace %s was deleted", podName, namespace)
+			}
+			pod, ok := event.Object.(*corev1.Pod)
+			if !ok {
+				continue
+			}
+			if done, err := condition(pod); done || err != nil {
+				return true, err
+			}
+		}
+	}
+}
+
+// streamPodLogs waits for the pod's containers to start and forwards each log line to the
+// deployment's client as a "test_log" event until the logs end or ctx is cancelled.
+func streamPodLogs(ctx context.Context, deployment *Deployment, namespace, podName string) {
+	started, err := waitForPod(ctx, namespace, podName, monitorPollInterval, func(pod *corev1.Pod) (bool, error) {
+		return pod.Status.Phase != corev1.PodPending, nil
+	})
+	if !started || err != nil {
+		return
+	}
+
+	stream, err := kubeFor(ctx).CoreV1().Pods(namespace).GetLogs(podName, &corev1.PodLogOptions{Follow: true}).Stream(ctx)
+	if err != nil {
+		deployment.logger.Error("Error streaming pod logs", "pod", podName, "error", err)
+		return
+	}
+	defer stream.Close()
+
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		deployment.send("test_log", scanner.Text())
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		deployment.logger.Error("Error reading pod logs", "pod", podName, "error", err)
+	}
+}
+
+// Limits on the diagnostics attached to a test failure.
+const (
+	diagnosticLogLines = 50
+	maxDiagnosticBytes = 16 * 1024
+)
+
+// collectPodDiagnostics gathers `kubectl describe pod` output and the last log lines of the
+// pod, truncated to maxDiagnosticBytes, for reporting a failure to the client.
+func collectPodDiagnostics(ctx context.Context, namespace, podName string) string {
+	var b strings.Builder
+
+	describe, err := runKubectl(ctx, 30*time.Second, "describe", "pod", podName, "-n", namespace)
+	if err != nil {
+		fmt.Fprintf(&b, "kubectl describe failed: %v\n", err)
+	}
+	fmt.Fprintf(&b, "=== kubectl describe pod %s ===\n%s\n", podName, describe)
+
+	tail := int64(diagnosticLogLines)
+	logs, err := kubeFor(ctx).CoreV1().Pods(namespace).GetLogs(podName, &corev1.PodLogOptions{TailLines: &tail}).Do(ctx).Raw()
+	if err != nil {
+		fmt.Fprintf(&b, "=== logs unavailable: %v ===\n", err)
+	} else {
+		fmt.Fprintf(&b, "=== last %d log lines ===\n%s", diagnosticLogLines, logs)
+	}
+
+	out := b.String()
+	if len(out) > maxDiagnosticBytes {
+		out = out[:maxDiagnosticBytes] + "\n... (truncated)"
+	}
+	return out
+}
+
+// ingressTimeout bounds how long a deployment waits for its ingress to be admitted.
+var ingressTimeout time.Duration
+
+// waitForIngress polls the ingress until the controller has assigned it an address.
+func waitForIngress(ctx context.Context, namespace, name string) error {
+	logger := loggerFrom(ctx)
+	err := wait.PollUntilContextTimeout(ctx, 2*time.Second, ingressTimeout, true, func(ctx context.Context) (bool, error) {
+		ing, err := kubeFor(ctx).NetworkingV1().Ingresses(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			logger.Info("Ingress not available yet", "ingress", name, "error", err)
+			return false, nil
+		}
+		return len(ing.Status.LoadBalancer.Ingress) > 0, nil
+	})
+	if err != nil {
+		return fmt.Errorf("ingress %s in namespace %s was not admitted: %w", name, namespace, err)
+	}
+	return nil
+}
+
+// appEnvConfigMap is the ConfigMap holding user-supplied environment variables,
+// referenced by the production pod template.
+const appEnvConfigMap = "app-env"
+
+// applyEnvConfigMap creates or updates the namespace's environment ConfigMap. Values go
+// through the API rather than template substitution, so they need no shell escaping.
+func applyEnvConfigMap(ctx context.Context, namespace string, env map[string]string) error {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: appEnvConfigMap, Namespace: namespace},
+		Data:       env,
+	}
+	configMaps := kubeFor(ctx).CoreV1().ConfigMaps(namespace)
+	_, err := configMaps.Create(ctx, cm, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// appSecret is the Secret holding user-supplied secrets, referenced by the production pod template.
+const appSecret = "app-secrets"
+
+// applyAppSecret creates or updates the namespace's application Secret.
+func applyAppSecret(ctx context.Context, namespace string, secrets SecretMap) error {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: appSecret, Namespace: namespace},
+		Type:       corev1.SecretTypeOpaque,
+		StringData: secrets,
+	}
+	client := kubeFor(ctx).CoreV1().Secrets(namespace)
+	_, err := client.Create(ctx, secret, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = client.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	return err
+}
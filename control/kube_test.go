@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckNamespaceOwner(t *testing.T) {
+	owned := namespaceOwner{UserID: "alice", RepoURL: "https://github.com/a/app", CommitHash: "abcdef1"}
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		conflict    bool
+	}{
+		{"owned", owned.labels(), owned.annotations(), false},
+		{"owned by another user", namespaceOwner{UserID: "bob"}.labels(), namespaceOwner{UserID: "bob"}.annotations(), true},
+		// Alice and alice normalize to the same label, but only the annotation's owner matches.
+		{"owned by a user with the same label", owned.labels(), namespaceOwner{UserID: "Alice"}.annotations(), true},
+		{"created before user annotations", owned.labels(), nil, false},
+		{"created before user annotations by another user", namespaceOwner{UserID: "bob"}.labels(), nil, true},
+		{"not managed by this service", map[string]string{"team": "platform"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name: "alice-app", Labels: tt.labels, Annotations: tt.annotations,
+			}})
+			ctx := withCluster(context.Background(), &cluster{Name: "test", Client: cs})
+			exists, err := checkNamespaceOwner(ctx, "alice-app", "alice")
+			if !exists {
+				t.Error("existing namespace was not found")
+			}
+			if conflict := errors.Is(err, errNamespaceConflict); conflict != tt.conflict {
+				t.Errorf("checkNamespaceOwner = %v, want a conflict %t", err, tt.conflict)
+			}
+		})
+	}
+
+	ctx := withCluster(context.Background(), &cluster{Name: "test", Client: fake.NewSimpleClientset()})
+	if exists, err := checkNamespaceOwner(ctx, "alice-app", "alice"); exists || err != nil {
+		t.Errorf("checkNamespaceOwner of a missing namespace = %t, %v", exists, err)
+	}
+}
+
+func TestDeploymentIntoAnotherUsersNamespaceConflicts(t *testing.T) {
+	cs, runner := useTestEnvironment(t)
+	payload := DeploymentPayload{UserID: "alice", RepoURL: "https://github.com/a/app", CommitHash: "abcdef1"}
+	namespace, _ := generateNamespace(payload.UserID, payload.RepoURL, payload.CommitHash)
+	bob := namespaceOwner{DeploymentID: "bobs-deployment", UserID: "bob", RepoURL: payload.RepoURL, CommitHash: payload.CommitHash}
+	if err := createNamespace(withCluster(context.Background(), primaryCluster), namespace, bob); err != nil {
+		t.Fatal(err)
+	}
+
+	d, done := startTestDeployment(t, nil, payload)
+	waitForFinish(t, done)
+
+	if status := d.status(); status != StatusFailed {
+		t.Errorf("status = %s, want %s", status, StatusFailed)
+	}
+	if e := waitForEvent(t, d, "namespace_conflict"); e.Code != codeNamespaceConflict {
+		t.Errorf("namespace_conflict code = %s, want %s", e.Code, codeNamespaceConflict)
+	}
+	if manifests := appliedManifests(runner); len(manifests) > 0 {
+		t.Errorf("applied %d manifests into bob's namespace", len(manifests))
+	}
+	if deleted := deletedNamespaces(runner); len(deleted) > 0 {
+		t.Errorf("deleted bob's namespace %v", deleted)
+	}
+	ns, err := cs.CoreV1().Namespaces().Get(context.Background(), namespace, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := ns.Annotations[userIDAnnotation]; owner != "bob" {
+		t.Errorf("namespace now belongs to %q, want bob", owner)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import "sync"
+
+// maxDeploymentsPerUser caps how many deployments a single user may have in flight.
+var maxDeploymentsPerUser int
+
+// activeDeployments counts in-flight deployments per user ID.
+var (
+	activeDeploymentsMu sync.Mutex
+	activeDeployments   = map[string]int{}
+)
+
+// acquireDeploymentSlot reserves one of the user's concurrent deployment slots,
+// reporting false if the user is already at the limit.
+func acquireDeploymentSlot(userID string) bool {
+	activeDeploymentsMu.Lock()
+	defer activeDeploymentsMu.Unlock()
+	if activeDeployments[userID] >= maxDeploymentsPerUser {
+		return false
+	}
+	activeDeployments[userID]++
+	return true
+}
+
+// releaseDeploymentSlot frees a slot previously reserved with acquireDeploymentSlot.
+func releaseDeploymentSlot(userID string) {
+	activeDeploymentsMu.Lock()
+	defer activeDeploymentsMu.Unlock()
+	if activeDeployments[userID]--; activeDeployments[userID] <= 0 {
+		delete(activeDeployments, userID)
+	}
+}
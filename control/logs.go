@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Log tail settings, set from Config. logTailLines is how many of each pod's existing log
+// lines are sent before new ones, and logRescanInterval how often a followed deployment is
+// checked for new pods, such as those of a restart or a redeploy.
+var (
+	logTailLines      int64
+	logRescanInterval time.Duration
+)
+
+// logTails tracks the log tails a connection has started, keyed by deployment ID, so a
+// client can stop one and all stop when the connection closes.
+type logTails struct {
+	mu    sync.Mutex
+	tails map[string]*logTail
+}
+
+// logTail is one running tail of a deployment's logs.
+type logTail struct {
+	cancel context.CancelFunc
+}
+
+func newLogTails() *logTails {
+	return &logTails{tails: map[string]*logTail{}}
+}
+
+// start tails the logs of one of the user's deployments to sconn, replacing any tail of it
+// the connection already runs.
+func (t *logTails) start(ctx context.Context, sconn *SafeConn, userID, id string, follow bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	tail := &logTail{cancel: cancel}
+	t.mu.Lock()
+	if previous, ok := t.tails[id]; ok {
+		previous.cancel()
+	}
+	t.tails[id] = tail
+	t.mu.Unlock()
+
+	go func() {
+		defer t.finish(id, tail)
+		tailDeploymentLogs(ctx, sconn, userID, id, follow)
+	}()
+}
+
+// stop stops the connection's tail of the deployment's logs, reporting whether it had one.
+func (t *logTails) stop(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tail, ok := t.tails[id]
+	if ok {
+		tail.cancel()
+		delete(t.tails, id)
+	}
+	return ok
+}
+
+// finish forgets a tail that ended, unless it has been replaced by a newer one.
+func (t *logTails) finish(id string, tail *logTail) {
+	tail.cancel()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tails[id] == tail {
+		delete(t.tails, id)
+	}
+}
+
+// stopAll stops every tail the connection started.
+func (t *logTails) stopAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, tail := range t.tails {
+		tail.cancel()
+		delete(t.tails, id)
+	}
+}
+
+// tailDeploymentLogs sends the recent logs of the live production pods of one of the user's
+// successful deployments as "log" events, each naming its pod. Without follow it stops there
+// and reports logs_end. With follow it keeps streaming new lines until ctx is done, attaching
+// to pods that replace the current ones and re-attaching to containers that restart.
+func tailDeploymentLogs(ctx context.Context, sconn *SafeConn, userID, id string, follow bool) {
+	rec, err := deploymentStore.Get(ctx, id)
+	if errors.Is(err, errDeploymentNotFound) || (err == nil && rec.UserID != userID) {
+		sendWebSocketError(sconn, "logs_error", codeDeploymentNotFound, "No deployment with ID "+id)
+		return
+	}
+	if err != nil {
+		sendWebSocketError(sconn, "logs_error", codeInternalError, "Failed to look up deployment: "+err.Error())
+		return
+	}
+	if rec.Status != StatusSucceeded {
+		sendWebSocketError(sconn, "logs_error", codeValidationError, fmt.Sprintf("Deployment %s is %s; only successful deployments are running", id, rec.Status))
+		return
+	}
+	c, err := resolveCluster(rec.Cluster)
+	if err != nil {
+		sendWebSocketError(sconn, "logs_error", codeInternalError, "Cannot reach the deployment's cluster: "+err.Error())
+		return
+	}
+	ctx = withCluster(ctx, c)
+	logger := slog.Default().With("deploymentID", id, "namespace", rec.Namespace)
+
+	pods, err := livePodNames(ctx, rec.Namespace)
+	if err != nil {
+		sendWebSocketError(sconn, "logs_error", codeInternalError, fmt.Sprintf("Failed to find the pods of deployment %s: %v", id, err))
+		return
+	}
+	if !follow {
+		for _, pod := range pods {
+			sendPodLogs(ctx, logger, sconn, id, rec.Namespace, pod, &corev1.PodLogOptions{Container: prodContainerName, TailLines: &logTailLines})
+		}
+		sendWebSocketMessage(sconn, "logs_end", fmt.Sprintf("End of the logs of deployment %s", id))
+		return
+	}
+
+	logger.Info("Following deployment logs")
+	sendWebSocketMessage(sconn, "logs_started", fmt.Sprintf("Following the logs of deployment %s", id))
+	var wg sync.WaitGroup
+	followed := map[string]bool{}
+	ticker := time.NewTicker(logRescanInterval)
+	defer ticker.Stop()
+	for {
+		for _, pod := range pods {
+			if followed[pod] {
+				continue
+			}
+			followed[pod] = true
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				followPodLogs(ctx, logger, sconn, id, rec.Namespace, pod)
+			}()
+		}
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			logger.Info("Stopped following deployment logs")
+			sendWebSocketMessage(sconn, "logs_stopped", fmt.Sprintf("Stopped following the logs of deployment %s", id))
+			return
+		case <-ticker.C:
+		}
+		// Pods that fail to list are picked up on the next scan.
+		if current, err := livePodNames(ctx, rec.Namespace); err == nil {
+			pods = current
+		}
+	}
+}
+
+// livePodNames returns the names of the pods of the namespace's live production version.
+func livePodNames(ctx context.Context, namespace string) ([]string, error) {
+	color, live, err := liveProdVersion(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if !live {
+		return nil, fmt.Errorf("namespace %s has no live production version", namespace)
+	}
+	selector := labels.SelectorFromSet(labels.Set{"app": prodDeploymentName, versionLabel: color}).String()
+	list, err := kubeFor(ctx).CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(list.Items))
+	for _, pod := range list.Items {
+		if pod.DeletionTimestamp == nil {
+			names = append(names, pod.Name)
+		}
+	}
+	return names, nil
+}
+
+// followPodLogs streams the pod's logs until ctx is done or the pod is gone. When the stream
+// ends because the container restarted, it re-attaches, resuming from when the stream ended.
+func followPodLogs(ctx context.Context, logger *slog.Logger, sconn *SafeConn, id, namespace, pod string) {
+	opts := &corev1.PodLogOptions{Container: prodContainerName, Follow: true, TailLines: &logTailLines}
+	for {
+		if err := sendPodLogs(ctx, logger, sconn, id, namespace, pod, opts); apierrors.IsNotFound(err) {
+			return
+		}
+		ended := metav1.Now()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(monitorPollInterval):
+		}
+		if _, err := kubeFor(ctx).CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{}); apierrors.IsNotFound(err) {
+			return
+		}
+		opts = &corev1.PodLogOptions{Container: prodContainerName, Follow: true, SinceTime: &ended}
+	}
+}
+
+// sendPodLogs sends the pod's log lines selected by opts to sconn as "log" events. Log lines
+// are written without logging each one.
+func sendPodLogs(ctx context.Context, logger *slog.Logger, sconn *SafeConn, id, namespace, pod string, opts *corev1.PodLogOptions) error {
+	stream, err := kubeFor(ctx).CoreV1().Pods(namespace).GetLogs(pod, opts).Stream(ctx)
+	if err != nil {
+		if ctx.Err() == nil && !apierrors.IsNotFound(err) {
+			logger.Error("Error streaming pod logs", "pod", pod, "error", err)
+		}
+		return err
+	}
+	defer stream.Close()
+
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		event := Event{Event: "log", Message: scanner.Text(), DeploymentID: id, Object: "Pod/" + pod, Timestamp: time.Now().UTC()}
+		if err := sconn.WriteJSON(event); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		logger.Error("Error reading pod logs", "pod", pod, "error", err)
+		return err
+	}
+	return nil
+}
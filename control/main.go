@@ -1,17 +1,38 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"os/exec"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
 )
 
 // DeploymentPayload represents the JSON payload from the client.
@@ -19,18 +40,124 @@ type DeploymentPayload struct {
 	UserID     string `json:"userID"`
 	CommitHash string `json:"commitHash"`
 	RepoURL    string `json:"repoURL"`
+	// Ref is a branch or tag to deploy instead of CommitHash. It is resolved to a commit
+	// before the deployment starts.
+	Ref string `json:"ref,omitempty"`
+	// CredentialID references a deploy token or SSH key uploaded through POST /credentials
+	// for cloning a private repository.
+	CredentialID string `json:"credentialID,omitempty"`
+	// TestPodName is the name of the pod defined by the test template; defaults to defaultTestPodName.
+	TestPodName string `json:"testPodName,omitempty"`
+	// MonitorTimeoutSeconds and PollIntervalSeconds optionally override the test pod monitoring defaults.
+	MonitorTimeoutSeconds int `json:"monitorTimeoutSeconds,omitempty"`
+	PollIntervalSeconds   int `json:"pollIntervalSeconds,omitempty"`
+	// TestSuccessCriterion optionally overrides how the test pod's result is decided: "phase",
+	// "exit_code", or "marker".
+	TestSuccessCriterion string `json:"testSuccessCriterion,omitempty"`
+	// TestCommand optionally replaces the test template's default test invocation with a
+	// shell command run in the repository checkout, and TestTimeoutSeconds bounds how long
+	// the tests may run inside the test pod.
+	TestCommand        string `json:"testCommand,omitempty"`
+	TestTimeoutSeconds int    `json:"testTimeoutSeconds,omitempty"`
+	// Image deploys a prebuilt container image instead of building the app from a
+	// repository: the clone and test steps are skipped, and a TestCommand is run in the
+	// image as a smoke test. RepoURL, CommitHash, Ref and CredentialID must then be empty.
+	Image string `json:"image,omitempty"`
+	// CallbackURL, if set, is sent a signed POST with the deployment's outcome once it
+	// finishes, whether or not a client is still connected. It must be a public https URL.
+	CallbackURL string `json:"callbackURL,omitempty"`
+	// TTLSeconds, if set, deletes the deployment's namespace that many seconds after it is
+	// created or redeployed into, as for a preview environment. It may not exceed
+	// maxDeploymentTTL.
+	TTLSeconds int `json:"ttlSeconds,omitempty"`
+	// Env holds environment variables injected into the production containers.
+	Env map[string]string `json:"env,omitempty"`
+	// Secrets are injected like Env but stored in a Kubernetes Secret and never logged.
+	Secrets SecretMap `json:"secrets,omitempty"`
+	// Replicas, CPULimit, and MemoryLimit optionally size the production deployment.
+	Replicas    int    `json:"replicas,omitempty"`
+	CPULimit    string `json:"cpuLimit,omitempty"`
+	MemoryLimit string `json:"memoryLimit,omitempty"`
+	// HealthCheckPath and HealthCheckPort optionally set the readiness and liveness probes
+	// of the production pods. Pods are probed over TCP on the container port by default.
+	HealthCheckPath string `json:"healthCheckPath,omitempty"`
+	HealthCheckPort int    `json:"healthCheckPort,omitempty"`
+	// MinReplicas, MaxReplicas, and TargetCPU optionally autoscale the production pods on
+	// CPU utilization, as a percentage of their CPU limit. Setting maxReplicas enables it.
+	MinReplicas int `json:"minReplicas,omitempty"`
+	MaxReplicas int `json:"maxReplicas,omitempty"`
+	TargetCPU   int `json:"targetCPU,omitempty"`
+	// DeployType selects how the production app is deployed: DeployTypeTemplate (the default) or DeployTypeHelm.
+	DeployType string `json:"deployType,omitempty"`
+	// HelmChart, HelmRepo, and HelmChartVersion identify the chart of a helm deployment, and
+	// HelmValues holds its --set-string value overrides.
+	HelmChart        string            `json:"helmChart,omitempty"`
+	HelmRepo         string            `json:"helmRepo,omitempty"`
+	HelmChartVersion string            `json:"helmChartVersion,omitempty"`
+	HelmValues       map[string]string `json:"helmValues,omitempty"`
+	// CanaryPercent, if set, routes that percentage of traffic to the new version for
+	// CanaryBakeSeconds before promoting it, rolling it back if it becomes unhealthy.
+	CanaryPercent     int `json:"canaryPercent,omitempty"`
+	CanaryBakeSeconds int `json:"canaryBakeSeconds,omitempty"`
+	// DryRun validates the deployment and its manifests with server-side dry runs without
+	// changing the cluster, reporting the outcome as a dry_run_result event.
+	DryRun bool `json:"dryRun,omitempty"`
+	// Subdomain, if set, replaces the generated stable hostname of the app with
+	// <subdomain>.<BASE_DOMAIN>. A subdomain belongs to the first app deployed with it.
+	Subdomain string `json:"subdomain,omitempty"`
+	// CustomDomain, if set, also serves the app at a domain the user owns, with a
+	// certificate from cert-manager. Its DNS must already point at the platform.
+	CustomDomain string `json:"customDomain,omitempty"`
+	// Cluster names the cluster to deploy to, one of those configured in CLUSTERS. The
+	// primary cluster is used when it is empty.
+	Cluster string `json:"cluster,omitempty"`
 	// Extend with additional fields if needed.
 }
 
+// ClientMessage is an inbound WebSocket message. Messages without an action are deployment requests.
+type ClientMessage struct {
+	Action       string `json:"action"`
+	DeploymentID string `json:"deploymentID"`
+	// After is the sequence number of the last event a subscribing client saw.
+	After int `json:"after"`
+	// TraceParent optionally carries the client's W3C trace context for a deployment request,
+	// for clients that cannot set headers on the WebSocket handshake.
+	TraceParent string `json:"traceparent,omitempty"`
+	// Follow asks a logs request to keep streaming new log lines.
+	Follow bool `json:"follow"`
+	DeploymentPayload
+}
+
+// wsCompression enables permessage-deflate compression of the messages sent to clients that
+// negotiate it, which shrinks verbose log and event streams considerably.
+var wsCompression = envBool("WS_COMPRESSION", true)
+
 // Upgrader for WebSocket connections.
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin:       checkOrigin,
+	EnableCompression: wsCompression,
+}
+
+// offersDeflate reports whether the client offered the permessage-deflate extension in its
+// handshake, in which case the upgrader accepts it when compression is enabled.
+func offersDeflate(r *http.Request) bool {
+	for _, value := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, extension := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(extension, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // SafeConn wraps a websocket connection with a mutex for safe concurrent writes.
 type SafeConn struct {
 	Conn  *websocket.Conn
 	Mutex sync.Mutex
+	// closeOnce ensures the connection is closed with a single close frame.
+	closeOnce sync.Once
 }
 
 // WriteJSON safely writes JSON to the WebSocket connection.
@@ -42,164 +169,1353 @@ func (s *SafeConn) WriteJSON(v interface{}) error {
 
 // sendWebSocketMessage sends and logs a message back to the client.
 func sendWebSocketMessage(sconn *SafeConn, event, message string) {
-	response := map[string]string{
-		"event":   event,
-		"message": message,
-	}
+	writeWebSocketMessage(slog.Default(), sconn, Event{Event: event, Message: message, Timestamp: time.Now().UTC()})
+}
+
+// sendWebSocketError sends an error event with its code directly to the client.
+func sendWebSocketError(sconn *SafeConn, event string, code errorCode, message string) {
+	writeWebSocketMessage(slog.Default(), sconn, Event{Event: event, Code: code, Message: message, Timestamp: time.Now().UTC()})
+}
+
+// writeWebSocketMessage logs and writes a response to the client.
+func writeWebSocketMessage(logger *slog.Logger, sconn *SafeConn, response Event) {
 	// Log the message being sent
-	log.Printf("Sending WebSocket message: %v", response)
+	logger.Info("Sending WebSocket message", "event", response.Event, "message", response.Message)
 	if err := sconn.WriteJSON(response); err != nil {
-		log.Printf("Error sending websocket message: %v", err)
+		logger.Error("Error sending websocket message", "error", err)
 	}
 }
 
-// generateNamespace returns a unique namespace name.
-func generateNamespace(userID, repoURL, commitHash string) string {
+// maxNamespaceLength is the RFC 1123 label length limit enforced by Kubernetes.
+const maxNamespaceLength = 63
+
+// invalidNamespaceChars matches runs of characters not allowed in an RFC 1123 label.
+var invalidNamespaceChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// repoHash returns a short, stable hash identifying a repository URL.
+func repoHash(repoURL string) string {
 	hash := sha256.Sum256([]byte(repoURL))
-	hashStr := hex.EncodeToString(hash[:])[:8]
-	return fmt.Sprintf("%s-%s-%s", userID, hashStr, commitHash)
+	return hex.EncodeToString(hash[:])[:8]
+}
+
+// dnsLabel normalizes raw into an RFC 1123 label: lowercased, invalid characters replaced
+// with "-", and truncated to maxNamespaceLength with a hash suffix that keeps it unique.
+// It returns "" if nothing valid remains.
+func dnsLabel(raw string) string {
+	name := invalidNamespaceChars.ReplaceAllString(strings.ToLower(raw), "-")
+	name = strings.Trim(name, "-")
+	if len(name) > maxNamespaceLength {
+		// Keep truncated names unique by suffixing a hash of the original input.
+		suffix := sha256.Sum256([]byte(raw))
+		suffixStr := hex.EncodeToString(suffix[:])[:8]
+		name = strings.TrimRight(name[:maxNamespaceLength-len(suffixStr)-1], "-") + "-" + suffixStr
+	}
+	return name
+}
+
+// shortCommitLength is how many characters of the commit hash namespaces include, as in
+// git's abbreviated hashes.
+const shortCommitLength = 7
+
+// shortCommit returns the abbreviated, lowercased form of a commit hash used in names.
+func shortCommit(commitHash string) string {
+	commit := strings.ToLower(commitHash)
+	if len(commit) > shortCommitLength {
+		commit = commit[:shortCommitLength]
+	}
+	return commit
+}
+
+// sameCommit reports whether two commit hashes, either of which may be abbreviated, name
+// the same commit.
+func sameCommit(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
 }
 
-// runCommand executes a command with a given timeout and returns its output.
-func runCommand(timeout time.Duration, name string, args ...string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	cmd := exec.CommandContext(ctx, name, args...)
-	output, err := cmd.CombinedOutput()
-	return string(output), err
+// generateNamespace returns a unique, RFC 1123 compliant namespace name of the form
+// <user>-<repo hash>-<short commit>. The repository hash and commit are always kept whole.
+// A user ID that had to be normalized or truncated to fit is suffixed with a hash of the
+// original ID, so distinct users never share a namespace.
+func generateNamespace(userID, repoURL, commitHash string) (string, error) {
+	user := strings.Trim(invalidNamespaceChars.ReplaceAllString(strings.ToLower(userID), "-"), "-")
+	commit := shortCommit(commitHash)
+	if user == "" || commit == "" {
+		return "", fmt.Errorf("could not derive a valid namespace from userID %q and commitHash %q", userID, commitHash)
+	}
+	suffix := fmt.Sprintf("-%s-%s", repoHash(repoURL), commit)
+	budget := maxNamespaceLength - len(suffix)
+	if user != userID || len(user) > budget {
+		userHash := sha256.Sum256([]byte(userID))
+		hashStr := hex.EncodeToString(userHash[:])[:8]
+		if len(user) > budget-len(hashStr)-1 {
+			user = strings.TrimRight(user[:budget-len(hashStr)-1], "-")
+		}
+		user += "-" + hashStr
+	}
+	return user + suffix, nil
+}
+
+// unsafeSubstitutionChars are characters that could break out of the shell commands
+// or YAML documents that substitution values are rendered into.
+const unsafeSubstitutionChars = "`$;&|<>(){}[]'\"\\!*?#~ \t\r\n"
+
+// sanitizeSubstitution rejects template substitution values containing shell-unsafe characters.
+func sanitizeSubstitution(value string) (string, error) {
+	if i := strings.IndexAny(value, unsafeSubstitutionChars); i >= 0 {
+		return "", fmt.Errorf("substitution value contains unsafe character %q", value[i])
+	}
+	return value, nil
+}
+
+// applyK8sTemplate renders the Kubernetes YAML templates named by spec, a template setting
+// as described by expandTemplates, with the given substitutions and applies the results in
+// namespace.
+func applyK8sTemplate(ctx context.Context, spec, namespace string, substitutions map[string]string) error {
+	_, err := applyK8sTemplates(ctx, spec, namespace, substitutions)
+	return err
+}
+
+// kubectlApply runs kubectl apply on manifest in namespace with any extra flags.
+// kubectl apply is idempotent, so it is retried on transient failures.
+func kubectlApply(ctx context.Context, namespace, manifest string, flags ...string) (string, error) {
+	args := append(clusterArgs(ctx, "kubectl"), "apply", "-n", namespace, "-f", "-")
+	args = append(args, flags...)
+	return retryTransient(ctx, func(ctx context.Context) (string, error) {
+		return commandRunner.Run(ctx, 30*time.Second, Command{Name: "kubectl", Args: args, Stdin: manifest})
+	})
 }
 
-// applyK8sTemplate applies a Kubernetes YAML template using a bash script.
-func applyK8sTemplate(templatePath, namespace string, substitutions map[string]string) error {
-	args := []string{templatePath, namespace}
+// manifestInvalidError reports a template that rendered to an invalid manifest or that the
+// API server rejected on a dry run.
+type manifestInvalidError struct {
+	Template string
+	Message  string
+}
+
+func (e *manifestInvalidError) Error() string {
+	return fmt.Sprintf("manifest %s is invalid: %s", e.Template, e.Message)
+}
+
+// renderK8sTemplate renders the text/template at templatePath with the substitutions and
+// checks that the result is a sequence of well-formed Kubernetes objects.
+func renderK8sTemplate(templatePath string, substitutions map[string]string) (string, error) {
+	data := make(map[string]string, len(substitutions))
 	for key, value := range substitutions {
-		args = append(args, fmt.Sprintf("%s=%s", key, value))
+		safe, err := sanitizeSubstitution(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+		data[key] = safe
 	}
-	output, err := runCommand(30*time.Second, "/scripts/apply-template.sh", args...)
+
+	tmpl, err := template.New(filepath.Base(templatePath)).Option("missingkey=error").ParseFiles(templatePath)
 	if err != nil {
-		log.Printf("Error applying template: %v\nOutput: %s", err, output)
+		return "", fmt.Errorf("parsing template: %w", err)
 	}
-	return err
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("rendering template: %w", err)
+	}
+	if _, err := manifestObjects(rendered.Bytes()); err != nil {
+		return "", fmt.Errorf("rendered template %s is invalid: %w", templatePath, err)
+	}
+	return rendered.String(), nil
 }
 
-func generatePVCName(namespace string) string {
-	return namespace
+// manifestObject identifies an object in a manifest.
+type manifestObject struct {
+	Kind string
+	Name string
 }
 
-// monitorTestPod polls the status of the test pod until it is "Running" or "Succeeded", or times out.
-// TODO: Replace with a robust implementation using client-go or similar.
-func monitorTestPod(namespace, podName string) (bool, error) {
-	timeout := time.After(2 * time.Minute)
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+// String renders the object as Kind/name.
+func (o manifestObject) String() string { return o.Kind + "/" + o.Name }
 
-	for {
-		select {
-		case <-timeout:
-			return false, fmt.Errorf("timeout waiting for pod %s in namespace %s", podName, namespace)
-		case <-ticker.C:
-			output, err := runCommand(10*time.Second, "kubectl", "get", "pod", podName, "-n", namespace, "-o", "jsonpath={.status.phase}")
-			if err != nil {
-				log.Printf("Error checking status for pod %s: %v", podName, err)
-				continue
+// manifestObjects lists the objects in manifest, checking that every YAML document names an
+// apiVersion, kind, and metadata.name.
+func manifestObjects(manifest []byte) ([]manifestObject, error) {
+	var objects []manifestObject
+	decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(manifest), 4096)
+	for i := 1; ; i++ {
+		var obj unstructured.Unstructured
+		if err := decoder.Decode(&obj.Object); err != nil {
+			if errors.Is(err, io.EOF) {
+				return objects, nil
 			}
-			log.Printf("Pod %s status: %s", podName, output)
-			if output == "Running" || output == "Succeeded" {
-				return true, nil
-			} else if output == "Failed" {
-				return false, fmt.Errorf("pod %s in namespace %s has failed", podName, namespace)
+			return nil, fmt.Errorf("document %d: %w", i, err)
+		}
+		if obj.Object == nil {
+			continue // empty document
+		}
+		if obj.GetAPIVersion() == "" || obj.GetKind() == "" || obj.GetName() == "" {
+			return nil, fmt.Errorf("document %d must set apiVersion, kind, and metadata.name", i)
+		}
+		objects = append(objects, manifestObject{Kind: obj.GetKind(), Name: obj.GetName()})
+	}
+}
+
+// Paths of the manifest templates applied by deployments, set from Config.
+var (
+	testPodTemplate     string
+	prodPodTemplate     string
+	prodServiceTemplate string
+	ingressTemplate     string
+)
+
+// Network isolation of deployment namespaces. networkPolicyTemplate may point at a custom
+// policy; it is rendered with Namespace and IngressNamespace, the namespace of the ingress
+// controller whose traffic tenant apps must accept.
+var (
+	networkPolicyEnabled  = envBool("NETWORK_POLICY_ENABLED", true)
+	networkPolicyTemplate string
+	ingressNamespace      = envString("INGRESS_CONTROLLER_NAMESPACE", "ingress-nginx")
+)
+
+// networkPolicySubstitutions returns the substitutions for networkPolicyTemplate.
+func networkPolicySubstitutions(namespace string) map[string]string {
+	return map[string]string{
+		"Namespace":        namespace,
+		"IngressNamespace": ingressNamespace,
+	}
+}
+
+// testPodSubstitutions returns the substitutions for testPodTemplate.
+func testPodSubstitutions(namespace, testPodName string, payload DeploymentPayload) map[string]string {
+	return map[string]string{
+		"PVCName":     generatePVCName(namespace, codeVolumePurpose),
+		"Namespace":   namespace,
+		"RepoURL":     payload.RepoURL,
+		"CommitHash":  payload.CommitHash,
+		"TestPodName": testPodName,
+		"PassMarker":  testPassMarker,
+		"FailMarker":  testFailMarker,
+		// The test command is free-form shell, so it is passed base64-encoded, which is inert
+		// in both YAML and the template's script, for the pod to decode.
+		"TestCommand":        base64.StdEncoding.EncodeToString([]byte(payload.TestCommand)),
+		"TestTimeoutSeconds": strconv.Itoa(payload.TestTimeoutSeconds),
+	}
+}
+
+// prodSubstitutions returns the substitutions for prodPodTemplate deploying the given color.
+func prodSubstitutions(namespace string, resources prodResources, hc healthCheck, color string) map[string]string {
+	substitutions := resources.substitutions()
+	for key, value := range hc.substitutions() {
+		substitutions[key] = value
+	}
+	substitutions["Namespace"] = namespace
+	substitutions["PVCName"] = generatePVCName(namespace, codeVolumePurpose)
+	substitutions["Color"] = color
+	return substitutions
+}
+
+// prodServiceSubstitutions returns the substitutions for prodServiceTemplate defining the
+// named service routing to the given color.
+func prodServiceSubstitutions(namespace, serviceName, color string) map[string]string {
+	return map[string]string{
+		"Namespace":   namespace,
+		"ServiceName": serviceName,
+		"Color":       color,
+	}
+}
+
+// ingressSubstitutions returns the substitutions for ingressTemplate.
+func ingressSubstitutions(namespace, ingressName, host string) map[string]string {
+	return map[string]string{
+		"Namespace":   namespace,
+		"IngressName": ingressName,
+		"Host":        host,
+	}
+}
+
+// codeVolumePurpose names the PVC the test pod clones the repository into and the
+// production pods serve it from.
+const codeVolumePurpose = "code"
+
+// generatePVCName returns a DNS-safe name for the namespace's PVC with the given purpose,
+// such as "<namespace>-code". Names that would exceed the RFC 1123 label limit are
+// truncated with a hash suffix, so different purposes never collide.
+func generatePVCName(namespace, purpose string) string {
+	return dnsLabel(namespace + "-" + purpose)
+}
+
+// templatePods renders the templates named by spec and returns the names of the pods they define.
+func templatePods(spec string, substitutions map[string]string) ([]string, error) {
+	rendered, err := renderK8sTemplates(spec, substitutions)
+	if err != nil {
+		return nil, err
+	}
+	var pods []string
+	for _, t := range rendered {
+		objects, err := manifestObjects([]byte(t.Manifest))
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objects {
+			if obj.Kind == "Pod" {
+				pods = append(pods, obj.Name)
 			}
 		}
 	}
+	return pods, nil
 }
 
-// cleanupTestPod deletes the test pod.
-func cleanupTestPod(namespace, podName string) {
-	output, err := runCommand(30*time.Second, "kubectl", "delete", "pod", podName, "-n", namespace)
+// cleanupTestPod deletes a test pod in the cluster selected for ctx. Cancelling ctx does not
+// stop the cleanup.
+func cleanupTestPod(ctx context.Context, logger *slog.Logger, namespace, podName string) {
+	output, err := runKubectl(context.WithoutCancel(ctx), 30*time.Second, "delete", "pod", podName, "-n", namespace)
 	if err != nil {
-		log.Printf("Error cleaning up pod %s in namespace %s: %v\nOutput: %s", podName, namespace, err, output)
+		logger.Error("Error cleaning up test pod", "pod", podName, "error", err, "output", output)
 	} else {
-		log.Printf("Successfully cleaned up pod %s in namespace %s", podName, namespace)
+		logger.Info("Successfully cleaned up test pod", "pod", podName)
+	}
+}
+
+// scheduleTestPodCleanup deletes the test pods after a delay, without blocking the caller.
+func scheduleTestPodCleanup(ctx context.Context, logger *slog.Logger, namespace string, podNames []string) {
+	if len(podNames) == 0 {
+		return
+	}
+	go func() {
+		time.Sleep(60 * time.Second)
+		unlock, err := lockNamespace(context.WithoutCancel(ctx), namespace)
+		if err != nil {
+			return
+		}
+		defer unlock()
+		for _, podName := range podNames {
+			cleanupTestPod(ctx, logger, namespace, podName)
+		}
+	}()
+}
+
+// deleteNamespace deletes the namespace and everything in it from the cluster selected for
+// ctx, without waiting for finalization. Cancelling ctx does not stop the deletion.
+func deleteNamespace(ctx context.Context, logger *slog.Logger, namespace string) error {
+	output, err := runKubectl(context.WithoutCancel(ctx), 30*time.Second, "delete", "namespace", namespace, "--ignore-not-found", "--wait=false")
+	if err != nil {
+		logger.Error("Error deleting namespace", "namespace", namespace, "error", err, "output", output)
+		return err
 	}
+	logger.Info("Deleted namespace", "namespace", namespace)
+	return nil
 }
 
+// baseDomain is the domain under which deployments get their public hostnames.
+var baseDomain string
+
+// validateBaseDomain checks that domain is a DNS name hostnames can be built under.
+func validateBaseDomain(domain string) error {
+	if errs := validation.IsDNS1123Subdomain(domain); len(errs) > 0 {
+		return fmt.Errorf("base domain %q is invalid: %s", domain, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// generateHost returns the public hostname routed to the namespace's ingress.
+func generateHost(namespace string) string {
+	return namespace + "." + baseDomain
+}
+
+// prodDeploymentName is the app label of the Deployments defined by the production template,
+// whose names add the blue-green color.
+const prodDeploymentName = "prod-app"
+
+// prodIngressName is the ingress routing a namespace's own hostname to its production service.
+const prodIngressName = "prod-ingress"
+
 // generateEndpoint returns the production endpoint URL.
 func generateEndpoint(namespace string) string {
-	return fmt.Sprintf("https://%s.yourdomain.com", namespace)
+	return "https://" + generateHost(namespace)
 }
 
+// defaultTestPodName is the test pod name used when the payload does not specify one.
+const defaultTestPodName = "test-app"
+
+// dedupWindow is how long after an identical deployment succeeds that repeat requests
+// are answered with the existing deployment instead of redeploying.
+var dedupWindow = envDuration("DEDUP_WINDOW", 10*time.Minute)
+
+// keepFailedNamespaces disables deleting the namespace of a failed deployment, for debugging.
+var keepFailedNamespaces = envBool("KEEP_FAILED_NAMESPACES", false)
+
 // handleDeployment processes the payload and orchestrates the workflow.
-func handleDeployment(sconn *SafeConn, payload DeploymentPayload) {
-	namespace := generateNamespace(payload.UserID, payload.RepoURL, payload.CommitHash)
-	log.Printf("Using namespace: %s", namespace)
+// Cancelling ctx aborts the deployment and deletes its namespace.
+func handleDeployment(ctx context.Context, deployment *Deployment, payload DeploymentPayload) {
+	// The deployment may have been cancelled while it waited in the queue.
+	if ctx.Err() != nil {
+		deployment.setStatus(StatusCancelled)
+		deployment.send("deployment_cancelled", fmt.Sprintf("Deployment %s was cancelled before it started", deployment.ID))
+		return
+	}
+
+	// Bound the whole deployment; expiry cancels whatever step is in flight.
+	ctx, cancelTimeout := context.WithTimeoutCause(ctx, deploymentTimeout, errDeploymentTimeout)
+	defer cancelTimeout()
+
+	ctx, tr := startDeploymentTrace(ctx, deployment)
+	startedAt := time.Now()
+	metricDeploymentsStarted.Inc()
+	metricActiveDeployments.Inc()
+	defer func() {
+		tr.end(deployment.status())
+		status := string(deployment.status())
+		metricActiveDeployments.Dec()
+		metricDeploymentsFinished.WithLabelValues(status).Inc()
+		metricDeploymentDuration.WithLabelValues(status).Observe(time.Since(startedAt).Seconds())
+	}()
+
+	validated, err := validatePayload(payload)
+	if err != nil {
+		deployment.fail("validation_error", codeValidationError, "Invalid deployment request: "+err.Error())
+		return
+	}
+	testPodName, resources, monitorOpts := validated.TestPodName, validated.Resources, validated.Monitor
+	deployType, canary, hc, autoscale := validated.DeployType, validated.Canary, validated.HealthCheck, validated.Autoscale
+	ctx = withCluster(ctx, validated.Cluster)
+	tier, err := tierFor(payload.UserID)
+	if err != nil {
+		deployment.fail("deployment_error", codeInternalError, "Failed to resolve quota tier: "+err.Error())
+		return
+	}
+
+	var credential *repoCredential
+	if payload.CredentialID != "" {
+		cred, err := lookupCredential(payload.CredentialID, payload.UserID)
+		if err != nil {
+			deployment.fail("validation_error", codeValidationError, "Invalid credentialID: "+err.Error())
+			return
+		}
+		credential = &cred
+	}
+
+	// A prebuilt image stands in for the repository and commit the deployment is named and
+	// recorded under.
+	if payload.Image != "" {
+		payload.RepoURL, payload.CommitHash = imageRepository(payload.Image), imageRevision(payload.Image)
+		deployment.update(func(rec *DeploymentRecord) { rec.RepoURL, rec.CommitHash = payload.RepoURL, payload.CommitHash })
+		// A missing image would otherwise only show as ImagePullBackOff once its pods start.
+		if imageCheckEnabled {
+			if err := checkImageExists(ctx, payload.Image); errors.Is(err, errImageNotFound) {
+				deployment.fail("image_not_found", codeImageNotFound, "Image check failed: "+err.Error())
+				return
+			} else if err != nil {
+				if ctx.Err() != nil {
+					reportStopped(ctx, deployment)
+					return
+				}
+				deployment.logger.Warn("Could not verify that the image exists", "image", payload.Image, "error", err)
+			}
+		}
+	}
+
+	// Pin a branch or tag to the commit it currently points at.
+	if payload.Ref != "" {
+		commit, err := resolveRef(ctx, payload.RepoURL, payload.Ref, credential)
+		if err != nil {
+			if ctx.Err() != nil {
+				reportStopped(ctx, deployment)
+				return
+			}
+			deployment.fail("validation_error", codeRefResolveFailed, "Failed to resolve ref: "+err.Error())
+			return
+		}
+		payload.CommitHash = commit
+		deployment.update(func(rec *DeploymentRecord) { rec.CommitHash = commit })
+		deployment.send("ref_resolved", fmt.Sprintf("Resolved %s to commit %s", payload.Ref, commit))
+	}
 
-	// Create namespace.
-	if output, err := runCommand(30*time.Second, "kubectl", "create", "namespace", namespace); err != nil {
-		sendWebSocketMessage(sconn, "deployment_error", fmt.Sprintf("Failed to create namespace: %v\nOutput: %s", err, output))
+	namespace, err := generateNamespace(payload.UserID, payload.RepoURL, payload.CommitHash)
+	if err != nil {
+		deployment.fail("deployment_error", codeValidationError, "Invalid namespace: "+err.Error())
+		return
+	}
+	// The test template may define several pods, one per test suite.
+	testTemplate, testSubstitutions, runTests := testManifest(namespace, testPodName, payload)
+	var testPods []string
+	if runTests {
+		testPods, err = templatePods(testTemplate, testSubstitutions)
+		if err != nil {
+			deployment.fail("manifest_invalid", codeManifestInvalid, "Invalid test template: "+err.Error())
+			return
+		}
+		if len(testPods) == 0 {
+			deployment.fail("manifest_invalid", codeManifestInvalid, "Test template defines no pods")
+			return
+		}
+	}
+	if payload.DryRun {
+		dryRunDeployment(ctx, deployment, payload, dryRunPlan{
+			Namespace:   namespace,
+			TestPodName: testPodName,
+			TestPods:    testPods,
+			Resources:   resources,
+			HealthCheck: hc,
+			Autoscale:   autoscale,
+			DeployType:  deployType,
+		})
+		return
+	}
+	if payload.Subdomain != "" {
+		if err := deploymentStore.ClaimSubdomain(ctx, payload.Subdomain, payload.UserID, payload.RepoURL); errors.Is(err, errSubdomainTaken) {
+			deployment.fail("validation_error", codeSubdomainInUse, fmt.Sprintf("Subdomain %s is already in use by another app", payload.Subdomain))
+			return
+		} else if err != nil {
+			deployment.fail("deployment_error", codeInternalError, "Failed to reserve subdomain: "+err.Error())
+			return
+		}
+	}
+	if domain := payload.CustomDomain; domain != "" {
+		if err := verifyDomainDNS(ctx, payload.UserID, domain, generateAppHost(payload.UserID, payload.RepoURL, payload.Subdomain)); err != nil {
+			deployment.fail("domain_not_verified", codeDomainNotVerified, err.Error())
+			return
+		}
+		if err := deploymentStore.ClaimSubdomain(ctx, domain, payload.UserID, payload.RepoURL); errors.Is(err, errSubdomainTaken) {
+			deployment.fail("validation_error", codeDomainInUse, fmt.Sprintf("Domain %s is already in use by another app", domain))
+			return
+		} else if err != nil {
+			deployment.fail("deployment_error", codeInternalError, "Failed to reserve domain: "+err.Error())
+			return
+		}
+	}
+	if existingID, ok := deployment.claimNamespace(validated.Cluster.Name, namespace); !ok {
+		deployment.setStatus(StatusDuplicate)
+		deployment.send("deployment_already_exists", fmt.Sprintf("An identical deployment %s is already in progress", existingID))
 		return
 	}
+	unlockNamespace, err := deployment.lockNamespace(ctx, namespace)
+	if err != nil {
+		reportStopped(ctx, deployment)
+		return
+	}
+	defer unlockNamespace()
+	// Namespaces name commits by their abbreviated hash, so check the commit itself matches.
+	if rec, err := deploymentStore.LatestByNamespace(ctx, namespace, StatusSucceeded); err == nil && rec.Cluster == validated.Cluster.Name && rec.UserID == payload.UserID &&
+		sameCommit(rec.CommitHash, payload.CommitHash) && time.Since(rec.UpdatedAt) < dedupWindow {
+		deployment.setStatus(StatusDuplicate)
+		deployment.send("deployment_already_exists", fmt.Sprintf("An identical deployment %s succeeded %s ago and is live at: %s",
+			rec.ID, time.Since(rec.UpdatedAt).Round(time.Second), rec.Endpoint))
+		return
+	}
+	logger := deployment.logger
+	ctx = withLogger(ctx, logger)
+	logger.Info("Using namespace")
+	tr.setNamespace(validated.Cluster.Name, namespace)
+
+	// createdNamespace is set once this deployment has created the namespace itself, as
+	// opposed to redeploying into one left by an earlier deployment of the same commit.
+	// Only namespaces we created are deleted on cancellation or failure.
+	createdNamespace := false
+
+	// cancelled reports whether the deployment was cancelled or timed out, cleaning up after
+	// it if so. A timed out deployment is failed, so the failure cleanup below removes its namespace.
+	cancelled := func() bool {
+		if ctx.Err() == nil {
+			return false
+		}
+		if createdNamespace && !errors.Is(context.Cause(ctx), errDeploymentTimeout) {
+			logger.Info("Deployment cancelled, cleaning up namespace")
+			deleteNamespace(ctx, logger, namespace)
+		}
+		reportStopped(ctx, deployment)
+		return true
+	}
+
+	// Create namespace, or redeploy into it if an earlier deployment of this commit left it behind.
+	ctx = tr.startPhase(ctx, "namespace")
+	if err := deployment.runHooks(ctx, hookPreNamespace, nil); err != nil {
+		if cancelled() {
+			return
+		}
+		deployment.fail("hook_failed", codeHookFailed, err.Error())
+		return
+	}
+	owner := namespaceOwner{
+		DeploymentID: deployment.ID,
+		UserID:       payload.UserID,
+		RepoURL:      payload.RepoURL,
+		CommitHash:   payload.CommitHash,
+		CallbackURL:  payload.CallbackURL,
+	}
+	if payload.TTLSeconds > 0 {
+		owner.ExpiresAt = time.Now().Add(time.Duration(payload.TTLSeconds) * time.Second)
+	}
+	// Namespace names are derived from the user ID, so distinct users could collide; never
+	// redeploy into a namespace someone else owns.
+	exists, err := checkNamespaceOwner(ctx, namespace, payload.UserID)
+	if errors.Is(err, errNamespaceConflict) {
+		deployment.fail("namespace_conflict", codeNamespaceConflict, err.Error())
+		return
+	} else if err != nil {
+		if cancelled() {
+			return
+		}
+		deployment.fail("deployment_error", codeNamespaceCreateFailed, fmt.Sprintf("Failed to look up namespace: %v", err))
+		return
+	}
+	// Only new namespaces count against the cluster's namespace limit.
+	releaseCapacity := func() {}
+	if !exists {
+		if releaseCapacity, err = deployment.waitForNamespaceCapacity(ctx); err != nil {
+			cancelled()
+			return
+		}
+	}
+	err = createNamespace(ctx, namespace, owner)
+	releaseCapacity()
+	if err == nil {
+		createdNamespace = true
+	} else if apierrors.IsAlreadyExists(err) {
+		logger.Info("Namespace already exists, redeploying")
+		deployment.send("redeploy", fmt.Sprintf("Namespace %s already exists; redeploying into it", namespace))
+		if err := updateNamespaceOwner(ctx, namespace, owner); err != nil {
+			if cancelled() {
+				return
+			}
+			deployment.fail("deployment_error", codeNamespaceCreateFailed, fmt.Sprintf("Failed to update namespace metadata: %v", err))
+			return
+		}
+		// Pods are immutable, so remove any test pods left by the previous run.
+		if len(testPods) > 0 {
+			args := append([]string{"delete", "pod"}, testPods...)
+			args = append(args, "-n", namespace, "--ignore-not-found", "--wait=true")
+			if output, err := runKubectl(ctx, 2*time.Minute, args...); err != nil {
+				if cancelled() {
+					return
+				}
+				deployment.fail("deployment_error", codeNamespaceCreateFailed, fmt.Sprintf("Failed to remove previous test pods: %v\nOutput: %s", err, output))
+				return
+			}
+		}
+	} else {
+		if cancelled() {
+			return
+		}
+		deployment.fail("deployment_error", codeNamespaceCreateFailed, fmt.Sprintf("Failed to create namespace: %v", err))
+		return
+	}
+
+	deployment.progress(progressNamespaceCreated, "namespace_created")
+
+	// Forward what Kubernetes reports about the deployment's pods until it finishes.
+	stopPodEvents := forwardPodEvents(ctx, deployment, namespace, testPods)
+	defer stopPodEvents()
+
+	// Remove the namespace if any later step fails.
+	defer func() {
+		if !createdNamespace || deployment.status() != StatusFailed {
+			return
+		}
+		if keepFailedNamespaces {
+			logger.Info("Keeping namespace of failed deployment")
+			return
+		}
+		if err := deleteNamespace(ctx, logger, namespace); err != nil {
+			deployment.send("cleanup", fmt.Sprintf("Failed to clean up namespace %s: %v", namespace, err))
+			return
+		}
+		deployment.send("cleanup", fmt.Sprintf("Cleaned up namespace %s", namespace))
+	}()
+
+	// Cap what the namespace may consume before anything runs in it.
+	if err := applyNamespaceQuota(ctx, namespace, tier); err != nil {
+		if cancelled() {
+			return
+		}
+		deployment.fail("deployment_error", codeQuotaApplyFailed, "Failed to apply resource quota: "+err.Error())
+		return
+	}
+	deployment.send("quota_applied", fmt.Sprintf("Applied %s tier quota: %s CPU, %s memory, %s storage, %d pods",
+		tier.Name, tier.CPU, tier.Memory, tier.Storage, tier.Pods))
+
+	// Isolate the namespace from other tenants and cluster internals.
+	if networkPolicyEnabled {
+		if err := applyK8sTemplate(ctx, networkPolicyTemplate, namespace, networkPolicySubstitutions(namespace)); err != nil {
+			if cancelled() {
+				return
+			}
+			reportApplyFailure(deployment, codeApplyFailed, "Failed to apply network policy: ", err)
+			return
+		}
+	}
+
+	if payload.Image != "" {
+		message := fmt.Sprintf("Deploying prebuilt image %s without building from source", payload.Image)
+		if runTests {
+			message += "; smoke testing it first"
+		}
+		deployment.send("prebuilt_deploy", message)
+	}
+	if runTests {
+		// Deploy test pod, along with the credential it clones the repository with.
+		ctx = tr.startPhase(ctx, "test_deploy")
+		deployment.setStatus(StatusTesting)
+		if credential != nil {
+			if err := applyRepoCredentialSecret(ctx, namespace, *credential); err != nil {
+				if cancelled() {
+					return
+				}
+				deployment.fail("deployment_error", codeCredentialsFailed, "Failed to configure repository credentials: "+err.Error())
+				return
+			}
+		}
+		applied, err := applyK8sTemplates(ctx, testTemplate, namespace, testSubstitutions)
+		if err != nil {
+			if cancelled() {
+				return
+			}
+			reportApplyFailure(deployment, codeApplyFailed, "Failed to deploy test pod: ", err)
+			return
+		}
+		deployment.send("manifests_applied", "Applied test manifests: "+templateNames(applied))
+		deployment.progress(progressTestDeployed, "test_deployed")
 
-	// Deploy test pod.
-	pvcName := generatePVCName(namespace)
-	substitutions := map[string]string{
-		"PVCName":   pvcName,
-		"Namespace": namespace,
-		"RepoURL":   payload.RepoURL,
+		// Monitor the test pods, streaming their logs to the client until monitoring finishes.
+		ctx = tr.startPhase(ctx, "test_monitor")
+		logCtx, stopLogs := context.WithCancel(ctx)
+		for _, pod := range testPods {
+			go streamPodLogs(logCtx, deployment, namespace, pod)
+		}
+		monitorStartedAt := time.Now()
+		failedPod, err := monitorTestPods(ctx, deployment, namespace, testPods, monitorOpts)
+		metricTestPodWait.Observe(time.Since(monitorStartedAt).Seconds())
+		stopLogs()
+		if err != nil {
+			if cancelled() {
+				return
+			}
+			details := collectPodDiagnostics(ctx, namespace, failedPod)
+			reportTestFailure(deployment, err, monitorOpts)
+			deployment.send("failure_details", details)
+			return
+		}
+		deployment.progress(progressTestsPassed, "tests_passed")
+	} else {
+		deployment.progress(progressTestsPassed, "tests_skipped")
 	}
-	if err := applyK8sTemplate("/templates/test-pod.yaml", namespace, substitutions); err != nil {
-		sendWebSocketMessage(sconn, "deployment_error", "Failed to deploy test pod: "+err.Error())
+	if err := deployment.runHooks(ctx, hookPostTest, nil); err != nil {
+		if cancelled() {
+			return
+		}
+		deployment.fail("hook_failed", codeHookFailed, err.Error())
 		return
 	}
 
-	// Monitor test pod.
-	passed, err := monitorTestPod(namespace, "test-app")
-	if !passed || err != nil {
-		sendWebSocketMessage(sconn, "test_failure", fmt.Sprintf("Tests failed: %v", err))
+	ctx = tr.startPhase(ctx, "prod_deploy")
+	if err := deployment.runHooks(ctx, hookPreProd, nil); err != nil {
+		if cancelled() {
+			return
+		}
+		deployment.fail("hook_failed", codeHookFailed, err.Error())
+		return
+	}
+	if deployType == DeployTypeHelm {
+		// Install the user's chart, which brings its own workloads and ingress.
+		deployment.setStatus(StatusDeploying)
+		if err := deployHelmRelease(ctx, deployment, namespace, payload); err != nil {
+			if cancelled() {
+				return
+			}
+			deployment.fail("deployment_error", codeHelmInstallFailed, "Failed to deploy Helm chart: "+err.Error())
+			return
+		}
+		scheduleTestPodCleanup(ctx, logger, namespace, testPods)
+		deployment.progress(progressHealthy, "healthy")
+		deployment.setStatus(StatusSucceeded)
+		deployment.send("deployment_success", fmt.Sprintf("Deployment successful! Helm release %s is running in namespace %s", helmReleaseName, namespace))
+		deployment.runHooks(ctx, hookPostSuccess, nil)
 		return
 	}
 
 	// Deploy production pods.
-	if err := applyK8sTemplate("/templates/prod-pod.yaml", namespace, map[string]string{"Namespace": namespace}); err != nil {
-		sendWebSocketMessage(sconn, "deployment_error", "Failed to deploy production pods: "+err.Error())
+	deployment.setStatus(StatusDeploying)
+	if err := applyEnvConfigMap(ctx, namespace, payload.Env); err != nil {
+		if cancelled() {
+			return
+		}
+		deployment.fail("deployment_error", codeApplyFailed, "Failed to configure environment: "+err.Error())
+		return
+	}
+	if err := applyAppSecret(ctx, namespace, payload.Secrets); err != nil {
+		if cancelled() {
+			return
+		}
+		deployment.fail("deployment_error", codeApplyFailed, "Failed to configure secrets: "+err.Error())
 		return
 	}
 
-	// Delay cleanup of the test pod (non-blocking).
-	go func() {
-		time.Sleep(60 * time.Second)
-		cleanupTestPod(namespace, "test-app")
-	}()
+	// Bring the new version up next to the live one, then switch traffic over (blue-green).
+	liveColor, hasLive, err := liveProdVersion(ctx, namespace)
+	if err != nil {
+		if cancelled() {
+			return
+		}
+		deployment.fail("deployment_error", codeInternalError, "Failed to look up the live version: "+err.Error())
+		return
+	}
+	color := otherColor(liveColor)
+	prodTemplate, prodSubs := prodManifest(namespace, resources, hc, color, payload)
+	applied, err := applyK8sTemplates(ctx, prodTemplate, namespace, prodSubs)
+	if err != nil {
+		if cancelled() {
+			return
+		}
+		reportApplyFailure(deployment, codeApplyFailed, "Failed to deploy production pods: ", err)
+		return
+	}
+	deployment.send("manifests_applied", "Applied production manifests: "+templateNames(applied))
+	if err := waitForProdRollout(ctx, namespace, color, func(line string) { deployment.send("rollout_progress", line) }); err != nil {
+		if cancelled() {
+			return
+		}
+		var details string
+		var rerr *rolloutError
+		var qerr *quotaExceededError
+		var uerr *unschedulableError
+		if errors.As(err, &qerr) {
+			deployment.fail("quota_exceeded", codeQuotaExceeded, "New version cannot start: "+qerr.Error())
+			return
+		}
+		if errors.As(err, &uerr) {
+			deployment.fail("unschedulable", codeUnschedulable, "New version cannot be scheduled: "+uerr.Error())
+			return
+		}
+		if errors.As(err, &rerr) {
+			details = rerr.Details
+		}
+		deployment.failWithDetails("rollout_failed", codeRolloutFailed, "New version did not roll out: "+err.Error(), details)
+		return
+	}
+	// A completed rollout only guarantees available pods; wait for every replica to be Ready
+	// so the endpoint is not reported while the service is half up.
+	report := func(ready, desired int32) {
+		deployment.send("replicas_ready", fmt.Sprintf("%d/%d replicas ready", ready, desired))
+	}
+	if err := waitForReplicasReady(ctx, namespace, prodDeploymentFor(color), resources.Replicas, replicasReadyTimeout, report); err != nil {
+		if cancelled() {
+			return
+		}
+		deployment.fail("rollout_failed", codeRolloutFailed, "Not every replica of the new version became ready: "+err.Error())
+		return
+	}
+	if err := waitForProdVersionHealthy(ctx, namespace, color, hc); err != nil {
+		if cancelled() {
+			return
+		}
+		deployment.fail("deployment_unhealthy", codeHealthCheckFailed, "New version is not responding: "+err.Error())
+		return
+	}
+	deployment.progress(progressProdDeployed, "prod_deployed")
+
+	// Try the new version on a share of the app's live traffic first, if asked to.
+	if canary.Percent > 0 {
+		live, err := canaryBaseline(ctx, payload.UserID, payload.RepoURL, validated.Cluster)
+		if err != nil {
+			deployment.send("canary_progress", "Skipping the canary: "+err.Error())
+		} else if err := runCanary(ctx, deployment, namespace, color, live, hc, canary); err != nil {
+			rollBackCanary(ctx, deployment, namespace, color)
+			if cancelled() {
+				return
+			}
+			deployment.fail("canary_failed", codeCanaryFailed, "Canary rolled back: "+err.Error())
+			return
+		} else {
+			deployment.send("canary_progress", fmt.Sprintf("Canary passed; promoting the %s version to 100%% of traffic", color))
+		}
+	}
+
+	deployment.send("switching_traffic", fmt.Sprintf("Switching traffic to the %s version", color))
+	if err := applyK8sTemplate(ctx, prodServiceTemplate, namespace, prodServiceSubstitutions(namespace, prodServiceName, color)); err != nil {
+		if cancelled() {
+			return
+		}
+		reportApplyFailure(deployment, codeApplyFailed, "Failed to switch traffic: ", err)
+		return
+	}
+	if hasLive {
+		scheduleOldVersionCleanup(ctx, deployment, namespace, liveColor)
+	}
+	if err := applyAutoscaling(ctx, deployment, namespace, color, autoscale); err != nil {
+		if cancelled() {
+			return
+		}
+		reportApplyFailure(deployment, codeApplyFailed, "Failed to configure autoscaling: ", err)
+		return
+	}
+
+	// Expose production pods through an ingress and wait for it to be admitted.
+	deployment.send("provisioning_ingress", "Provisioning ingress for "+generateHost(namespace))
+	if err := applyK8sTemplate(ctx, ingressTemplate, namespace, ingressSubstitutions(namespace, prodIngressName, generateHost(namespace))); err != nil {
+		if cancelled() {
+			return
+		}
+		reportApplyFailure(deployment, codeIngressFailed, "Failed to create ingress: ", err)
+		return
+	}
+	if err := waitForIngress(ctx, namespace, prodIngressName); err != nil {
+		if cancelled() {
+			return
+		}
+		deployment.fail("deployment_error", codeIngressFailed, "Ingress was not provisioned: "+err.Error())
+		return
+	}
 
-	// Generate endpoint and send success message.
+	scheduleTestPodCleanup(ctx, logger, namespace, testPods)
+
+	// Serve the custom domain once cert-manager has issued its certificate.
+	if domain := payload.CustomDomain; domain != "" {
+		deployment.send("provisioning_certificate", "Requesting a certificate for "+domain)
+		if err := applyK8sTemplate(ctx, customDomainIngressTemplate, namespace, customDomainSubstitutions(namespace, domain)); err != nil {
+			if cancelled() {
+				return
+			}
+			reportApplyFailure(deployment, codeIngressFailed, "Failed to create custom domain ingress: ", err)
+			return
+		}
+		if err := waitForCertificate(ctx, deployment, namespace); err != nil {
+			if cancelled() {
+				return
+			}
+			deployment.fail("certificate_failed", codeCertificateFailed, fmt.Sprintf("Certificate for %s was not issued: %v", domain, err))
+			return
+		}
+	}
+
+	// Generate endpoint and wait for it to serve traffic before reporting success.
+	ctx = tr.startPhase(ctx, "health_check")
 	endpoint := generateEndpoint(namespace)
-	sendWebSocketMessage(sconn, "deployment_success", fmt.Sprintf("Deployment successful! Your app is live at: %s", endpoint))
+	deployment.setEndpoint(endpoint)
+	if err := waitForEndpointHealthy(ctx, endpoint, hc.httpPath()); err != nil {
+		if cancelled() {
+			return
+		}
+		deployment.fail("deployment_unhealthy", codeHealthCheckFailed, "Deployment is not responding: "+err.Error())
+		return
+	}
+	deployment.endPhase()
+	deployment.setStatus(StatusSucceeded)
+	deployment.progress(progressHealthy, "healthy")
+	success := Event{Event: "deployment_success", Message: fmt.Sprintf("Deployment successful! Your app is live at: %s", endpoint),
+		Timings: deployment.timings()}
+	if image, err := prodVersionImage(ctx, namespace, color); err != nil {
+		logger.Error("Failed to look up the running image", "error", err)
+	} else {
+		success.Image, success.ImageDigest = image.Image, image.Digest
+		success.Message += fmt.Sprintf(" (image %s", image.Image)
+		if image.Digest != "" {
+			success.Message += "@" + image.Digest
+		}
+		success.Message += ")"
+	}
+	deployment.emit(success)
+	deployment.runHooks(ctx, hookPostSuccess, nil)
+
+	// Point the app's stable endpoint at the new release, keeping the old one for rollback.
+	r := release{
+		DeploymentID: deployment.ID,
+		Cluster:      validated.Cluster,
+		Namespace:    namespace,
+		CommitHash:   payload.CommitHash,
+		Host:         generateAppHost(payload.UserID, payload.RepoURL, payload.Subdomain),
+		CustomDomain: payload.CustomDomain,
+	}
+	if err := promoteRelease(ctx, deployment, payload.UserID, payload.RepoURL, r); err != nil {
+		logger.Error("Failed to route app endpoint to new release", "error", err)
+		return
+	}
+	message := fmt.Sprintf("Your app's stable endpoint https://%s now serves this deployment", r.Host)
+	if r.CustomDomain != "" {
+		message += ", as does https://" + r.CustomDomain
+	}
+	deployment.send("app_endpoint", message)
+}
+
+// deploymentTimeout bounds a deployment from the moment a worker starts it.
+var deploymentTimeout time.Duration
+
+// errDeploymentTimeout is the cancellation cause of a deployment that ran out of time.
+var errDeploymentTimeout = errors.New("deployment timed out")
+
+// reportStopped reports a deployment whose context is done: as deployment_timeout if it ran
+// out of time, and as deployment_cancelled otherwise.
+func reportStopped(ctx context.Context, deployment *Deployment) {
+	if errors.Is(context.Cause(ctx), errDeploymentTimeout) {
+		deployment.fail("deployment_timeout", codeDeploymentTimeout, fmt.Sprintf("Deployment %s did not finish within %s", deployment.ID, deploymentTimeout))
+		return
+	}
+	deployment.setStatus(StatusCancelled)
+	deployment.send("deployment_cancelled", fmt.Sprintf("Deployment %s was cancelled", deployment.ID))
+}
+
+// reportApplyFailure reports a failed template apply to the client with the given code, or
+// as manifest_invalid when the manifest itself was at fault and as quota_exceeded when the
+// namespace quota refused an object.
+func reportApplyFailure(deployment *Deployment, code errorCode, prefix string, err error) {
+	var invalid *manifestInvalidError
+	if errors.As(err, &invalid) {
+		deployment.fail("manifest_invalid", codeManifestInvalid, prefix+invalid.Error())
+		return
+	}
+	if qerr := parseQuotaError(err.Error()); qerr != nil {
+		deployment.fail("quota_exceeded", codeQuotaExceeded, prefix+qerr.Error())
+		return
+	}
+	deployment.fail("deployment_error", code, prefix+err.Error())
+}
+
+// reportTestFailure sends the failure event matching why test pod monitoring failed.
+func reportTestFailure(deployment *Deployment, err error, opts monitorOptions) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		deployment.fail("test_timeout", codeTestTimeout, fmt.Sprintf("Tests did not finish within %s", opts.Timeout))
+		return
+	}
+	var exitErr *testExitError
+	if errors.As(err, &exitErr) {
+		deployment.fail("test_failure", codeTestFailed, fmt.Sprintf("Tests failed: %v", exitErr))
+		return
+	}
+	var uerr *unschedulableError
+	if errors.As(err, &uerr) {
+		deployment.fail("unschedulable", codeUnschedulable, "Test pod cannot be scheduled: "+uerr.Error())
+		return
+	}
+	var waitErr *containerWaitingError
+	if errors.As(err, &waitErr) {
+		if waitErr.isImagePull() {
+			deployment.fail("image_pull_error", codeImagePullError, "Failed to pull test image: "+waitErr.Error())
+		} else {
+			deployment.fail("crash_loop", codeCrashLoop, "Test container keeps crashing: "+waitErr.Error())
+		}
+		return
+	}
+	deployment.fail("test_failure", codeTestFailed, fmt.Sprintf("Tests failed: %v", err))
+}
+
+// Keepalive settings, set from Config: the server pings every wsPingInterval and drops the
+// connection if no pong (or other message) arrives within wsPongWait.
+var (
+	wsPingInterval time.Duration
+	wsPongWait     time.Duration
+)
+
+// wsMaxMessageBytes, set from Config, bounds the size of a client message. Larger messages
+// are discarded unparsed and answered with payload_too_large; a message more than four
+// times the limit closes the connection with status 1009 (message too big).
+var wsMaxMessageBytes int64
+
+// errPayloadTooLarge is returned by readClientMessage for a message over wsMaxMessageBytes.
+var errPayloadTooLarge = errors.New("message too large")
+
+// readClientMessage reads and decodes the next client message, reading no more than
+// wsMaxMessageBytes+1 bytes of it.
+func readClientMessage(conn *websocket.Conn, msg *ClientMessage) error {
+	_, r, err := conn.NextReader()
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, wsMaxMessageBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > wsMaxMessageBytes {
+		return errPayloadTooLarge
+	}
+	return json.Unmarshal(data, msg)
+}
+
+// keepAlive pings the client until done is closed, closing the connection if a ping cannot be sent.
+func keepAlive(sconn *SafeConn, done <-chan struct{}) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := sconn.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				log.Printf("Error sending ping, closing connection: %v", err)
+				sconn.Conn.Close()
+				return
+			}
+		}
+	}
 }
 
 // wsHandler handles incoming WebSocket connections.
 func wsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := parseToken(r)
+	if err != nil {
+		log.Printf("Rejected WebSocket connection: %v", err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userID := claims.Subject
+
+	ip := clientIP(r)
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Upgrade error: %v", err)
 		return
 	}
 	defer conn.Close()
+	// Write compression only takes effect on connections that negotiated the extension;
+	// other clients are sent uncompressed messages.
+	compressed := wsCompression && offersDeflate(r)
+	conn.EnableWriteCompression(compressed)
+	log.Printf("WebSocket connection from %s (compression: %t)", ip, compressed)
+
+	connCtx, cancelConn := context.WithCancel(context.Background())
+	defer cancelConn()
 
 	sconn := &SafeConn{Conn: conn}
+	trackConnection(sconn)
+	defer untrackConnection(sconn)
+
+	// The connection is only authorized for as long as the token it was opened with.
+	expiry := time.AfterFunc(time.Until(claims.ExpiresAt.Time), func() {
+		log.Printf("Closing WebSocket connection from %s: token expired", ip)
+		sconn.Close(websocket.ClosePolicyViolation, "token expired")
+	})
+	defer expiry.Stop()
+
+	// Deployments started or subscribed to on this connection are unsubscribed when it
+	// closes. One left without subscribers is cancelled, cleaning up the namespace it
+	// created, unless the client reconnects and subscribes within reconnectGrace.
+	var subscriptions []*eventLog
+	defer func() {
+		for _, events := range subscriptions {
+			events.unsubscribe(slog.Default(), sconn)
+		}
+	}()
+
+	// Log tails started on this connection stop when it closes.
+	tails := newLogTails()
+	defer tails.stopAll()
+
+	// The rest of an oversized message is discarded by the next read, up to this limit.
+	conn.SetReadLimit(4 * wsMaxMessageBytes)
+
+	// Any message or pong from the client extends the read deadline; a client that goes
+	// silent for wsPongWait fails the read and is disconnected.
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	pingDone := make(chan struct{})
+	defer close(pingDone)
+	go keepAlive(sconn, pingDone)
+
 	for {
-		var payload DeploymentPayload
-		if err := conn.ReadJSON(&payload); err != nil {
+		var msg ClientMessage
+		err := readClientMessage(conn, &msg)
+		if errors.Is(err, errPayloadTooLarge) {
+			log.Printf("Rejected message over %d bytes", wsMaxMessageBytes)
+			sendWebSocketError(sconn, "payload_too_large", codePayloadTooLarge, fmt.Sprintf("Message exceeds the %d byte limit", wsMaxMessageBytes))
+			conn.SetReadDeadline(time.Now().Add(wsPongWait))
+			continue
+		}
+		if err != nil {
 			log.Printf("Error reading JSON: %v", err)
+			if code, reason, ok := closeReasonFor(err); ok {
+				sconn.Close(code, reason)
+			}
 			break
 		}
-		log.Printf("Received payload: %+v", payload)
-		go handleDeployment(sconn, payload)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		switch msg.Action {
+		case "rollback":
+			log.Printf("Received rollback request for %s", msg.RepoURL)
+			go rollbackApp(connCtx, sconn, userID, ip, msg.RepoURL)
+		case "scale":
+			log.Printf("Received scale request for deployment %s to %d replicas", msg.DeploymentID, msg.Replicas)
+			go scaleDeployment(connCtx, sconn, userID, ip, msg.DeploymentID, msg.Replicas)
+		case "restart":
+			log.Printf("Received restart request for deployment %s", msg.DeploymentID)
+			go restartDeployment(connCtx, sconn, userID, ip, msg.DeploymentID)
+		case "logs":
+			log.Printf("Received logs request for deployment %s (follow: %t)", msg.DeploymentID, msg.Follow)
+			tails.start(connCtx, sconn, userID, msg.DeploymentID, msg.Follow)
+		case "unsubscribe_logs":
+			log.Printf("Received logs unsubscribe request for deployment %s", msg.DeploymentID)
+			if !tails.stop(msg.DeploymentID) {
+				sendWebSocketError(sconn, "logs_error", codeDeploymentNotFound, "Not following the logs of deployment "+msg.DeploymentID)
+			}
+		case "cancel":
+			log.Printf("Received cancel request for deployment %s", msg.DeploymentID)
+			outcome := auditSucceeded
+			if !cancelDeployment(msg.DeploymentID) {
+				outcome = auditFailed
+				sendWebSocketError(sconn, "cancel_error", codeDeploymentNotFound, "No in-flight deployment with ID "+msg.DeploymentID)
+			}
+			recordAudit(auditEntry{UserID: userID, Action: "cancel", DeploymentID: msg.DeploymentID, Outcome: outcome, SourceIP: ip})
+		case "subscribe":
+			log.Printf("Received subscribe request for deployment %s after event %d", msg.DeploymentID, msg.After)
+			events, err := eventLogFor(msg.DeploymentID, userID)
+			if err != nil {
+				sendWebSocketError(sconn, "subscribe_error", codeDeploymentNotFound, fmt.Sprintf("Cannot subscribe to deployment %s: %v", msg.DeploymentID, err))
+				continue
+			}
+			if events.subscribe(slog.Default(), sconn, msg.After, true) {
+				subscriptions = append(subscriptions, events)
+			}
+		default:
+			// Deploy as the authenticated user, regardless of what the payload claims.
+			msg.UserID = userID
+			log.Printf("Received payload: %+v", msg.DeploymentPayload)
+			if wait, ok := allowDeployment(userID, ip); !ok {
+				auditDeployRequest(msg.DeploymentPayload, ip, auditRejected, "rate limited")
+				seconds := retryAfterSeconds(wait)
+				writeWebSocketMessage(slog.Default(), sconn, Event{
+					Event:      "rate_limited",
+					Code:       codeRateLimited,
+					Message:    fmt.Sprintf("Too many deployment requests; retry in %ds", seconds),
+					RetryAfter: seconds,
+					Timestamp:  time.Now().UTC(),
+				})
+				continue
+			}
+			if !trackDeployment() {
+				auditDeployRequest(msg.DeploymentPayload, ip, auditRejected, "server shutting down")
+				sendWebSocketError(sconn, "deployment_rejected", codeServerShuttingDown, "Server is shutting down; please retry shortly")
+				continue
+			}
+			traceHeader := r.Header
+			if msg.TraceParent != "" {
+				traceHeader = http.Header{}
+				traceHeader.Set(traceParentField, msg.TraceParent)
+			}
+			deployment, err := startDeployment(traceContextFrom(context.Background(), traceHeader), sconn, msg.DeploymentPayload, ip)
+			if err != nil {
+				sendWebSocketError(sconn, "deployment_rejected", codeTooManyDeployments, err.Error())
+				continue
+			}
+			subscriptions = append(subscriptions, deployment.events)
+		}
+	}
+}
+
+// Command-line flags. -listen-addr overrides the configured listen address.
+var (
+	configFile = flag.String("config", envString("CONFIG_FILE", ""), "path of a JSON or YAML config file")
+	listenAddr = flag.String("listen-addr", "", "address to listen on (host:port)")
+)
+
+// validateListenAddr checks that addr is a host:port pair with a valid port number.
+func validateListenAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("port %q must be a number between 0 and 65535", port)
 	}
+	if host != "" && net.ParseIP(host) == nil && len(validation.IsDNS1123Subdomain(strings.ToLower(host))) > 0 {
+		return fmt.Errorf("host %q is neither an IP address nor a hostname", host)
+	}
+	return nil
 }
 
 func main() {
+	slog.SetDefault(newLogger())
+
+	flag.Parse()
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if *listenAddr != "" {
+		cfg.ListenAddr = *listenAddr
+	}
+	if err := cfg.validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	cfg.apply()
+	log.Printf("Loaded configuration: %s", cfg.redacted())
+	if problems := assetProblems(); len(problems) > 0 {
+		log.Fatalf("Required templates are unavailable:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	if err := loadClusters(); err != nil {
+		log.Fatalf("Failed to create Kubernetes clients: %v", err)
+	}
+	if err := checkClusters(context.Background()); err != nil {
+		log.Fatalf("Kubernetes API unreachable:\n%v", err)
+	}
+
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+
+	store, err := newSQLiteStore(cfg.DatabasePath)
+	if err != nil {
+		log.Fatalf("Failed to open deployment store: %v", err)
+	}
+	defer store.Close()
+	deploymentStore = store
+	sink, closeAudit, err := newAuditSink(store)
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer closeAudit()
+	auditLog = sink
+	deploymentPool = newWorkerPool(cfg.WorkerPoolSize)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go runNamespaceGC(ctx)
+
 	http.HandleFunc("/ws", wsHandler)
-	log.Println("WebSocket server listening on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	http.HandleFunc("GET /deployments", listDeploymentsHandler)
+	http.HandleFunc("POST /deployments", createDeploymentHandler)
+	http.HandleFunc("GET /deployments/{id}", deploymentStatusHandler)
+	http.HandleFunc("GET /deployments/{id}/events", deploymentEventsHandler)
+	http.HandleFunc("GET /deployments/{id}/logs", deploymentLogsHandler)
+	http.HandleFunc("DELETE /deployments/{id}", deleteDeploymentHandler)
+	http.HandleFunc("POST /credentials", createCredentialHandler)
+	http.HandleFunc("DELETE /credentials/{id}", deleteCredentialHandler)
+	http.HandleFunc("POST /admin/cleanup", adminCleanupHandler)
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("GET /healthz", healthzHandler)
+	http.HandleFunc("GET /readyz", readyzHandler)
+
+	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", cfg.ListenAddr, err)
+	}
+	srv := &http.Server{Addr: cfg.ListenAddr}
+	certFile, keyFile, _ := cfg.tlsFiles()
+	if certFile != "" {
+		reloader, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: reloader.GetCertificate}
+	}
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			log.Printf("WebSocket server listening on %s with TLS (certificate %s)", ln.Addr(), certFile)
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			log.Printf("WebSocket server listening on %s without TLS", ln.Addr())
+			err = srv.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutdown signal received, draining deployments")
+	shutdown(srv)
+
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFlush()
+	if err := shutdownTracing(flushCtx); err != nil {
+		log.Printf("Error flushing traces: %v", err)
 	}
 }
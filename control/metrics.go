@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics exposed at /metrics.
+var (
+	metricDeploymentsStarted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backendim_deployments_started_total",
+		Help: "Number of deployments started.",
+	})
+	metricDeploymentsFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backendim_deployments_finished_total",
+		Help: "Number of deployments finished, by final status (succeeded, failed, cancelled).",
+	}, []string{"status"})
+	metricDeploymentDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "backendim_deployment_duration_seconds",
+		Help:    "End-to-end deployment duration, by final status.",
+		Buckets: prometheus.ExponentialBuckets(5, 2, 8),
+	}, []string{"status"})
+	metricTestPodWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "backendim_test_pod_wait_seconds",
+		Help:    "Time spent waiting for the test pod in monitorTestPod.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+	})
+	metricActiveDeployments = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "backendim_active_deployments",
+		Help: "Number of deployments currently in progress.",
+	})
+)
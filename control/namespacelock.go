@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// namespaceLocks serializes the operations on each namespace, keyed by namespaceKey: the
+// deployments into it, the delayed cleanups they leave running in it, and its deletion.
+// Operations on different namespaces proceed in parallel.
+var namespaceLocks = newKeyedMutex()
+
+// keyedMutex is a set of mutexes created on demand for each key and dropped once nobody
+// holds or waits for them. Unlike a sync.Mutex, waiting for one can be cancelled.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+// keyedLock is the mutex of one key. Its channel holds a token while the mutex is held, and
+// refs counts the holder and the waiters.
+type keyedLock struct {
+	held chan struct{}
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: map[string]*keyedLock{}}
+}
+
+// acquire returns the mutex of key, counting the caller as one of its users.
+func (k *keyedMutex) acquire(key string) *keyedLock {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{held: make(chan struct{}, 1)}
+		k.locks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+// release stops counting the caller as a user of key's mutex, dropping it if it was the last.
+func (k *keyedMutex) release(key string, l *keyedLock) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if l.refs--; l.refs == 0 {
+		delete(k.locks, key)
+	}
+}
+
+// lock locks key's mutex, waiting until it is free or ctx is done. The returned function
+// unlocks it and must be called exactly once.
+func (k *keyedMutex) lock(ctx context.Context, key string) (unlock func(), err error) {
+	l := k.acquire(key)
+	select {
+	case l.held <- struct{}{}:
+		return k.unlocker(key, l), nil
+	case <-ctx.Done():
+		k.release(key, l)
+		return nil, ctx.Err()
+	}
+}
+
+// tryLock locks key's mutex if it is free, without waiting.
+func (k *keyedMutex) tryLock(key string) (unlock func(), ok bool) {
+	l := k.acquire(key)
+	select {
+	case l.held <- struct{}{}:
+		return k.unlocker(key, l), true
+	default:
+		k.release(key, l)
+		return nil, false
+	}
+}
+
+func (k *keyedMutex) unlocker(key string, l *keyedLock) func() {
+	return func() {
+		<-l.held
+		k.release(key, l)
+	}
+}
+
+// lockNamespace locks the namespace in the cluster selected for ctx, waiting while another
+// operation holds it or until ctx is done.
+func lockNamespace(ctx context.Context, namespace string) (unlock func(), err error) {
+	return namespaceLocks.lock(ctx, namespaceKey(clusterFrom(ctx).Name, namespace))
+}
+
+// lockNamespace locks the deployment's namespace for the rest of the deployment, telling
+// the client when it has to wait for another operation on the namespace to finish.
+func (d *Deployment) lockNamespace(ctx context.Context, namespace string) (unlock func(), err error) {
+	if unlock, ok := namespaceLocks.tryLock(namespaceKey(clusterFrom(ctx).Name, namespace)); ok {
+		return unlock, nil
+	}
+	d.send("waiting_for_namespace", fmt.Sprintf("Waiting for another operation on namespace %s to finish", namespace))
+	return lockNamespace(ctx, namespace)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyedMutexSerializesEachKey(t *testing.T) {
+	k := newKeyedMutex()
+	var (
+		wg                sync.WaitGroup
+		active, maxActive atomic.Int32
+	)
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := k.lock(context.Background(), "cluster/ns")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			n := active.Add(1)
+			for {
+				m := maxActive.Load()
+				if n <= m || maxActive.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			active.Add(-1)
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if got := maxActive.Load(); got != 1 {
+		t.Errorf("%d holders of the same key at once, want 1", got)
+	}
+	if len(k.locks) != 0 {
+		t.Errorf("%d locks left after every holder unlocked, want 0", len(k.locks))
+	}
+}
+
+func TestKeyedMutexKeysAreIndependent(t *testing.T) {
+	k := newKeyedMutex()
+	unlock, err := k.lock(context.Background(), "cluster/ns-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	other, ok := k.tryLock("cluster/ns-2")
+	if !ok {
+		t.Fatal("locking another namespace waited for the first")
+	}
+	other()
+	if _, ok := k.tryLock("cluster/ns-1"); ok {
+		t.Error("locked a namespace that is already held")
+	}
+}
+
+func TestKeyedMutexLockCancelled(t *testing.T) {
+	k := newKeyedMutex()
+	unlock, err := k.lock(context.Background(), "cluster/ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := k.lock(ctx, "cluster/ns"); err == nil {
+		t.Fatal("lock of a held key succeeded")
+	}
+	unlock()
+	if len(k.locks) != 0 {
+		t.Errorf("%d locks left after the waiter gave up, want 0", len(k.locks))
+	}
+}
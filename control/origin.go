@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// allowedOrigins is the comma-separated ALLOWED_ORIGINS allowlist. Entries are either full
+// origins ("https://app.example.com"), bare hosts ("app.example.com"), or wildcard
+// subdomains ("*.example.com").
+var allowedOrigins = parseAllowedOrigins(os.Getenv("ALLOWED_ORIGINS"))
+
+// parseAllowedOrigins splits a comma-separated list of origins, dropping empty entries.
+func parseAllowedOrigins(value string) []string {
+	var origins []string
+	for _, origin := range strings.Split(value, ",") {
+		if origin = strings.ToLower(strings.TrimSpace(origin)); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// checkOrigin validates the Origin header of a WebSocket upgrade against the allowlist.
+// Requests without an Origin header come from non-browser clients and are allowed.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if originAllowed(origin, allowedOrigins) {
+		return true
+	}
+	log.Printf("Rejected WebSocket connection from disallowed origin %q", origin)
+	return false
+}
+
+// originAllowed reports whether origin matches any entry in allowed.
+func originAllowed(origin string, allowed []string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	origin = strings.ToLower(origin)
+	host := strings.ToLower(u.Hostname())
+	for _, pattern := range allowed {
+		switch {
+		case strings.HasPrefix(pattern, "*."):
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		case strings.Contains(pattern, "://"):
+			if pattern == origin {
+				return true
+			}
+		case pattern == host:
+			return true
+		}
+	}
+	return false
+}
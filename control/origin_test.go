@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	allowed := parseAllowedOrigins(" https://app.example.com, dashboard.example.org ,*.preview.example.com,")
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"HTTPS://APP.EXAMPLE.COM", true},
+		{"http://app.example.com", false},
+		{"https://dashboard.example.org", true},
+		{"http://dashboard.example.org:8080", true},
+		{"https://pr-12.preview.example.com", true},
+		{"https://a.b.preview.example.com", true},
+		{"https://preview.example.com", false},
+		{"https://evilpreview.example.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"https://evil.com", false},
+		{"null", false},
+		{"not a url", false},
+	}
+	for _, tt := range tests {
+		if got := originAllowed(tt.origin, allowed); got != tt.want {
+			t.Errorf("originAllowed(%q) = %t, want %t", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	previous := allowedOrigins
+	allowedOrigins = []string{"https://app.example.com"}
+	t.Cleanup(func() { allowedOrigins = previous })
+	for origin, want := range map[string]bool{
+		"":                        true,
+		"https://app.example.com": true,
+		"https://evil.com":        false,
+	} {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if got := checkOrigin(r); got != want {
+			t.Errorf("checkOrigin with Origin %q = %t, want %t", origin, got, want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// forwardPodEvents watches the Kubernetes events about the deployment's pods in namespace,
+// its test pods and the pods of the production Deployments, and forwards each to the client
+// as a k8s_event, so users see scheduling, volume mounts and image pulls as they happen.
+// Events recorded before the call are skipped. The returned function stops forwarding and
+// waits for it to finish.
+func forwardPodEvents(ctx context.Context, deployment *Deployment, namespace string, testPods []string) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	f := &podEventForwarder{
+		deployment: deployment,
+		namespace:  namespace,
+		testPods:   testPods,
+		seen:       map[types.UID]string{},
+	}
+	go func() {
+		defer close(done)
+		f.run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// podEventForwarder forwards the events of one deployment's pods. seen maps each event
+// already handled to the resource version it was handled at, so an event is forwarded again
+// only when Kubernetes updates it, such as when a back-off repeats.
+type podEventForwarder struct {
+	deployment *Deployment
+	namespace  string
+	testPods   []string
+	seen       map[types.UID]string
+}
+
+// podEventSelector restricts event lists and watches to events about pods.
+var podEventSelector = fields.OneTermEqualSelector("involvedObject.kind", "Pod").String()
+
+// run lists and then watches the namespace's pod events until ctx is cancelled, listing
+// again whenever the watch ends after a delay that backs off to monitorPollInterval.
+func (f *podEventForwarder) run(ctx context.Context) {
+	events := kubeFor(ctx).CoreV1().Events(f.namespace)
+	listed := false
+	backoff := newPollBackoff(monitorPollInterval)
+	for {
+		list, err := events.List(ctx, metav1.ListOptions{FieldSelector: podEventSelector})
+		if err != nil && ctx.Err() == nil {
+			f.deployment.logger.Error("Error listing pod events", "error", err)
+		}
+		if err == nil {
+			for i := range list.Items {
+				if listed {
+					f.forward(&list.Items[i])
+				} else {
+					f.seen[list.Items[i].UID] = list.Items[i].ResourceVersion
+				}
+			}
+			listed = true
+			f.watch(ctx, list.ResourceVersion)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff.next()):
+		}
+	}
+}
+
+// watch forwards pod events from resourceVersion on until the watch ends or ctx is cancelled.
+func (f *podEventForwarder) watch(ctx context.Context, resourceVersion string) {
+	w, err := kubeFor(ctx).CoreV1().Events(f.namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector:   podEventSelector,
+		ResourceVersion: resourceVersion,
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			f.deployment.logger.Error("Error watching pod events", "error", err)
+		}
+		return
+	}
+	defer w.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-w.ResultChan():
+			if !ok || event.Type == watch.Error {
+				return
+			}
+			if e, ok := event.Object.(*corev1.Event); ok && event.Type != watch.Deleted {
+				f.forward(e)
+			}
+		}
+	}
+}
+
+// forward sends the event to the client if it is about one of the deployment's pods and has
+// not been sent at its current resource version.
+func (f *podEventForwarder) forward(e *corev1.Event) {
+	if f.seen[e.UID] == e.ResourceVersion {
+		return
+	}
+	f.seen[e.UID] = e.ResourceVersion
+	pod := e.InvolvedObject.Name
+	if !slices.Contains(f.testPods, pod) && !strings.HasPrefix(pod, prodDeploymentName+"-") {
+		return
+	}
+	message := e.Message
+	if e.Count > 1 {
+		message = fmt.Sprintf("%s (x%d)", message, e.Count)
+	}
+	f.deployment.emit(Event{
+		Event:   "k8s_event",
+		Message: message,
+		Reason:  e.Reason,
+		Object:  "Pod/" + pod,
+	})
+}
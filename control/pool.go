@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// deploymentPool runs submitted deployments, initialized in main.
+var deploymentPool *workerPool
+
+// workerPool runs jobs on a fixed number of workers, queueing jobs FIFO while all are busy.
+type workerPool struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue []func()
+	idle  int
+}
+
+// newWorkerPool starts size workers.
+func newWorkerPool(size int) *workerPool {
+	p := &workerPool{}
+	p.cond = sync.NewCond(&p.mu)
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// work runs queued jobs forever.
+func (p *workerPool) work() {
+	for {
+		p.mu.Lock()
+		p.idle++
+		for len(p.queue) == 0 {
+			p.cond.Wait()
+		}
+		p.idle--
+		job := p.queue[0]
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+
+		job()
+	}
+}
+
+// submit queues a job and returns its 1-based queue position, or 0 if a worker is
+// free to start it immediately.
+func (p *workerPool) submit(job func()) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queue = append(p.queue, job)
+	p.cond.Signal()
+	if len(p.queue) <= p.idle {
+		return 0
+	}
+	return len(p.queue) - p.idle
+}
+
+// errTooManyDeployments is returned by startDeployment when the user is at their limit of
+// concurrent deployments.
+var errTooManyDeployments = errors.New("wait for one to finish before starting another")
+
+// startDeployment registers a deployment and submits it to the worker pool, telling the
+// client its queue position if no worker is free. sink, if not nil, is subscribed to the
+// deployment's events. The request, made from sourceIP, and the deployment's outcome are
+// recorded in the audit log. The caller must have called trackDeployment.
+func startDeployment(parent context.Context, sink eventSink, payload DeploymentPayload, sourceIP string) (*Deployment, error) {
+	if !acquireDeploymentSlot(payload.UserID) {
+		deploymentsWG.Done()
+		auditDeployRequest(payload, sourceIP, auditRejected, "too many deployments in progress")
+		return nil, fmt.Errorf("you already have %d deployments in progress; %w", maxDeploymentsPerUser, errTooManyDeployments)
+	}
+
+	deployment, ctx := registerDeployment(parent, sink, payload)
+	deployment.send("deployment_started", "Deployment "+deployment.ID+" started")
+	recordAudit(auditEntry{
+		UserID:       payload.UserID,
+		Action:       "deploy",
+		DeploymentID: deployment.ID,
+		RepoURL:      payload.RepoURL,
+		CommitHash:   payload.CommitHash,
+		Outcome:      auditAccepted,
+		SourceIP:     sourceIP,
+	})
+
+	// Whichever comes first, a worker picking the job up or the deployment being cancelled,
+	// claims it. A deployment cancelled while still queued is reported immediately.
+	var claimed atomic.Bool
+	finish := func() {
+		finishDeployment(deployment)
+		deployment.sendCallback()
+		deployment.audit(sourceIP)
+		releaseDeploymentSlot(payload.UserID)
+		deploymentsWG.Done()
+	}
+	stopWatching := context.AfterFunc(ctx, func() {
+		if claimed.CompareAndSwap(false, true) {
+			deployment.setStatus(StatusCancelled)
+			deployment.send("deployment_cancelled", fmt.Sprintf("Deployment %s was cancelled before it started", deployment.ID))
+			finish()
+		}
+	})
+	position := deploymentPool.submit(func() {
+		if !claimed.CompareAndSwap(false, true) {
+			return
+		}
+		stopWatching()
+		defer finish()
+		handleDeployment(ctx, deployment, payload)
+	})
+	if position > 0 {
+		deployment.send("queued", fmt.Sprintf("All workers are busy; your deployment is number %d in the queue", position))
+	}
+	return deployment, nil
+}
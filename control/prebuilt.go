@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Paths of the templates of prebuilt image deployments, set from Config. prebuiltPodTemplate
+// runs the image as the production Deployment, with the substitutions of prodPodTemplate
+// plus Image; smokeTestPodTemplate runs the deployment's test command in the image first.
+var (
+	prebuiltPodTemplate  string
+	smokeTestPodTemplate string
+)
+
+// imageReferencePattern matches a container image reference: an optional registry host and
+// port, a lowercase repository path, and an optional tag and sha256 digest, such as
+// ghcr.io/org/app:v1.2 or registry.example.com:5000/app@sha256:<64 hex digits>.
+var imageReferencePattern = regexp.MustCompile(`^` +
+	`(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?/)?` +
+	`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` +
+	`(?::[A-Za-z0-9_][A-Za-z0-9_.-]{0,127})?` +
+	`(?:@sha256:[a-f0-9]{64})?$`)
+
+// maxImageReferenceLength bounds image references, as registries bound repository names.
+const maxImageReferenceLength = 512
+
+// validateImage checks that image is a well-formed image reference.
+func validateImage(image string) error {
+	if len(image) > maxImageReferenceLength || !imageReferencePattern.MatchString(image) {
+		return fmt.Errorf("image %q is not a valid image reference", image)
+	}
+	return nil
+}
+
+// validatePrebuiltPayload checks a payload deploying a prebuilt image, which has no
+// repository to clone.
+func validatePrebuiltPayload(payload DeploymentPayload) error {
+	if err := validateImage(payload.Image); err != nil {
+		return err
+	}
+	if payload.RepoURL != "" || payload.CommitHash != "" || payload.Ref != "" || payload.CredentialID != "" {
+		return errors.New("image deployments take no repoURL, commitHash, ref or credentialID")
+	}
+	return nil
+}
+
+// imageRepository returns the image reference without its tag and digest, which identifies
+// the app a prebuilt image deployment belongs to, as the repository URL does for others.
+func imageRepository(image string) string {
+	name, _, _ := strings.Cut(image, "@")
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	return name
+}
+
+// imageRevision returns the hexadecimal revision a prebuilt image deployment is recorded
+// under in place of a commit hash: the image digest if the reference pins one, and a hash
+// of the reference otherwise.
+func imageRevision(image string) string {
+	if _, digest, ok := strings.Cut(image, "@sha256:"); ok {
+		return digest[:40]
+	}
+	sum := sha256.Sum256([]byte(image))
+	return hex.EncodeToString(sum[:20])
+}
+
+// testManifest returns the test template of the deployment and its substitutions, and
+// whether it runs tests at all. Prebuilt image deployments have no source to test and run
+// only a smoke test of the image, if they supply a test command.
+func testManifest(namespace, testPodName string, payload DeploymentPayload) (template string, substitutions map[string]string, ok bool) {
+	if payload.Image == "" {
+		return testPodTemplate, testPodSubstitutions(namespace, testPodName, payload), true
+	}
+	if payload.TestCommand == "" {
+		return "", nil, false
+	}
+	return smokeTestPodTemplate, map[string]string{
+		"Namespace":          namespace,
+		"TestPodName":        testPodName,
+		"Image":              payload.Image,
+		"PassMarker":         testPassMarker,
+		"FailMarker":         testFailMarker,
+		"TestCommand":        base64.StdEncoding.EncodeToString([]byte(payload.TestCommand)),
+		"TestTimeoutSeconds": strconv.Itoa(payload.TestTimeoutSeconds),
+	}, true
+}
+
+// prodManifest returns the production template of the deployment deploying the given color
+// and its substitutions.
+func prodManifest(namespace string, resources prodResources, hc healthCheck, color string, payload DeploymentPayload) (template string, substitutions map[string]string) {
+	substitutions = prodSubstitutions(namespace, resources, hc, color)
+	if payload.Image == "" {
+		return prodPodTemplate, substitutions
+	}
+	substitutions["Image"] = payload.Image
+	return prebuiltPodTemplate, substitutions
+}
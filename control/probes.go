@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// defaultProbePort is the port production pods are probed on when the payload names none:
+// the port the production container serves on.
+const defaultProbePort = 8080
+
+// probePathPattern matches the HTTP paths production pods may be probed on, limited to
+// characters that are safe to render into the pod template.
+var probePathPattern = regexp.MustCompile(`^/[A-Za-z0-9._~/-]*$`)
+
+// healthCheck is the validated health check of the production pods, from which their
+// readiness and liveness probes are built. An empty Path means a TCP check on Port.
+type healthCheck struct {
+	Path string
+	Port int
+}
+
+// resolveHealthCheck validates the payload's health check fields, probing the container
+// port over TCP if no path is given.
+func resolveHealthCheck(payload DeploymentPayload) (healthCheck, error) {
+	hc := healthCheck{Path: payload.HealthCheckPath, Port: payload.HealthCheckPort}
+	if hc.Port == 0 {
+		hc.Port = defaultProbePort
+	}
+	if hc.Port < 1 || hc.Port > 65535 {
+		return hc, errors.New("healthCheckPort must be between 1 and 65535")
+	}
+	if hc.Path != "" && !probePathPattern.MatchString(hc.Path) {
+		return hc, fmt.Errorf("healthCheckPath %q must start with / and contain only letters, digits, and ._~/-", hc.Path)
+	}
+	return hc, nil
+}
+
+// substitutions returns the prodPodTemplate substitutions for the pods' probes.
+func (hc healthCheck) substitutions() map[string]string {
+	return map[string]string{
+		"ProbePath": hc.Path,
+		"ProbePort": strconv.Itoa(hc.Port),
+	}
+}
+
+// httpPath is the path the control server requests to check that the app serves traffic:
+// the probe path, or healthCheckPath for apps probed over TCP.
+func (hc healthCheck) httpPath() string {
+	if hc.Path != "" {
+		return hc.Path
+	}
+	return healthCheckPath
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// quotaTier caps what a user's namespace may consume.
+type quotaTier struct {
+	Name string
+	// CPU, Memory, and Storage cap the namespace's total limits and storage requests.
+	CPU     string
+	Memory  string
+	Storage string
+	Pods    int
+	PVCs    int
+	// DefaultCPU and DefaultMemory are the limits given to containers that set none, and
+	// DefaultRequestCPU and DefaultRequestMemory their requests.
+	DefaultCPU           string
+	DefaultMemory        string
+	DefaultRequestCPU    string
+	DefaultRequestMemory string
+}
+
+// quotaTiers are the available tiers by name.
+var quotaTiers = map[string]quotaTier{
+	"free": {
+		Name: "free", CPU: "2", Memory: "2Gi", Storage: "5Gi", Pods: 5, PVCs: 2,
+		DefaultCPU: "500m", DefaultMemory: "512Mi", DefaultRequestCPU: "100m", DefaultRequestMemory: "128Mi",
+	},
+	"standard": {
+		Name: "standard", CPU: "4", Memory: "4Gi", Storage: "10Gi", Pods: 10, PVCs: 4,
+		DefaultCPU: "500m", DefaultMemory: "512Mi", DefaultRequestCPU: "100m", DefaultRequestMemory: "128Mi",
+	},
+	"pro": {
+		Name: "pro", CPU: "8", Memory: "8Gi", Storage: "20Gi", Pods: 20, PVCs: 8,
+		DefaultCPU: "1", DefaultMemory: "1Gi", DefaultRequestCPU: "250m", DefaultRequestMemory: "256Mi",
+	},
+}
+
+// defaultTier is the tier of users not listed in USER_TIERS.
+var defaultTier = envString("DEFAULT_TIER", "free")
+
+// userTiers maps user IDs to tier names, from the comma-separated USER_TIERS list of
+// userID=tier pairs.
+var userTiers = parseUserTiers(os.Getenv("USER_TIERS"))
+
+// parseUserTiers parses a comma-separated list of userID=tier pairs, skipping malformed entries.
+func parseUserTiers(value string) map[string]string {
+	tiers := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		userID, tier, ok := strings.Cut(entry, "=")
+		if !ok || userID == "" || tier == "" {
+			log.Printf("Ignoring malformed USER_TIERS entry %q", entry)
+			continue
+		}
+		tiers[strings.TrimSpace(userID)] = strings.TrimSpace(tier)
+	}
+	return tiers
+}
+
+// tierFor returns the quota tier of the user.
+func tierFor(userID string) (quotaTier, error) {
+	name := defaultTier
+	if tier, ok := userTiers[userID]; ok {
+		name = tier
+	}
+	tier, ok := quotaTiers[name]
+	if !ok {
+		return quotaTier{}, fmt.Errorf("unknown quota tier %q", name)
+	}
+	return tier, nil
+}
+
+// Names of the quota objects created in each deployment namespace.
+const (
+	tenantQuotaName      = "tenant-quota"
+	tenantLimitRangeName = "tenant-limits"
+)
+
+// applyNamespaceQuota creates or updates the namespace's ResourceQuota and LimitRange from the tier.
+// The LimitRange gives containers without explicit resources default limits, which the
+// quota requires every pod to have.
+func applyNamespaceQuota(ctx context.Context, namespace string, tier quotaTier) error {
+	quota, limits, err := tierObjects(namespace, tier)
+	if err != nil {
+		return err
+	}
+
+	quotas := kubeFor(ctx).CoreV1().ResourceQuotas(namespace)
+	if _, err := quotas.Create(ctx, quota, metav1.CreateOptions{}); apierrors.IsAlreadyExists(err) {
+		if _, err := quotas.Update(ctx, quota, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("updating resource quota: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("creating resource quota: %w", err)
+	}
+
+	limitRanges := kubeFor(ctx).CoreV1().LimitRanges(namespace)
+	if _, err := limitRanges.Create(ctx, limits, metav1.CreateOptions{}); apierrors.IsAlreadyExists(err) {
+		if _, err := limitRanges.Update(ctx, limits, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("updating limit range: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("creating limit range: %w", err)
+	}
+	return nil
+}
+
+// tierObjects builds the ResourceQuota and LimitRange for a tier.
+func tierObjects(namespace string, tier quotaTier) (*corev1.ResourceQuota, *corev1.LimitRange, error) {
+	parse := func(field, value string) (resource.Quantity, error) {
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			return q, fmt.Errorf("tier %s has invalid %s %q: %w", tier.Name, field, value, err)
+		}
+		return q, nil
+	}
+	quantities := map[string]resource.Quantity{}
+	for field, value := range map[string]string{
+		"cpu": tier.CPU, "memory": tier.Memory, "storage": tier.Storage,
+		"defaultCPU": tier.DefaultCPU, "defaultMemory": tier.DefaultMemory,
+		"defaultRequestCPU": tier.DefaultRequestCPU, "defaultRequestMemory": tier.DefaultRequestMemory,
+	} {
+		q, err := parse(field, value)
+		if err != nil {
+			return nil, nil, err
+		}
+		quantities[field] = q
+	}
+
+	quota := &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: tenantQuotaName, Namespace: namespace, Labels: map[string]string{managedByLabel: managedByValue}},
+		Spec: corev1.ResourceQuotaSpec{
+			Hard: corev1.ResourceList{
+				corev1.ResourceLimitsCPU:              quantities["cpu"],
+				corev1.ResourceLimitsMemory:           quantities["memory"],
+				corev1.ResourceRequestsCPU:            quantities["cpu"],
+				corev1.ResourceRequestsMemory:         quantities["memory"],
+				corev1.ResourceRequestsStorage:        quantities["storage"],
+				corev1.ResourcePods:                   *resource.NewQuantity(int64(tier.Pods), resource.DecimalSI),
+				corev1.ResourcePersistentVolumeClaims: *resource.NewQuantity(int64(tier.PVCs), resource.DecimalSI),
+			},
+		},
+	}
+	limits := &corev1.LimitRange{
+		ObjectMeta: metav1.ObjectMeta{Name: tenantLimitRangeName, Namespace: namespace, Labels: map[string]string{managedByLabel: managedByValue}},
+		Spec: corev1.LimitRangeSpec{
+			Limits: []corev1.LimitRangeItem{{
+				Type: corev1.LimitTypeContainer,
+				Default: corev1.ResourceList{
+					corev1.ResourceCPU:    quantities["defaultCPU"],
+					corev1.ResourceMemory: quantities["defaultMemory"],
+				},
+				DefaultRequest: corev1.ResourceList{
+					corev1.ResourceCPU:    quantities["defaultRequestCPU"],
+					corev1.ResourceMemory: quantities["defaultRequestMemory"],
+				},
+			}},
+		},
+	}
+	return quota, limits, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+// quotaExceededError reports an object the namespace's ResourceQuota refused to admit.
+type quotaExceededError struct {
+	// Resources names the quota resources at fault, such as "limits.cpu" or "pods".
+	Resources []string
+	// Message is the message Kubernetes rejected the object with.
+	Message string
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("the namespace quota does not allow %s: %s", strings.Join(e.Resources, ", "), e.Message)
+}
+
+// Patterns of the admission errors of the ResourceQuota controller: an object that would
+// exceed the quota ("exceeded quota: tenant-quota, requested: pods=1, used: pods=5,
+// limited: pods=5") and a pod that sets no value for a quota resource ("failed quota:
+// tenant-quota: must specify limits.cpu,limits.memory").
+var (
+	quotaExceededPattern = regexp.MustCompile(`exceeded quota: [^,]+, requested: (\S+), used: (\S+), limited: (\S+)`)
+	quotaUnspecified     = regexp.MustCompile(`failed quota: [^:]+: must specify (\S+)`)
+)
+
+// parseQuotaError returns the quota error described by a Kubernetes error message or
+// kubectl output, or nil if it describes none.
+func parseQuotaError(message string) *quotaExceededError {
+	if m := quotaExceededPattern.FindStringSubmatch(message); m != nil {
+		requested, used, limited := quotaValues(m[1]), quotaValues(m[2]), quotaValues(m[3])
+		var resources []string
+		for _, name := range slices.Sorted(maps.Keys(requested)) {
+			resources = append(resources, fmt.Sprintf("%s (requested %s, used %s, limit %s)", name, requested[name], used[name], limited[name]))
+		}
+		return &quotaExceededError{Resources: resources, Message: strings.TrimSpace(m[0])}
+	}
+	if m := quotaUnspecified.FindStringSubmatch(message); m != nil {
+		var resources []string
+		for _, name := range strings.Split(strings.TrimRight(m[1], ".,"), ",") {
+			resources = append(resources, name+" (not specified)")
+		}
+		return &quotaExceededError{Resources: resources, Message: strings.TrimSpace(m[0])}
+	}
+	return nil
+}
+
+// quotaValues parses a comma-separated list of resource=quantity pairs.
+func quotaValues(list string) map[string]string {
+	values := map[string]string{}
+	for _, pair := range strings.Split(strings.TrimRight(list, ".,"), ",") {
+		if name, value, ok := strings.Cut(pair, "="); ok {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+// replicaSetFailuresSelector restricts event lists to ReplicaSets failing to create pods.
+var replicaSetFailuresSelector = fields.AndSelectors(
+	fields.OneTermEqualSelector("involvedObject.kind", "ReplicaSet"),
+	fields.OneTermEqualSelector("reason", "FailedCreate"),
+).String()
+
+// watchQuotaFailures polls the namespace's events until ctx is done for a ReplicaSet of the
+// named Deployment failing to create pods because of the quota since the given time,
+// calling fail with the quota error when it finds one. A Deployment's pods are created by
+// its ReplicaSet, so the quota rejecting them does not fail the apply itself.
+func watchQuotaFailures(ctx context.Context, namespace, deployment string, since time.Time, fail func(*quotaExceededError)) {
+	ticker := time.NewTicker(monitorPollInterval)
+	defer ticker.Stop()
+	for {
+		list, err := kubeFor(ctx).CoreV1().Events(namespace).List(ctx, metav1.ListOptions{FieldSelector: replicaSetFailuresSelector})
+		if err == nil {
+			for i := range list.Items {
+				e := &list.Items[i]
+				if !strings.HasPrefix(e.InvolvedObject.Name, deployment+"-") || eventTime(e).Before(since) {
+					continue
+				}
+				if qerr := parseQuotaError(e.Message); qerr != nil {
+					fail(qerr)
+					return
+				}
+			}
+		} else if ctx.Err() == nil {
+			loggerFrom(ctx).Error("Error listing ReplicaSet events", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// eventTime returns when an event last occurred.
+func eventTime(e *corev1.Event) time.Time {
+	switch {
+	case !e.LastTimestamp.IsZero():
+		return e.LastTimestamp.Time
+	case !e.EventTime.IsZero():
+		return e.EventTime.Time
+	}
+	return e.CreationTimestamp.Time
+}
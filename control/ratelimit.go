@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// trustForwardedFor makes clientIP use the X-Forwarded-For header, for servers behind a
+// proxy or load balancer that sets it. Otherwise clients could spoof their address with it.
+var trustForwardedFor = envBool("TRUST_FORWARDED_FOR", false)
+
+// userDeployLimiter and ipDeployLimiter throttle deployment requests by user ID and by IP,
+// at the rates set from Config.
+var (
+	userDeployLimiter *rateLimiter
+	ipDeployLimiter   *rateLimiter
+)
+
+// rateLimiter keeps a token bucket per key.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu         sync.Mutex
+	buckets    map[string]*rate.Limiter
+	lastPruned time.Time
+}
+
+// newRateLimiter returns a limiter allowing perMinute events a minute per key after an
+// initial burst, or no limit if perMinute is not positive.
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	l := &rateLimiter{limit: rate.Inf, burst: max(burst, 1), buckets: map[string]*rate.Limiter{}}
+	if perMinute > 0 {
+		l.limit = rate.Limit(float64(perMinute) / 60)
+	}
+	return l
+}
+
+// reserve takes a token from key's bucket if one is available at now, returning the
+// reservation so it can be handed back with CancelAt. If none is available, nothing is
+// taken and the wait until one will be is returned.
+func (l *rateLimiter) reserve(key string, now time.Time) (*rate.Reservation, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pruneLocked(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = rate.NewLimiter(l.limit, l.burst)
+		l.buckets[key] = b
+	}
+	r := b.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return nil, delay
+	}
+	return r, 0
+}
+
+// pruneLocked drops, at most once a minute, the buckets that have refilled completely,
+// which behave the same as new ones.
+func (l *rateLimiter) pruneLocked(now time.Time) {
+	if now.Sub(l.lastPruned) < time.Minute {
+		return
+	}
+	l.lastPruned = now
+	for key, b := range l.buckets {
+		if b.TokensAt(now) >= float64(l.burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// allowDeployment reports whether the user may start a deployment from ip now, taking a
+// token from both the user's and the IP's bucket if so. Otherwise neither is charged and
+// the wait until the request would be allowed is returned.
+func allowDeployment(userID, ip string) (retryAfter time.Duration, ok bool) {
+	now := time.Now()
+	userRes, wait := userDeployLimiter.reserve(userID, now)
+	if userRes == nil {
+		return wait, false
+	}
+	if ipRes, wait := ipDeployLimiter.reserve(ip, now); ipRes == nil {
+		userRes.CancelAt(now)
+		return wait, false
+	}
+	return 0, true
+}
+
+// retryAfterSeconds rounds a rate limit wait up to whole seconds, as sent to clients.
+func retryAfterSeconds(wait time.Duration) int {
+	return int((wait + time.Second - 1) / time.Second)
+}
+
+// clientIP returns the address of the client that sent r, taken from X-Forwarded-For if
+// trustForwardedFor is set.
+func clientIP(r *http.Request) string {
+	if trustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// useDeployLimits replaces the deployment rate limiters for the test.
+func useDeployLimits(t *testing.T, userPerMinute, userBurst, ipPerMinute, ipBurst int) {
+	t.Helper()
+	previousUser, previousIP := userDeployLimiter, ipDeployLimiter
+	userDeployLimiter = newRateLimiter(userPerMinute, userBurst)
+	ipDeployLimiter = newRateLimiter(ipPerMinute, ipBurst)
+	t.Cleanup(func() { userDeployLimiter, ipDeployLimiter = previousUser, previousIP })
+}
+
+func TestRateLimiterExceeded(t *testing.T) {
+	l := newRateLimiter(1, 2)
+	now := time.Now()
+	for i := range 2 {
+		if r, wait := l.reserve("alice", now); r == nil {
+			t.Fatalf("request %d within the burst was limited for %s", i+1, wait)
+		}
+	}
+	r, wait := l.reserve("alice", now)
+	if r != nil {
+		t.Fatal("request over the burst was allowed")
+	}
+	if wait <= 59*time.Second || wait > time.Minute {
+		t.Errorf("wait = %s, want about a minute", wait)
+	}
+	if r, _ := l.reserve("bob", now); r == nil {
+		t.Error("another key shared alice's bucket")
+	}
+	if r, _ := l.reserve("alice", now.Add(wait)); r == nil {
+		t.Error("request was still limited once the wait had passed")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	l := newRateLimiter(0, 1)
+	now := time.Now()
+	for range 100 {
+		if r, wait := l.reserve("alice", now); r == nil {
+			t.Fatalf("disabled limiter limited a request for %s", wait)
+		}
+	}
+}
+
+func TestAllowDeploymentChargesNeitherBucketWhenLimited(t *testing.T) {
+	useDeployLimits(t, 1, 1, 1, 1)
+	if _, ok := allowDeployment("alice", "192.0.2.1"); !ok {
+		t.Fatal("first deployment was limited")
+	}
+	// alice's bucket is empty, so the new IP's bucket must not be charged...
+	if _, ok := allowDeployment("alice", "192.0.2.2"); ok {
+		t.Fatal("alice exceeded her limit")
+	}
+	if _, ok := allowDeployment("bob", "192.0.2.2"); !ok {
+		t.Error("a request alice was refused charged the IP's bucket")
+	}
+	// ...and the IP's empty bucket must not charge a new user's.
+	if _, ok := allowDeployment("carol", "192.0.2.1"); ok {
+		t.Fatal("the IP exceeded its limit")
+	}
+	if _, ok := allowDeployment("carol", "192.0.2.3"); !ok {
+		t.Error("a request the IP was refused charged the user's bucket")
+	}
+}
+
+func TestWebSocketSendsRateLimited(t *testing.T) {
+	useTestEnvironment(t)
+	useDeployLimits(t, 1, 1, 0, 1)
+	// The deployment allowed through finishes before the test environment is torn down.
+	t.Cleanup(deploymentsWG.Wait)
+	srv := newWebSocketTestServer(t)
+	conn := dialTestServer(t, srv, time.Hour)
+
+	// The payloads are invalid, so the one allowed through fails without deploying.
+	for range 2 {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		e := readEvent(t, conn)
+		if e.Event != "rate_limited" {
+			continue
+		}
+		if e.Code != codeRateLimited || e.RetryAfter <= 0 || e.RetryAfter > 60 {
+			t.Errorf("rate_limited event %+v lacks a retry-after hint", e)
+		}
+		return
+	}
+}
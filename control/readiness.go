@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// requiredAsset is a file deployments read from disk.
+type requiredAsset struct {
+	Path       string
+	Executable bool
+}
+
+// requiredAssets returns the templates deployments read from disk.
+func requiredAssets() []requiredAsset {
+	return []requiredAsset{
+		{Path: testPodTemplate},
+		{Path: prodPodTemplate},
+		{Path: prodServiceTemplate},
+		{Path: ingressTemplate},
+		{Path: canaryIngressTemplate},
+		{Path: customDomainIngressTemplate},
+		{Path: networkPolicyTemplate},
+		{Path: hpaTemplate},
+		{Path: prebuiltPodTemplate},
+		{Path: smokeTestPodTemplate},
+	}
+}
+
+// readinessTimeout bounds the Kubernetes API check made by /readyz.
+const readinessTimeout = 5 * time.Second
+
+// assetProblems describes every required asset that is missing, not a regular file, or
+// not executable when it must be. Template settings naming several files, as described by
+// expandTemplates, are checked file by file.
+func assetProblems() []string {
+	var problems []string
+	for _, asset := range requiredAssets() {
+		paths, err := expandTemplates(asset.Path)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			switch {
+			case err != nil:
+				problems = append(problems, "missing "+path)
+			case !info.Mode().IsRegular():
+				problems = append(problems, path+" is not a regular file")
+			case asset.Executable && info.Mode().Perm()&0o111 == 0:
+				problems = append(problems, path+" is not executable")
+			}
+		}
+	}
+	return problems
+}
+
+// healthzHandler serves /healthz, reporting that the process is up.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler serves /readyz, reporting whether deployments can run: kubectl must be
+// installed, the Kubernetes API of every cluster reachable, and the templates present.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	var problems []string
+	if _, err := exec.LookPath("kubectl"); err != nil {
+		problems = append(problems, "kubectl not found: "+err.Error())
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	for _, name := range clusterNames() {
+		if _, err := clusters[name].serverVersion(ctx); err != nil {
+			problems = append(problems, fmt.Sprintf("Kubernetes API of cluster %s unreachable: %v", name, err))
+		}
+	}
+	problems = append(problems, assetProblems()...)
+
+	if len(problems) > 0 {
+		http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
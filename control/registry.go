@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// deploymentRegistry is the registry of in-flight deployments, keyed by deployment ID, and
+// of the namespaces they have claimed, keyed by namespaceKey. It also guards the records of
+// the deployments it holds: they are read and written only through it, from the deployment
+// goroutines, the WebSocket and REST handlers and the garbage collector alike.
+type deploymentRegistry struct {
+	mu         sync.RWMutex
+	byID       map[string]*Deployment
+	namespaces map[string]string
+}
+
+func newDeploymentRegistry() *deploymentRegistry {
+	return &deploymentRegistry{byID: map[string]*Deployment{}, namespaces: map[string]string{}}
+}
+
+// deployments is the process-wide registry of in-flight deployments.
+var deployments = newDeploymentRegistry()
+
+// Add registers a deployment.
+func (r *deploymentRegistry) Add(d *Deployment) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byID[d.ID] = d
+}
+
+// Get returns the in-flight deployment with the given ID.
+func (r *deploymentRegistry) Get(id string) (*Deployment, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	d, ok := r.byID[id]
+	return d, ok
+}
+
+// List returns the in-flight deployments, in no particular order.
+func (r *deploymentRegistry) List() []*Deployment {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]*Deployment, 0, len(r.byID))
+	for _, d := range r.byID {
+		list = append(list, d)
+	}
+	return list
+}
+
+// Delete removes a deployment and releases the namespace it claimed.
+func (r *deploymentRegistry) Delete(d *Deployment) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.byID, d.ID)
+	if key := namespaceKey(d.Cluster, d.Namespace); r.namespaces[key] == d.ID {
+		delete(r.namespaces, key)
+	}
+}
+
+// Update applies fn to the deployment's record, stamps it as updated and returns a snapshot
+// of the result.
+func (r *deploymentRegistry) Update(d *Deployment, fn func(rec *DeploymentRecord)) DeploymentRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&d.DeploymentRecord)
+	d.UpdatedAt = time.Now().UTC()
+	return d.DeploymentRecord
+}
+
+// Record returns a snapshot of the deployment's record.
+func (r *deploymentRegistry) Record(d *Deployment) DeploymentRecord {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return d.DeploymentRecord
+}
+
+// ClaimNamespace claims the namespace key for the deployment with the given ID. If another
+// deployment holds it, that deployment's ID is returned with ok=false.
+func (r *deploymentRegistry) ClaimNamespace(key, id string) (existingID string, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, taken := r.namespaces[key]; taken {
+		return existing, false
+	}
+	r.namespaces[key] = id
+	return "", true
+}
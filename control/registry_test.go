@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestDeploymentRegistryConcurrentAccess hammers a registry from many goroutines, as the
+// deployment goroutines and the handlers do; run it with -race.
+func TestDeploymentRegistryConcurrentAccess(t *testing.T) {
+	const workers, rounds = 32, 50
+	r := newDeploymentRegistry()
+	var claimed atomic.Int32
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range rounds {
+				d := &Deployment{DeploymentRecord: DeploymentRecord{
+					ID: fmt.Sprintf("%d-%d", w, i), Cluster: "test", Namespace: fmt.Sprintf("ns-%d", i), Status: StatusPending,
+				}}
+				r.Add(d)
+				if _, ok := r.ClaimNamespace(namespaceKey(d.Cluster, d.Namespace), d.ID); ok {
+					claimed.Add(1)
+				}
+				if got, ok := r.Get(d.ID); !ok || got != d {
+					t.Errorf("Get(%s) did not return the deployment just added", d.ID)
+				}
+				r.Update(d, func(rec *DeploymentRecord) { rec.Status = StatusTesting })
+				for _, other := range r.List() {
+					r.Record(other)
+				}
+				if rec := r.Record(d); rec.Status != StatusTesting || rec.UpdatedAt.IsZero() {
+					t.Errorf("record of %s = %+v after Update", d.ID, rec)
+				}
+				r.Delete(d)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(r.List()); n != 0 {
+		t.Errorf("%d deployments left after all were deleted", n)
+	}
+	// Claims are released on Delete, so every round's namespace was claimed at least once.
+	if n := claimed.Load(); n < rounds {
+		t.Errorf("namespaces claimed %d times, want at least %d", n, rounds)
+	}
+	if len(r.namespaces) != 0 {
+		t.Errorf("claims left after every deployment was deleted: %v", r.namespaces)
+	}
+}
+
+func TestDeploymentRegistryClaimNamespaceIsExclusive(t *testing.T) {
+	r := newDeploymentRegistry()
+	key := namespaceKey("test", "alice-app")
+	var winners sync.Map
+	var wg sync.WaitGroup
+	for i := range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := fmt.Sprint(i)
+			if _, ok := r.ClaimNamespace(key, id); ok {
+				winners.Store(id, true)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var ids []string
+	winners.Range(func(id, _ any) bool {
+		ids = append(ids, id.(string))
+		return true
+	})
+	if len(ids) != 1 {
+		t.Fatalf("namespace claimed by %v, want exactly one deployment", ids)
+	}
+	if holder, ok := r.ClaimNamespace(key, "late"); ok || holder != ids[0] {
+		t.Errorf("ClaimNamespace = %q, %t; want the holder %s", holder, ok, ids[0])
+	}
+}
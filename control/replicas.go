@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// replicasReadyTimeout bounds how long a new production version may take to have every
+// replica Ready once its rollout completes, set from Config.
+var replicasReadyTimeout time.Duration
+
+// replicasPollInterval is how often waitForReplicasReady checks the Deployment.
+var replicasPollInterval = 2 * time.Second
+
+// waitForReplicasReady waits up to timeout until the Deployment runs exactly replicas pods,
+// all of them Ready and none left over from a previous pod template. Unless report is nil,
+// it is called with the ready and desired replica counts whenever the ready count changes.
+func waitForReplicasReady(ctx context.Context, namespace, name string, replicas int, timeout time.Duration, report func(ready, desired int32)) error {
+	desired := int32(replicas)
+	ready := int32(-1)
+	err := wait.PollUntilContextTimeout(ctx, replicasPollInterval, timeout, true, func(ctx context.Context) (bool, error) {
+		d, err := kubeFor(ctx).AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		// Ready pods of the previous template are not counted: they are on their way out.
+		current := min(d.Status.ReadyReplicas, d.Status.UpdatedReplicas)
+		if current != ready && report != nil {
+			report(current, desired)
+		}
+		ready = current
+		return d.Status.ObservedGeneration >= d.Generation && d.Status.Replicas == desired &&
+			d.Status.UpdatedReplicas == desired && ready == desired, nil
+	})
+	if err != nil {
+		return fmt.Errorf("%d of %d replicas ready: %w", max(ready, 0), replicas, err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func replicasTestDeployment(replicas, updated, ready int32) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "prod-blue", Namespace: "ns", Generation: 1},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		Status: appsv1.DeploymentStatus{
+			ObservedGeneration: 1,
+			Replicas:           replicas,
+			UpdatedReplicas:    updated,
+			ReadyReplicas:      ready,
+		},
+	}
+}
+
+func withReplicasTestClient(t *testing.T, d *appsv1.Deployment) (context.Context, *fake.Clientset) {
+	t.Helper()
+	old := replicasPollInterval
+	replicasPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { replicasPollInterval = old })
+	cs := fake.NewSimpleClientset(d)
+	return withCluster(context.Background(), &cluster{Name: "test", Client: cs}), cs
+}
+
+func TestWaitForReplicasReadyReportsProgress(t *testing.T) {
+	ctx, cs := withReplicasTestClient(t, replicasTestDeployment(3, 3, 1))
+	var mu sync.Mutex
+	var reports []string
+	report := func(ready, desired int32) {
+		mu.Lock()
+		defer mu.Unlock()
+		reports = append(reports, fmt.Sprintf("%d/%d", ready, desired))
+		if ready == 1 {
+			go cs.AppsV1().Deployments("ns").UpdateStatus(context.Background(), replicasTestDeployment(3, 3, 3), metav1.UpdateOptions{})
+		}
+	}
+	if err := waitForReplicasReady(ctx, "ns", "prod-blue", 3, 5*time.Second, report); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"1/3", "3/3"}; !slices.Equal(reports, want) {
+		t.Errorf("reports = %v, want %v", reports, want)
+	}
+}
+
+func TestWaitForReplicasReadyIgnoresOldPods(t *testing.T) {
+	// Three ready pods, but only one of them runs the new template.
+	ctx, _ := withReplicasTestClient(t, replicasTestDeployment(3, 1, 3))
+	var last int32
+	err := waitForReplicasReady(ctx, "ns", "prod-blue", 3, 100*time.Millisecond, func(ready, _ int32) { last = ready })
+	if err == nil {
+		t.Fatal("waitForReplicasReady succeeded with replicas of the previous template")
+	}
+	if last != 1 {
+		t.Errorf("reported %d ready replicas, want 1", last)
+	}
+}
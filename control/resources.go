@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Production sizing defaults and the maximums users may request.
+var (
+	defaultReplicas    = envInt("DEFAULT_REPLICAS", 1)
+	maxReplicas        = envInt("MAX_REPLICAS", 5)
+	defaultCPULimit    = envString("DEFAULT_CPU_LIMIT", "500m")
+	maxCPULimit        = envString("MAX_CPU_LIMIT", "2")
+	defaultMemoryLimit = envString("DEFAULT_MEMORY_LIMIT", "512Mi")
+	maxMemoryLimit     = envString("MAX_MEMORY_LIMIT", "2Gi")
+)
+
+// prodResources is the validated sizing of the production deployment.
+type prodResources struct {
+	Replicas    int
+	CPULimit    string
+	MemoryLimit string
+}
+
+// substitutions returns the template substitutions for the production sizing.
+func (r prodResources) substitutions() map[string]string {
+	return map[string]string{
+		"Replicas":    strconv.Itoa(r.Replicas),
+		"CPULimit":    r.CPULimit,
+		"MemoryLimit": r.MemoryLimit,
+	}
+}
+
+// resolveProdResources applies defaults to the payload's optional sizing fields and
+// validates them against the configured maximums.
+func resolveProdResources(payload DeploymentPayload) (prodResources, error) {
+	r := prodResources{Replicas: payload.Replicas}
+	if r.Replicas == 0 {
+		r.Replicas = defaultReplicas
+	}
+	if r.Replicas < 1 || r.Replicas > maxReplicas {
+		return r, fmt.Errorf("replicas must be between 1 and %d", maxReplicas)
+	}
+
+	var err error
+	if r.CPULimit, err = resolveQuantity("cpuLimit", payload.CPULimit, defaultCPULimit, maxCPULimit); err != nil {
+		return r, err
+	}
+	if r.MemoryLimit, err = resolveQuantity("memoryLimit", payload.MemoryLimit, defaultMemoryLimit, maxMemoryLimit); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// resolveQuantity parses a resource quantity, falling back to def, and checks it is
+// positive and no greater than max. The canonical form is returned, so only safe
+// characters reach the template.
+func resolveQuantity(field, value, def, max string) (string, error) {
+	if value == "" {
+		value = def
+	}
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return "", fmt.Errorf("%s %q is not a valid quantity", field, value)
+	}
+	limit := resource.MustParse(max)
+	if q.Sign() <= 0 || q.Cmp(limit) > 0 {
+		return "", fmt.Errorf("%s must be greater than 0 and at most %s", field, max)
+	}
+	return q.String(), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// restartDeployment restarts the pods of the live production version of one of the user's
+// successful deployments with kubectl rollout restart, so they pick up rotated secrets, and
+// waits for the rollout to complete, relaying its progress and reporting restarted. The
+// attempt, made from sourceIP, is recorded in the audit log.
+func restartDeployment(ctx context.Context, sconn *SafeConn, userID, sourceIP, id string) {
+	entry := auditEntry{UserID: userID, Action: "restart", DeploymentID: id, Outcome: auditFailed, SourceIP: sourceIP}
+	defer func() { recordAudit(entry) }()
+
+	ctx, rec, unlock, ok := lockLiveDeployment(ctx, sconn, "restart_error", userID, id)
+	if !ok {
+		return
+	}
+	defer unlock()
+	entry.Namespace, entry.Cluster = rec.Namespace, rec.Cluster
+
+	color, live, err := liveProdVersion(ctx, rec.Namespace)
+	if err == nil && !live {
+		err = fmt.Errorf("namespace %s has no live production version", rec.Namespace)
+	}
+	if err != nil {
+		sendWebSocketError(sconn, "restart_error", codeRestartFailed, fmt.Sprintf("Failed to restart deployment %s: %v", id, err))
+		return
+	}
+	name := prodDeploymentFor(color)
+	if output, err := runKubectl(ctx, 30*time.Second, "rollout", "restart", "deployment/"+name, "-n", rec.Namespace); err != nil {
+		sendWebSocketError(sconn, "restart_error", codeRestartFailed, fmt.Sprintf("Failed to restart deployment %s: %v\nOutput: %s", id, err, output))
+		return
+	}
+	slog.Default().Info("Restarting production deployment", "deploymentID", id, "namespace", rec.Namespace, "deployment", name)
+	sendWebSocketMessage(sconn, "restarting", fmt.Sprintf("Restarting the pods of deployment %s", id))
+
+	err = waitForProdRollout(ctx, rec.Namespace, color, func(line string) { sendWebSocketMessage(sconn, "rollout_progress", line) })
+	if err != nil {
+		event := Event{
+			Event:     "restart_error",
+			Code:      codeRolloutFailed,
+			Message:   fmt.Sprintf("Deployment %s did not restart: %v", id, err),
+			Timestamp: time.Now().UTC(),
+		}
+		var rollout *rolloutError
+		var quota *quotaExceededError
+		if errors.As(err, &rollout) {
+			event.Details = rollout.Details
+		} else if errors.As(err, &quota) {
+			event.Code = codeQuotaExceeded
+		}
+		writeWebSocketMessage(slog.Default(), sconn, event)
+		return
+	}
+	entry.Outcome = auditSucceeded
+	sendWebSocketMessage(sconn, "restarted", fmt.Sprintf("Deployment %s restarted", id))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Retry policy for kubectl invocations that fail because the API server is briefly unavailable.
+var (
+	kubectlRetryAttempts  = envInt("KUBECTL_RETRY_ATTEMPTS", 4)
+	kubectlRetryBaseDelay = envDuration("KUBECTL_RETRY_BASE_DELAY", 500*time.Millisecond)
+	kubectlRetryMaxDelay  = envDuration("KUBECTL_RETRY_MAX_DELAY", 10*time.Second)
+)
+
+// transientKubectlErrors are fragments of kubectl output that indicate a network problem or
+// an API server error worth retrying. Semantic errors such as AlreadyExists, NotFound, or
+// invalid manifests are deliberately absent.
+var transientKubectlErrors = []string{
+	"connection refused",
+	"connection reset by peer",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"no route to host",
+	"Unable to connect to the server",
+	"the server is currently unable to handle the request",
+	"the server was unable to return a response in the time allotted",
+	"etcdserver: request timed out",
+	"etcdserver: leader changed",
+	"(InternalError)",
+	"(ServiceUnavailable)",
+	"(Timeout)",
+	"(TooManyRequests)",
+	"http2: client connection lost",
+	"unexpected EOF",
+}
+
+// isTransientKubectlError reports whether a failed command's error and output indicate a
+// transient failure. A command killed by its own timeout counts as transient.
+func isTransientKubectlError(output string, err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	for _, fragment := range transientKubectlErrors {
+		if strings.Contains(output, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryTransient runs run until it succeeds, fails with a non-transient error, ctx is done,
+// or kubectlRetryAttempts attempts have been made, doubling the delay between attempts.
+// It returns the output and error of the last attempt.
+func retryTransient(ctx context.Context, run func(ctx context.Context) (string, error)) (string, error) {
+	delay := kubectlRetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		output, err := run(ctx)
+		if err == nil || attempt >= kubectlRetryAttempts || ctx.Err() != nil || !isTransientKubectlError(output, err) {
+			return output, err
+		}
+		loggerFrom(ctx).Warn("Transient kubectl failure, retrying", "attempt", attempt, "delay", delay, "error", err, "output", output)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return output, err
+		case <-timer.C:
+		}
+		delay = min(delay*2, kubectlRetryMaxDelay)
+	}
+}
+
+// runKubectl runs kubectl with the given arguments, retrying transient failures. Each attempt
+// gets its own timeout.
+func runKubectl(ctx context.Context, timeout time.Duration, args ...string) (string, error) {
+	return retryTransient(ctx, func(ctx context.Context) (string, error) {
+		return runCommand(ctx, timeout, "kubectl", args...)
+	})
+}
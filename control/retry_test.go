@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// useFastRetries shortens the delay between kubectl retries for the test.
+func useFastRetries(t *testing.T) {
+	t.Helper()
+	previous := kubectlRetryBaseDelay
+	kubectlRetryBaseDelay = time.Millisecond
+	t.Cleanup(func() { kubectlRetryBaseDelay = previous })
+}
+
+// failingRunner returns a fakeRunner whose first failures commands fail with output.
+func failingRunner(failures int, output string) *fakeRunner {
+	runner := &fakeRunner{}
+	runner.Handler = func(Command) (string, error) {
+		if len(runner.Commands()) <= failures {
+			return output, errors.New("exit status 1")
+		}
+		return "ok", nil
+	}
+	return runner
+}
+
+func TestRunKubectlRetriesTransientFailures(t *testing.T) {
+	useFastRetries(t)
+	runner := failingRunner(2, "Unable to connect to the server: dial tcp 10.0.0.1:6443: connect: connection refused")
+	useFakeRunner(t, runner)
+
+	output, err := runKubectl(context.Background(), time.Second, "get", "pods")
+	if err != nil || output != "ok" {
+		t.Fatalf("runKubectl = %q, %v; want the output of the third attempt", output, err)
+	}
+	if n := len(runner.Commands()); n != 3 {
+		t.Errorf("ran kubectl %d times, want 3", n)
+	}
+}
+
+func TestRunKubectlGivesUpAfterMaxAttempts(t *testing.T) {
+	useFastRetries(t)
+	runner := failingRunner(kubectlRetryAttempts+1, "Error from server (ServiceUnavailable): the server is currently unable to handle the request")
+	useFakeRunner(t, runner)
+
+	if _, err := runKubectl(context.Background(), time.Second, "get", "pods"); err == nil {
+		t.Fatal("runKubectl succeeded although every attempt failed")
+	}
+	if n := len(runner.Commands()); n != kubectlRetryAttempts {
+		t.Errorf("ran kubectl %d times, want %d", n, kubectlRetryAttempts)
+	}
+}
+
+func TestRunKubectlDoesNotRetrySemanticErrors(t *testing.T) {
+	useFastRetries(t)
+	runner := failingRunner(1, `Error from server (AlreadyExists): namespaces "alice" already exists`)
+	useFakeRunner(t, runner)
+
+	if _, err := runKubectl(context.Background(), time.Second, "create", "namespace", "alice"); err == nil {
+		t.Fatal("runKubectl succeeded although kubectl failed")
+	}
+	if n := len(runner.Commands()); n != 1 {
+		t.Errorf("ran kubectl %d times, want 1", n)
+	}
+}
+
+func TestRetryTransientStopsWhenCancelled(t *testing.T) {
+	previous := kubectlRetryBaseDelay
+	kubectlRetryBaseDelay = time.Hour
+	t.Cleanup(func() { kubectlRetryBaseDelay = previous })
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	_, err := retryTransient(ctx, func(context.Context) (string, error) {
+		attempts++
+		time.AfterFunc(10*time.Millisecond, cancel)
+		return "i/o timeout", errors.New("exit status 1")
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("retryTransient = %v after %d attempts; want the first attempt's error", err, attempts)
+	}
+}
+
+func TestIsTransientKubectlError(t *testing.T) {
+	tests := []struct {
+		output string
+		err    error
+		want   bool
+	}{
+		{"Unable to connect to the server: net/http: TLS handshake timeout", errors.New("exit status 1"), true},
+		{"Error from server (InternalError): etcdserver: leader changed", errors.New("exit status 1"), true},
+		{"", context.DeadlineExceeded, true},
+		{`Error from server (NotFound): pods "app" not found`, errors.New("exit status 1"), false},
+		{"error: error validating \"STDIN\": unknown field \"specs\"", errors.New("exit status 1"), false},
+	}
+	for _, tt := range tests {
+		if got := isTransientKubectlError(tt.output, tt.err); got != tt.want {
+			t.Errorf("isTransientKubectlError(%q, %v) = %t, want %t", tt.output, tt.err, got, tt.want)
+		}
+	}
+}
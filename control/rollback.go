@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// appIngressName is the ingress routing an app's stable hostname to its active release.
+const appIngressName = "app-ingress"
+
+// maxReleaseHistory bounds how many successful releases are kept per app for rollback.
+const maxReleaseHistory = 5
+
+// release is a successful deployment of an app.
+type release struct {
+	DeploymentID string
+	Cluster      *cluster
+	Namespace    string
+	CommitHash   string
+	// Host is the app's stable hostname routed to the release, and CustomDomain the user's
+	// own domain, if any, also routed to it.
+	Host         string
+	CustomDomain string
+}
+
+// releaseHistory holds each app's successful releases, oldest first; the last entry is
+// the release the app's stable endpoint currently routes to. releaseHistoryMu only guards
+// reads and writes of the map; changes that also route the app are serialized per app key
+// by appLocks, so a slow cluster call for one app doesn't hold up the others.
+var (
+	releaseHistoryMu sync.Mutex
+	releaseHistory   = map[string][]release{}
+	appLocks         = newKeyedMutex()
+)
+
+// appKey identifies an app as a user's repository.
+func appKey(userID, repoURL string) string {
+	return userID + "\x00" + repoURL
+}
+
+// generateAppHost returns the stable hostname of a user's app, independent of the commit
+// deployed: the custom subdomain if one was chosen, otherwise one derived from the app.
+func generateAppHost(userID, repoURL, subdomain string) string {
+	if subdomain != "" {
+		return subdomain + "." + baseDomain
+	}
+	return generateHost(dnsLabel(fmt.Sprintf("%s-%s", userID, repoHash(repoURL))))
+}
+
+// routeApp moves the app's stable ingress, and its custom domain ingress if it has one,
+// from one release's namespace to another's. from may be nil when the app has no active
+// release yet.
+func routeApp(ctx context.Context, userID, repoURL string, from *release, to release) error {
+	toCtx := withCluster(ctx, to.Cluster)
+	substitutions := ingressSubstitutions(to.Namespace, appIngressName, to.Host)
+	if err := applyK8sTemplate(toCtx, ingressTemplate, to.Namespace, substitutions); err != nil {
+		return fmt.Errorf("creating app ingress in %s: %w", to.Namespace, err)
+	}
+	if to.CustomDomain != "" {
+		if err := applyK8sTemplate(toCtx, customDomainIngressTemplate, to.Namespace, customDomainSubstitutions(to.Namespace, to.CustomDomain)); err != nil {
+			return fmt.Errorf("creating custom domain ingress in %s: %w", to.Namespace, err)
+		}
+	}
+	if from == nil || (from.Cluster == to.Cluster && from.Namespace == to.Namespace) {
+		return nil
+	}
+	fromCtx := withCluster(ctx, from.Cluster)
+	ingresses := []string{appIngressName}
+	if from.CustomDomain != "" {
+		ingresses = append(ingresses, customDomainIngressName)
+	}
+	for _, name := range ingresses {
+		err := kubeFor(fromCtx).NetworkingV1().Ingresses(from.Namespace).Delete(fromCtx, name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("removing ingress %s from %s: %w", name, from.Namespace, err)
+		}
+	}
+	return nil
+}
+
+// currentRelease returns the release the app's stable endpoint routes to, if any.
+func currentRelease(userID, repoURL string) (release, bool) {
+	releaseHistoryMu.Lock()
+	defer releaseHistoryMu.Unlock()
+	history := releaseHistory[appKey(userID, repoURL)]
+	if len(history) == 0 {
+		return release{}, false
+	}
+	return history[len(history)-1], true
+}
+
+// sameNamespace reports whether two releases run in the same namespace of the same cluster.
+func (r release) sameNamespace(other release) bool {
+	return r.Cluster.Name == other.Cluster.Name && r.Namespace == other.Namespace
+}
+
+// promoteRelease routes the app's stable endpoint to a new release of the deployment and
+// records it in the history. The release traffic moved off, if it is in another namespace,
+// is kept for blueGreenRetention so it can be rolled back to, then its namespace is deleted.
+func promoteRelease(ctx context.Context, deployment *Deployment, userID, repoURL string, r release) error {
+	key := appKey(userID, repoURL)
+	unlock, err := appLocks.lock(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, ok := currentRelease(userID, repoURL)
+	from := &current
+	if !ok {
+		from = nil
+	}
+	if err := routeApp(ctx, userID, repoURL, from, r); err != nil {
+		return err
+	}
+	if ok && !current.sameNamespace(r) {
+		scheduleReleaseCleanup(ctx, deployment.logger, key, current, deployment.send)
+	}
+	releaseHistoryMu.Lock()
+	history := append(releaseHistory[key], r)
+	if len(history) > maxReleaseHistory {
+		history = history[len(history)-maxReleaseHistory:]
+	}
+	releaseHistory[key] = history
+	releaseHistoryMu.Unlock()
+	return nil
+}
+
+// scheduleReleaseCleanup deletes the namespace of a release of the app key once
+// blueGreenRetention has passed, unless the app's stable endpoint routes to it again by
+// then. notify, if set, is told once the namespace is being deleted.
+func scheduleReleaseCleanup(ctx context.Context, logger *slog.Logger, key string, old release, notify func(event, message string)) {
+	go func() {
+		time.Sleep(blueGreenRetention)
+		if cleanUpRelease(ctx, logger, key, old) && notify != nil {
+			notify("old_version_cleaned", fmt.Sprintf("Removed previous release %s (namespace %s)", old.DeploymentID, old.Namespace))
+		}
+	}()
+}
+
+// cleanUpRelease deletes the namespace of a release traffic has moved off, together with the
+// releases in it from the app's history, and marks their deployments deleted. It waits for
+// any operation on the namespace, and any promotion or rollback of the app, to finish first,
+// and keeps the namespace if the app's stable endpoint routes to it again by then, reporting
+// whether it was deleted.
+func cleanUpRelease(ctx context.Context, logger *slog.Logger, key string, old release) bool {
+	ctx = withCluster(context.WithoutCancel(ctx), old.Cluster)
+	logger = logger.With("namespace", old.Namespace, "releaseDeploymentID", old.DeploymentID)
+	unlock, err := lockNamespace(ctx, old.Namespace)
+	if err != nil {
+		return false
+	}
+	defer unlock()
+
+	// Holding the app's lock while dropping the release from the history keeps a rollback
+	// from routing to it meanwhile; once dropped, none can.
+	unlockApp, err := appLocks.lock(ctx, key)
+	if err != nil {
+		return false
+	}
+	releaseHistoryMu.Lock()
+	history := releaseHistory[key]
+	if len(history) > 0 && history[len(history)-1].sameNamespace(old) {
+		releaseHistoryMu.Unlock()
+		unlockApp()
+		logger.Info("Previous release is live again, keeping it")
+		return false
+	}
+	var kept []release
+	dropped := []string{old.DeploymentID}
+	for _, r := range history {
+		if !r.sameNamespace(old) {
+			kept = append(kept, r)
+		} else if r.DeploymentID != old.DeploymentID {
+			dropped = append(dropped, r.DeploymentID)
+		}
+	}
+	releaseHistory[key] = kept
+	releaseHistoryMu.Unlock()
+	unlockApp()
+
+	if err := deleteNamespace(ctx, logger, old.Namespace); err != nil {
+		return false
+	}
+	for _, id := range dropped {
+		markDeploymentDeleted(ctx, logger, id)
+	}
+	return true
+}
+
+// rollbackApp routes the app's stable endpoint back to its previous successful release,
+// provided that release's production deployment is still running. The attempt, made from
+// sourceIP, is recorded in the audit log.
+func rollbackApp(ctx context.Context, sconn *SafeConn, userID, sourceIP, repoURL string) {
+	entry := auditEntry{UserID: userID, Action: "rollback", RepoURL: repoURL, Outcome: auditFailed, SourceIP: sourceIP}
+	defer func() { recordAudit(entry) }()
+
+	key := appKey(userID, repoURL)
+	unlock, err := appLocks.lock(ctx, key)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	releaseHistoryMu.Lock()
+	history := slices.Clone(releaseHistory[key])
+	releaseHistoryMu.Unlock()
+	if len(history) < 2 {
+		sendWebSocketError(sconn, "rollback_error", codeNoPreviousDeployment, "No previous successful deployment to roll back to")
+		return
+	}
+	current, previous := history[len(history)-1], history[len(history)-2]
+	// The stable hostname and custom domain stay the ones currently served.
+	previous.Host, previous.CustomDomain = current.Host, current.CustomDomain
+	entry.DeploymentID, entry.Namespace, entry.Cluster = previous.DeploymentID, previous.Namespace, previous.Cluster.Name
+	entry.CommitHash, entry.Detail = previous.CommitHash, "from deployment "+current.DeploymentID
+
+	if err := checkProdDeploymentReady(withCluster(ctx, previous.Cluster), previous.Namespace); err != nil {
+		sendWebSocketError(sconn, "rollback_error", codeRollbackFailed, fmt.Sprintf("Previous deployment %s is not available: %v", previous.DeploymentID, err))
+		return
+	}
+	if err := routeApp(ctx, userID, repoURL, &current, previous); err != nil {
+		sendWebSocketError(sconn, "rollback_error", codeRollbackFailed, "Failed to switch endpoint: "+err.Error())
+		return
+	}
+	history[len(history)-2] = previous
+	releaseHistoryMu.Lock()
+	releaseHistory[key] = history[:len(history)-1]
+	releaseHistoryMu.Unlock()
+	if !current.sameNamespace(previous) {
+		scheduleReleaseCleanup(ctx, slog.Default().With("userID", userID), key, current, nil)
+	}
+	entry.Outcome = auditSucceeded
+	sendWebSocketMessage(sconn, "rollback_success", fmt.Sprintf("Rolled back https://%s to deployment %s (commit %s)",
+		previous.Host, previous.DeploymentID, previous.CommitHash))
+}
+
+// checkProdDeploymentReady verifies the namespace's live production version has ready replicas.
+func checkProdDeploymentReady(ctx context.Context, namespace string) error {
+	color, live, err := liveProdVersion(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	if !live {
+		return fmt.Errorf("namespace %s has no live production version", namespace)
+	}
+	name := prodDeploymentFor(color)
+	d, err := kubeFor(ctx).AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if d.Status.ReadyReplicas == 0 {
+		return fmt.Errorf("deployment %s has %d/%d ready replicas", name, d.Status.ReadyReplicas, d.Status.Replicas)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// deletedNamespaces returns the namespaces the runner was asked to delete.
+func deletedNamespaces(f *fakeRunner) []string {
+	var namespaces []string
+	for _, cmd := range f.Commands() {
+		if i := slices.Index(cmd.Args, "delete"); i >= 0 && i+2 < len(cmd.Args) && cmd.Args[i+1] == "namespace" {
+			namespaces = append(namespaces, cmd.Args[i+2])
+		}
+	}
+	return namespaces
+}
+
+func TestCleanUpReleaseDeletesOldNamespace(t *testing.T) {
+	useTestStore(t)
+	runner := &fakeRunner{}
+	useFakeRunner(t, runner)
+	c := &cluster{Name: "test"}
+	now := time.Now().UTC()
+	if err := deploymentStore.Save(context.Background(), DeploymentRecord{
+		ID: "dep-old", UserID: "alice", Namespace: "app-old", Status: StatusSucceeded, CreatedAt: now, UpdatedAt: now,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	key := appKey("alice", "repo")
+	old := release{DeploymentID: "dep-old", Cluster: c, Namespace: "app-old"}
+	current := release{DeploymentID: "dep-new", Cluster: c, Namespace: "app-new"}
+	useTestReleaseHistory(t, map[string][]release{key: {old, current}})
+
+	if !cleanUpRelease(context.Background(), slog.Default(), key, old) {
+		t.Fatal("old release was kept")
+	}
+	if got := deletedNamespaces(runner); !slices.Equal(got, []string{"app-old"}) {
+		t.Errorf("deleted namespaces = %v, want [app-old]", got)
+	}
+	if history := releaseHistory[key]; len(history) != 1 || history[0].DeploymentID != "dep-new" {
+		t.Errorf("history = %+v, want only the current release", history)
+	}
+	rec, err := deploymentStore.Get(context.Background(), "dep-old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Status != StatusDeleted {
+		t.Errorf("old deployment status = %s, want %s", rec.Status, StatusDeleted)
+	}
+}
+
+func TestCleanUpReleaseKeepsLiveRelease(t *testing.T) {
+	useTestStore(t)
+	runner := &fakeRunner{}
+	useFakeRunner(t, runner)
+	c := &cluster{Name: "test"}
+	key := appKey("alice", "repo")
+	old := release{DeploymentID: "dep-old", Cluster: c, Namespace: "app-old"}
+	// The app was rolled back to the old release during the retention period.
+	useTestReleaseHistory(t, map[string][]release{key: {old}})
+
+	if cleanUpRelease(context.Background(), slog.Default(), key, old) {
+		t.Error("live release was deleted")
+	}
+	if got := deletedNamespaces(runner); len(got) != 0 {
+		t.Errorf("deleted namespaces = %v, want none", got)
+	}
+}
+
+func TestPromoteReleaseSchedulesCleanupOfOtherNamespace(t *testing.T) {
+	useTestStore(t)
+	runner := &fakeRunner{}
+	useFakeRunner(t, runner)
+	previousRetention := blueGreenRetention
+	blueGreenRetention = 0
+	t.Cleanup(func() { blueGreenRetention = previousRetention })
+	previousTemplate := ingressTemplate
+	ingressTemplate = "../templates/ingress.yaml"
+	t.Cleanup(func() { ingressTemplate = previousTemplate })
+	c := &cluster{Name: "test", Client: fake.NewSimpleClientset()}
+	key := appKey("alice", "repo")
+	old := release{DeploymentID: "dep-old", Cluster: c, Namespace: "app-old", Host: "app.example.com"}
+	useTestReleaseHistory(t, map[string][]release{key: {old}})
+
+	d, ctx := newTestDeployment(t, DeploymentPayload{UserID: "alice", RepoURL: "repo", CommitHash: "abcdef1"})
+	if err := promoteRelease(ctx, d, "alice", "repo", release{DeploymentID: d.ID, Cluster: c, Namespace: "app-new", Host: "app.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Contains(sentEvents(d), "old_version_cleaned") {
+		if time.Now().After(deadline) {
+			t.Fatal("old release was never cleaned up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := deletedNamespaces(runner); !slices.Equal(got, []string{"app-old"}) {
+		t.Errorf("deleted namespaces = %v, want [app-old]", got)
+	}
+}
+
+func TestPromoteReleaseDoesNotWaitForOtherApps(t *testing.T) {
+	useTestStore(t)
+	started, proceed := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	runner := &fakeRunner{Handler: func(cmd Command) (string, error) {
+		if slices.Contains(cmd.Args, "app-slow") {
+			once.Do(func() { close(started) })
+			<-proceed
+		}
+		return "", nil
+	}}
+	useFakeRunner(t, runner)
+	previousTemplate := ingressTemplate
+	ingressTemplate = "../templates/ingress.yaml"
+	t.Cleanup(func() { ingressTemplate = previousTemplate })
+	c := &cluster{Name: "test", Client: fake.NewSimpleClientset()}
+	useTestReleaseHistory(t, map[string][]release{})
+	// Let the slow routing finish even if the test fails early.
+	finishSlow := sync.OnceFunc(func() { close(proceed) })
+	t.Cleanup(finishSlow)
+
+	slow, slowCtx := newTestDeployment(t, DeploymentPayload{UserID: "bob", RepoURL: "repo", CommitHash: "abcdef1"})
+	slowDone := make(chan error, 1)
+	go func() {
+		slowDone <- promoteRelease(slowCtx, slow, "bob", "repo", release{DeploymentID: slow.ID, Cluster: c, Namespace: "app-slow", Host: "bob.example.com"})
+	}()
+	<-started
+
+	d, ctx := newTestDeployment(t, DeploymentPayload{UserID: "alice", RepoURL: "repo", CommitHash: "abcdef1"})
+	done := make(chan error, 1)
+	go func() {
+		done <- promoteRelease(ctx, d, "alice", "repo", release{DeploymentID: d.ID, Cluster: c, Namespace: "app-fast", Host: "alice.example.com"})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("promoting one app waited for another app's routing")
+	}
+	if r, ok := currentRelease("alice", "repo"); !ok || r.DeploymentID != d.ID {
+		t.Errorf("alice's current release = %+v, %v; want %s", r, ok, d.ID)
+	}
+
+	finishSlow()
+	if err := <-slowDone; err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := currentRelease("bob", "repo"); !ok || r.DeploymentID != slow.ID {
+		t.Errorf("bob's current release = %+v, %v; want %s", r, ok, slow.ID)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Command is an external command to run.
+type Command struct {
+	Name string
+	Args []string
+	// Env is added to the control server's own environment.
+	Env []string
+	// Stdin, if not empty, is written to the command's standard input.
+	Stdin string
+	// OnLine, if not nil, is called with each line of output as the command produces it.
+	OnLine func(line string)
+}
+
+// String renders the command line for logs and errors.
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// CommandRunner runs external commands such as kubectl, helm, and git and returns their
+// combined output.
+type CommandRunner interface {
+	Run(ctx context.Context, timeout time.Duration, cmd Command) (string, error)
+}
+
+// commandRunner runs every external command the control server executes.
+var commandRunner CommandRunner = execRunner{}
+
+// execRunner runs commands as child processes.
+type execRunner struct{}
+
+// Run executes cmd, killing it once timeout elapses or ctx is cancelled.
+func (execRunner) Run(ctx context.Context, timeout time.Duration, c Command) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.Name, c.Args...)
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	if c.Stdin != "" {
+		cmd.Stdin = strings.NewReader(c.Stdin)
+	}
+	var output []byte
+	var err error
+	if c.OnLine == nil {
+		output, err = cmd.CombinedOutput()
+	} else {
+		w := &lineWriter{onLine: c.OnLine}
+		cmd.Stdout, cmd.Stderr = w, w
+		err = cmd.Run()
+		w.flush()
+		output = w.buf.Bytes()
+	}
+	if err != nil && ctx.Err() != nil {
+		// Report that the command was killed because it ran out of time or was cancelled.
+		err = fmt.Errorf("%w (%w)", ctx.Err(), err)
+	}
+	return string(output), err
+}
+
+// lineWriter collects a command's output, passing each complete line to onLine as it is written.
+type lineWriter struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	partial []byte
+	onLine  func(line string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.onLine(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush passes on a final line that did not end in a newline.
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.onLine(string(w.partial))
+		w.partial = nil
+	}
+}
+
+// runCommand executes a command with a given timeout and returns its output.
+// The command is killed early if ctx is cancelled. kubectl and helm commands target the
+// cluster selected for ctx.
+func runCommand(ctx context.Context, timeout time.Duration, name string, args ...string) (string, error) {
+	return commandRunner.Run(ctx, timeout, Command{Name: name, Args: append(clusterArgs(ctx, name), args...)})
+}
+
+// runCommandEnv is like runCommand but adds env to the command's environment.
+func runCommandEnv(ctx context.Context, timeout time.Duration, env []string, name string, args ...string) (string, error) {
+	return commandRunner.Run(ctx, timeout, Command{Name: name, Args: append(clusterArgs(ctx, name), args...), Env: env})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRunner is a CommandRunner that records commands instead of running them, answering
+// each with the result of Handler, or empty output if Handler is nil.
+type fakeRunner struct {
+	Handler func(cmd Command) (string, error)
+
+	mu       sync.Mutex
+	commands []Command
+}
+
+// Run records cmd and returns the handler's result.
+func (f *fakeRunner) Run(ctx context.Context, timeout time.Duration, cmd Command) (string, error) {
+	f.mu.Lock()
+	f.commands = append(f.commands, cmd)
+	f.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if f.Handler == nil {
+		return "", nil
+	}
+	output, err := f.Handler(cmd)
+	if cmd.OnLine != nil && output != "" {
+		for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+			cmd.OnLine(line)
+		}
+	}
+	return output, err
+}
+
+// Commands returns the commands run so far.
+func (f *fakeRunner) Commands() []Command {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Command(nil), f.commands...)
+}
+
+// useFakeRunner replaces commandRunner with a fakeRunner for the test.
+func useFakeRunner(t *testing.T, f *fakeRunner) {
+	t.Helper()
+	previous := commandRunner
+	commandRunner = f
+	t.Cleanup(func() { commandRunner = previous })
+}
+
+func TestRunCommandTargetsCluster(t *testing.T) {
+	runner := &fakeRunner{}
+	useFakeRunner(t, runner)
+	ctx := withCluster(context.Background(), &cluster{Name: "east", Context: "east-ctx", Kubeconfig: "/etc/kube/east"})
+
+	if _, err := runCommand(ctx, time.Second, "kubectl", "get", "pods"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runCommand(ctx, time.Second, "helm", "list"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runCommand(ctx, time.Second, "git", "status"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"kubectl --kubeconfig /etc/kube/east --context east-ctx get pods",
+		"helm --kubeconfig /etc/kube/east --kube-context east-ctx list",
+		"git status",
+	}
+	var got []string
+	for _, cmd := range runner.Commands() {
+		got = append(got, cmd.String())
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestFakeRunnerAnswersWithHandler(t *testing.T) {
+	failure := errors.New("exit status 1")
+	runner := &fakeRunner{Handler: func(cmd Command) (string, error) {
+		return "line 1\nline 2\n", failure
+	}}
+	var lines []string
+	output, err := runner.Run(context.Background(), time.Second, Command{Name: "kubectl", OnLine: func(line string) { lines = append(lines, line) }})
+	if !errors.Is(err, failure) || output != "line 1\nline 2\n" {
+		t.Errorf("Run = %q, %v; want the handler's result", output, err)
+	}
+	if !slices.Equal(lines, []string{"line 1", "line 2"}) {
+		t.Errorf("lines = %q, want each line of output", lines)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := runner.Run(ctx, time.Second, Command{Name: "kubectl"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run with a cancelled context = %v, want context.Canceled", err)
+	}
+	if n := len(runner.Commands()); n != 2 {
+		t.Errorf("%d commands recorded, want 2", n)
+	}
+}
+
+func TestExecRunnerStreamsLines(t *testing.T) {
+	var lines []string
+	output, err := execRunner{}.Run(context.Background(), 5*time.Second, Command{
+		Name:   "sh",
+		Args:   []string{"-c", "cat; printf 'last'"},
+		Stdin:  "first\n",
+		OnLine: func(line string) { lines = append(lines, line) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "first\nlast" || !slices.Equal(lines, []string{"first", "last"}) {
+		t.Errorf("Run = %q with lines %q, want %q with lines [first last]", output, lines, "first\nlast")
+	}
+}
+
+func TestExecRunnerTimeout(t *testing.T) {
+	_, err := execRunner{}.Run(context.Background(), 50*time.Millisecond, Command{Name: "sleep", Args: []string{"5"}})
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "killed") {
+		t.Errorf("Run = %v, want a deadline exceeded error", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// scaleDeployment changes the replica count of the live production version of one of the
+// user's successful deployments, then waits for the replicas to be ready and reports scaled.
+// Deployments running an autoscaler are rejected, since it would undo the change. The
+// attempt, made from sourceIP, is recorded in the audit log.
+func scaleDeployment(ctx context.Context, sconn *SafeConn, userID, sourceIP, id string, replicas int) {
+	entry := auditEntry{UserID: userID, Action: "scale", DeploymentID: id, Outcome: auditFailed, SourceIP: sourceIP,
+		Detail: fmt.Sprintf("replicas=%d", replicas)}
+	defer func() { recordAudit(entry) }()
+
+	if replicas < 1 || replicas > maxReplicas {
+		sendWebSocketError(sconn, "scale_error", codeValidationError, fmt.Sprintf("replicas must be between 1 and %d", maxReplicas))
+		return
+	}
+	ctx, rec, unlock, ok := lockLiveDeployment(ctx, sconn, "scale_error", userID, id)
+	if !ok {
+		return
+	}
+	defer unlock()
+	entry.Namespace, entry.Cluster = rec.Namespace, rec.Cluster
+
+	name, err := scaleProdVersion(ctx, rec.Namespace, replicas)
+	if err != nil {
+		sendWebSocketError(sconn, "scale_error", codeScaleFailed, fmt.Sprintf("Failed to scale deployment %s: %v", id, err))
+		return
+	}
+	slog.Default().Info("Scaled production deployment", "deploymentID", id, "namespace", rec.Namespace, "deployment", name, "replicas", replicas)
+	if err := waitForReplicasReady(ctx, rec.Namespace, name, replicas, rolloutTimeout, nil); err != nil {
+		sendWebSocketError(sconn, "scale_error", codeScaleFailed, fmt.Sprintf("Deployment %s did not scale to %d replicas: %v", id, replicas, err))
+		return
+	}
+	entry.Outcome = auditSucceeded
+	sendWebSocketMessage(sconn, "scaled", fmt.Sprintf("Deployment %s is running %d ready replicas", id, replicas))
+}
+
+// lockLiveDeployment looks up one of the user's successful deployments for an action on its
+// production pods and locks its namespace, returning a context selecting its cluster. If the
+// deployment cannot be acted on, the client is sent errorEvent and ok is false.
+func lockLiveDeployment(ctx context.Context, sconn *SafeConn, errorEvent, userID, id string) (_ context.Context, rec DeploymentRecord, unlock func(), ok bool) {
+	rec, err := deploymentStore.Get(ctx, id)
+	if errors.Is(err, errDeploymentNotFound) || (err == nil && rec.UserID != userID) {
+		sendWebSocketError(sconn, errorEvent, codeDeploymentNotFound, "No deployment with ID "+id)
+		return ctx, rec, nil, false
+	}
+	if err != nil {
+		sendWebSocketError(sconn, errorEvent, codeInternalError, "Failed to look up deployment: "+err.Error())
+		return ctx, rec, nil, false
+	}
+	if rec.Status != StatusSucceeded {
+		sendWebSocketError(sconn, errorEvent, codeValidationError, fmt.Sprintf("Deployment %s is %s; only successful deployments are running", id, rec.Status))
+		return ctx, rec, nil, false
+	}
+	c, err := resolveCluster(rec.Cluster)
+	if err != nil {
+		sendWebSocketError(sconn, errorEvent, codeInternalError, "Cannot reach the deployment's cluster: "+err.Error())
+		return ctx, rec, nil, false
+	}
+	ctx = withCluster(ctx, c)
+	if unlock, err = lockNamespace(ctx, rec.Namespace); err != nil {
+		return ctx, rec, nil, false
+	}
+	return ctx, rec, unlock, true
+}
+
+// scaleProdVersion sets the replica count of the namespace's live production Deployment,
+// returning its name.
+func scaleProdVersion(ctx context.Context, namespace string, replicas int) (string, error) {
+	color, live, err := liveProdVersion(ctx, namespace)
+	if err != nil {
+		return "", err
+	}
+	if !live {
+		return "", fmt.Errorf("namespace %s has no live production version", namespace)
+	}
+	if _, err := kubeFor(ctx).AutoscalingV2().HorizontalPodAutoscalers(namespace).Get(ctx, hpaName, metav1.GetOptions{}); err == nil {
+		return "", errors.New("the deployment is autoscaled; redeploy with new minReplicas and maxReplicas instead")
+	} else if !apierrors.IsNotFound(err) {
+		return "", err
+	}
+
+	name := prodDeploymentFor(color)
+	patch := fmt.Sprintf(`{"spec":{"replicas":%d}}`, replicas)
+	if _, err := kubeFor(ctx).AppsV1().Deployments(namespace).Patch(ctx, name, types.MergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// SecretMap holds sensitive key/value pairs. Its values are redacted whenever it is
+// formatted or logged, so payloads containing it can be printed safely.
+type SecretMap map[string]string
+
+// redacted renders the keys with masked values.
+func (m SecretMap) redacted() string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key+":[REDACTED]")
+	}
+	sort.Strings(keys)
+	return "map[" + strings.Join(keys, " ") + "]"
+}
+
+// String implements fmt.Stringer.
+func (m SecretMap) String() string { return m.redacted() }
+
+// GoString implements fmt.GoStringer so %#v is redacted too.
+func (m SecretMap) GoString() string { return m.redacted() }
+
+// Format implements fmt.Formatter, redacting for every verb.
+func (m SecretMap) Format(f fmt.State, verb rune) { fmt.Fprint(f, m.redacted()) }
+
+// LogValue implements slog.LogValuer.
+func (m SecretMap) LogValue() slog.Value { return slog.StringValue(m.redacted()) }
+
+// SecretString is a sensitive value, such as a token or private key, that is redacted
+// whenever it is formatted or logged.
+type SecretString string
+
+// String implements fmt.Stringer.
+func (s SecretString) String() string { return "[REDACTED]" }
+
+// GoString implements fmt.GoStringer so %#v is redacted too.
+func (s SecretString) GoString() string { return "[REDACTED]" }
+
+// Format implements fmt.Formatter, redacting for every verb.
+func (s SecretString) Format(f fmt.State, verb rune) { fmt.Fprint(f, "[REDACTED]") }
+
+// LogValue implements slog.LogValuer.
+func (s SecretString) LogValue() slog.Value { return slog.StringValue("[REDACTED]") }
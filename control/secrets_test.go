@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// captureLogs sends the standard and structured loggers' output to a buffer for the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous, output, flags := slog.Default(), log.Writer(), log.Flags()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() {
+		log.SetOutput(output)
+		log.SetFlags(flags)
+		slog.SetDefault(previous)
+	})
+	return &buf
+}
+
+func TestSecretsAreRedactedInLogs(t *testing.T) {
+	const value = "s3cr3t-value"
+	payload := DeploymentPayload{
+		UserID:  "alice",
+		Secrets: SecretMap{"API_KEY": value},
+	}
+	token := SecretString(value)
+	logs := captureLogs(t)
+
+	slog.Info("Received deployment", "payload", payload, "secrets", payload.Secrets, "token", token)
+	slog.Default().With("payload", payload).Error("Deployment failed")
+	log.Printf("payload %v %+v %#v %s %q", payload, payload, payload, payload.Secrets, payload.Secrets)
+	log.Printf("token %v %s %q %x %#v", token, token, token, token, token)
+	fmt.Fprintf(logs, "%v %+v\n", &payload, []SecretMap{payload.Secrets})
+
+	if strings.Contains(logs.String(), value) {
+		t.Errorf("logs contain the secret value:\n%s", logs)
+	}
+	if !strings.Contains(logs.String(), "API_KEY:[REDACTED]") {
+		t.Errorf("logs do not name the redacted secret:\n%s", logs)
+	}
+}
+
+func TestApplyAppSecretStoresValues(t *testing.T) {
+	cs := fake.NewSimpleClientset()
+	ctx := withCluster(context.Background(), &cluster{Name: "test", Client: cs})
+	for _, value := range []string{"first", "second"} {
+		if err := applyAppSecret(ctx, "ns", SecretMap{"API_KEY": value}); err != nil {
+			t.Fatal(err)
+		}
+		secret, err := cs.CoreV1().Secrets("ns").Get(ctx, appSecret, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := secret.StringData["API_KEY"]; got != value {
+			t.Errorf("secret API_KEY = %q, want %q", got, value)
+		}
+	}
+}
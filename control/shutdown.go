@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// shutdownGracePeriod bounds how long shutdown waits for in-flight deployments to finish.
+var shutdownGracePeriod time.Duration
+
+var (
+	// shutdownMu guards shuttingDown so no deployment is tracked after shutdown starts waiting.
+	shutdownMu    sync.Mutex
+	shuttingDown  bool
+	deploymentsWG sync.WaitGroup
+
+	// connections holds the open WebSocket connections so they can be closed on shutdown.
+	connectionsMu sync.Mutex
+	connections   = map[*SafeConn]struct{}{}
+)
+
+// trackDeployment registers a new deployment goroutine, reporting false if the server
+// is shutting down and no new deployments should be started.
+func trackDeployment() bool {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	if shuttingDown {
+		return false
+	}
+	deploymentsWG.Add(1)
+	return true
+}
+
+// trackConnection records an open WebSocket connection.
+func trackConnection(sconn *SafeConn) {
+	connectionsMu.Lock()
+	connections[sconn] = struct{}{}
+	connectionsMu.Unlock()
+}
+
+// untrackConnection forgets a WebSocket connection once its handler exits.
+func untrackConnection(sconn *SafeConn) {
+	connectionsMu.Lock()
+	delete(connections, sconn)
+	connectionsMu.Unlock()
+}
+
+// Close sends a close frame with the given code and reason, then closes the connection.
+// Only the first call has any effect, so a connection closed for one reason is not closed
+// again for the read error that follows.
+func (s *SafeConn) Close(code int, reason string) {
+	s.closeOnce.Do(func() {
+		deadline := time.Now().Add(time.Second)
+		if err := s.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline); err != nil {
+			log.Printf("Error sending close frame: %v", err)
+		}
+		s.Conn.Close()
+	})
+}
+
+// shutdown stops accepting connections and deployments, waits up to the grace period for
+// in-flight deployments, then closes the remaining WebSocket connections.
+func shutdown(srv *http.Server) {
+	shutdownMu.Lock()
+	shuttingDown = true
+	shutdownMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down HTTP server: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		deploymentsWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Println("All deployments finished")
+	case <-ctx.Done():
+		log.Println("Grace period expired, cancelling remaining deployments")
+	}
+
+	cancelAllDeployments()
+	connectionsMu.Lock()
+	for sconn := range connections {
+		sconn.Close(websocket.CloseGoingAway, "server shutting down")
+	}
+	connectionsMu.Unlock()
+
+	// Give cancelled deployments a moment to delete their namespaces before exiting.
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		log.Println("Timed out waiting for cancelled deployments to clean up")
+	}
+}
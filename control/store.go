@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errDeploymentNotFound is returned by a DeploymentStore when no record matches.
+var errDeploymentNotFound = errors.New("deployment not found")
+
+// errSubdomainTaken is returned by DeploymentStore.ClaimSubdomain when another app holds the subdomain.
+var errSubdomainTaken = errors.New("subdomain taken")
+
+// DeploymentRecord is the persisted form of a deployment.
+type DeploymentRecord struct {
+	ID         string `json:"id"`
+	UserID     string `json:"userID"`
+	RepoURL    string `json:"repoURL"`
+	CommitHash string `json:"commitHash"`
+	Namespace  string `json:"namespace"`
+	// Cluster names the cluster the namespace is in; empty for records made before
+	// deployments could target more than one cluster, which ran in the primary cluster.
+	Cluster   string           `json:"cluster,omitempty"`
+	Status    DeploymentStatus `json:"status"`
+	Endpoint  string           `json:"endpoint,omitempty"`
+	CreatedAt time.Time        `json:"createdAt"`
+	UpdatedAt time.Time        `json:"updatedAt"`
+	// Timings records the phases the deployment went through, in order.
+	Timings []PhaseTiming `json:"timings,omitempty"`
+}
+
+// DeploymentFilter selects deployment records for DeploymentStore.List.
+type DeploymentFilter struct {
+	UserID string
+	// Status restricts results to one status when non-empty.
+	Status DeploymentStatus
+	Limit  int
+	Offset int
+}
+
+// DeploymentStore persists deployment records so they survive restarts.
+type DeploymentStore interface {
+	// Save inserts the record, or replaces the existing record with the same ID.
+	Save(ctx context.Context, rec DeploymentRecord) error
+	// Get returns the record with the given ID, or errDeploymentNotFound.
+	Get(ctx context.Context, id string) (DeploymentRecord, error)
+	// LatestByNamespace returns the most recently created record for the namespace with the
+	// given status, or errDeploymentNotFound.
+	LatestByNamespace(ctx context.Context, namespace string, status DeploymentStatus) (DeploymentRecord, error)
+	// List returns the records matching filter, oldest first.
+	List(ctx context.Context, filter DeploymentFilter) ([]DeploymentRecord, error)
+	// AppendEvent records an event of a deployment, including its streamed log lines.
+	AppendEvent(ctx context.Context, deploymentID string, e Event) error
+	// Events returns the recorded events of a deployment with sequence numbers greater
+	// than after, in order.
+	Events(ctx context.Context, deploymentID string, after int) ([]Event, error)
+	// ClaimSubdomain reserves a custom subdomain or custom domain for a user's app,
+	// succeeding if the app already holds it, or returns errSubdomainTaken if another app does.
+	ClaimSubdomain(ctx context.Context, subdomain, userID, repoURL string) error
+	Close() error
+}
+
+// deploymentStore is the process-wide store, initialized in main.
+var deploymentStore DeploymentStore
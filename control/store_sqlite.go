@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteStore is a DeploymentStore backed by a SQLite database file.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// newSQLiteStore opens (creating if needed) the SQLite database at path and applies the schema.
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("opening database %s: %w", path, err)
+	}
+	// SQLite allows a single writer; serialize access through one connection.
+	db.SetMaxOpenConns(1)
+
+	const schema = `CREATE TABLE IF NOT EXISTS deployments (
+		id          TEXT PRIMARY KEY,
+		user_id     TEXT NOT NULL,
+		repo_url    TEXT NOT NULL,
+		commit_hash TEXT NOT NULL,
+		namespace   TEXT NOT NULL,
+		cluster     TEXT NOT NULL DEFAULT '',
+		status      TEXT NOT NULL,
+		endpoint    TEXT NOT NULL,
+		created_at  TEXT NOT NULL,
+		updated_at  TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS deployments_user_created ON deployments (user_id, created_at);
+	CREATE INDEX IF NOT EXISTS deployments_namespace ON deployments (namespace);
+	CREATE TABLE IF NOT EXISTS deployment_events (
+		deployment_id TEXT NOT NULL,
+		seq           INTEGER NOT NULL,
+		event         TEXT NOT NULL,
+		message       TEXT NOT NULL,
+		phase         TEXT NOT NULL,
+		progress      INTEGER NOT NULL,
+		details       TEXT NOT NULL,
+		code          TEXT NOT NULL DEFAULT '',
+		image         TEXT NOT NULL DEFAULT '',
+		image_digest  TEXT NOT NULL DEFAULT '',
+		timestamp     TEXT NOT NULL,
+		PRIMARY KEY (deployment_id, seq)
+	);
+	CREATE TABLE IF NOT EXISTS subdomains (
+		subdomain  TEXT PRIMARY KEY,
+		user_id    TEXT NOT NULL,
+		repo_url   TEXT NOT NULL,
+		created_at TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		time          TEXT NOT NULL,
+		user_id       TEXT NOT NULL,
+		action        TEXT NOT NULL,
+		deployment_id TEXT NOT NULL,
+		namespace     TEXT NOT NULL,
+		cluster       TEXT NOT NULL,
+		repo_url      TEXT NOT NULL,
+		commit_hash   TEXT NOT NULL,
+		outcome       TEXT NOT NULL,
+		source_ip     TEXT NOT NULL,
+		detail        TEXT NOT NULL
+	);
+	CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+	BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END;
+	CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+	BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END;`
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating schema: %w", err)
+	}
+	for _, c := range sqliteAddedColumns {
+		if err := addColumnIfMissing(db, c.table, c.name, c.definition); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("adding column %s: %w", c.name, err)
+		}
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+// sqliteAddedColumns are columns added to tables after they were first released, added to
+// databases created before them.
+var sqliteAddedColumns = []struct{ table, name, definition string }{
+	{"deployments", "cluster", "TEXT NOT NULL DEFAULT ''"},
+	{"deployment_events", "code", "TEXT NOT NULL DEFAULT ''"},
+	{"deployment_events", "image", "TEXT NOT NULL DEFAULT ''"},
+	{"deployment_events", "image_digest", "TEXT NOT NULL DEFAULT ''"},
+	{"deployments", "timings", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// addColumnIfMissing adds a column to a table unless it already has it.
+func addColumnIfMissing(db *sql.DB, table, name, definition string) error {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, name).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + name + " " + definition)
+	return err
+}
+
+func (s *sqliteStore) Save(ctx context.Context, rec DeploymentRecord) error {
+	var timings string
+	if len(rec.Timings) > 0 {
+		data, err := json.Marshal(rec.Timings)
+		if err != nil {
+			return err
+		}
+		timings = string(data)
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO deployments
+		(id, user_id, repo_url, commit_hash, namespace, cluster, status, endpoint, created_at, updated_at, timings)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			namespace = excluded.namespace,
+			cluster = excluded.cluster,
+			status = excluded.status,
+			endpoint = excluded.endpoint,
+			updated_at = excluded.updated_at,
+			timings = excluded.timings`,
+		rec.ID, rec.UserID, rec.RepoURL, rec.CommitHash, rec.Namespace, rec.Cluster, string(rec.Status), rec.Endpoint,
+		rec.CreatedAt.UTC().Format(time.RFC3339Nano), rec.UpdatedAt.UTC().Format(time.RFC3339Nano), timings)
+	return err
+}
+
+func (s *sqliteStore) Get(ctx context.Context, id string) (DeploymentRecord, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT id, user_id, repo_url, commit_hash, namespace, cluster, status, endpoint, created_at, updated_at, timings
+		FROM deployments WHERE id = ?`, id)
+	rec, err := scanDeploymentRecord(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DeploymentRecord{}, errDeploymentNotFound
+	}
+	return rec, err
+}
+
+func (s *sqliteStore) LatestByNamespace(ctx context.Context, namespace string, status DeploymentStatus) (DeploymentRecord, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT id, user_id, repo_url, commit_hash, namespace, cluster, status, endpoint, created_at, updated_at, timings
+		FROM deployments WHERE namespace = ? AND status = ? ORDER BY created_at DESC LIMIT 1`, namespace, string(status))
+	rec, err := scanDeploymentRecord(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DeploymentRecord{}, errDeploymentNotFound
+	}
+	return rec, err
+}
+
+func (s *sqliteStore) List(ctx context.Context, filter DeploymentFilter) ([]DeploymentRecord, error) {
+	query := `SELECT id, user_id, repo_url, commit_hash, namespace, cluster, status, endpoint, created_at, updated_at, timings
+		FROM deployments WHERE user_id = ?`
+	args := []interface{}{filter.UserID}
+	if filter.Status != "" {
+		query += " AND status = ?"
+		args = append(args, string(filter.Status))
+	}
+	query += " ORDER BY created_at LIMIT ? OFFSET ?"
+	args = append(args, filter.Limit, filter.Offset)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []DeploymentRecord{}
+	for rows.Next() {
+		rec, err := scanDeploymentRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+func (s *sqliteStore) AppendEvent(ctx context.Context, deploymentID string, e Event) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO deployment_events
+		(deployment_id, seq, event, message, phase, progress, details, code, image, image_digest, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		deploymentID, e.Seq, e.Event, e.Message, e.Phase, e.Progress, e.Details, string(e.Code), e.Image, e.ImageDigest, e.Timestamp.UTC().Format(time.RFC3339Nano))
+	return err
+}
+
+func (s *sqliteStore) Events(ctx context.Context, deploymentID string, after int) ([]Event, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT seq, event, message, phase, progress, details, code, image, image_digest, timestamp
+		FROM deployment_events WHERE deployment_id = ? AND seq > ? ORDER BY seq`, deploymentID, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		e := Event{DeploymentID: deploymentID}
+		var timestamp string
+		if err := rows.Scan(&e.Seq, &e.Event, &e.Message, &e.Phase, &e.Progress, &e.Details, &e.Code, &e.Image, &e.ImageDigest, &timestamp); err != nil {
+			return nil, err
+		}
+		if e.Timestamp, err = time.Parse(time.RFC3339Nano, timestamp); err != nil {
+			return nil, fmt.Errorf("parsing timestamp: %w", err)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// AppendAudit appends an entry to the audit_log table, which rejects updates and deletes.
+func (s *sqliteStore) AppendAudit(ctx context.Context, e auditEntry) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO audit_log
+		(time, user_id, action, deployment_id, namespace, cluster, repo_url, commit_hash, outcome, source_ip, detail)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Time.UTC().Format(time.RFC3339Nano), e.UserID, e.Action, e.DeploymentID, e.Namespace, e.Cluster,
+		e.RepoURL, e.CommitHash, e.Outcome, e.SourceIP, e.Detail)
+	return err
+}
+
+func (s *sqliteStore) ClaimSubdomain(ctx context.Context, subdomain, userID, repoURL string) error {
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO subdomains (subdomain, user_id, repo_url, created_at)
+		VALUES (?, ?, ?, ?) ON CONFLICT (subdomain) DO NOTHING`,
+		subdomain, userID, repoURL, time.Now().UTC().Format(time.RFC3339Nano)); err != nil {
+		return err
+	}
+	var ownerID, ownerRepo string
+	if err := s.db.QueryRowContext(ctx, `SELECT user_id, repo_url FROM subdomains WHERE subdomain = ?`, subdomain).Scan(&ownerID, &ownerRepo); err != nil {
+		return err
+	}
+	if ownerID != userID || ownerRepo != repoURL {
+		return errSubdomainTaken
+	}
+	return nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// scanDeploymentRecord reads one deployments row.
+func scanDeploymentRecord(row interface{ Scan(...interface{}) error }) (DeploymentRecord, error) {
+	var rec DeploymentRecord
+	var status, createdAt, updatedAt, timings string
+	if err := row.Scan(&rec.ID, &rec.UserID, &rec.RepoURL, &rec.CommitHash, &rec.Namespace, &rec.Cluster, &status, &rec.Endpoint, &createdAt, &updatedAt, &timings); err != nil {
+		return DeploymentRecord{}, err
+	}
+	rec.Status = DeploymentStatus(status)
+	var err error
+	if rec.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+		return DeploymentRecord{}, fmt.Errorf("parsing created_at: %w", err)
+	}
+	if rec.UpdatedAt, err = time.Parse(time.RFC3339Nano, updatedAt); err != nil {
+		return DeploymentRecord{}, fmt.Errorf("parsing updated_at: %w", err)
+	}
+	if timings != "" {
+		if err := json.Unmarshal([]byte(timings), &rec.Timings); err != nil {
+			return DeploymentRecord{}, fmt.Errorf("parsing timings: %w", err)
+		}
+	}
+	return rec, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// expandTemplates resolves a template setting to the template files it names, in the order
+// they are applied. The setting is a comma-separated list of entries, each a file, a
+// directory, standing for the .yaml and .yml files in it, or a glob pattern. Directory and
+// glob entries expand in lexical order, so files can be ordered by prefixing them with
+// numbers. A plain file is returned whether or not it exists, leaving that to its reader.
+func expandTemplates(spec string) ([]string, error) {
+	var paths []string
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		var matches []string
+		if info, err := os.Stat(entry); err == nil && info.IsDir() {
+			for _, pattern := range []string{"*.yaml", "*.yml"} {
+				found, _ := filepath.Glob(filepath.Join(entry, pattern))
+				matches = append(matches, found...)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("template directory %s contains no .yaml or .yml files", entry)
+			}
+		} else if strings.ContainsAny(entry, "*?[") {
+			found, err := filepath.Glob(entry)
+			if err != nil {
+				return nil, fmt.Errorf("template pattern %s: %w", entry, err)
+			}
+			if len(found) == 0 {
+				return nil, fmt.Errorf("template pattern %s matches no files", entry)
+			}
+			matches = found
+		} else {
+			matches = []string{entry}
+		}
+		slices.Sort(matches)
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("template setting %q names no templates", spec)
+	}
+	return paths, nil
+}
+
+// renderedTemplate is a template file rendered to a manifest.
+type renderedTemplate struct {
+	Path     string
+	Manifest string
+}
+
+// renderK8sTemplates renders every template named by spec with the substitutions. A template
+// that fails to render is reported as a *manifestInvalidError.
+func renderK8sTemplates(spec string, substitutions map[string]string) ([]renderedTemplate, error) {
+	paths, err := expandTemplates(spec)
+	if err != nil {
+		return nil, &manifestInvalidError{Template: spec, Message: err.Error()}
+	}
+	rendered := make([]renderedTemplate, 0, len(paths))
+	for _, path := range paths {
+		manifest, err := renderK8sTemplate(path, substitutions)
+		if err != nil {
+			return nil, &manifestInvalidError{Template: path, Message: err.Error()}
+		}
+		rendered = append(rendered, renderedTemplate{Path: path, Manifest: manifest})
+	}
+	return rendered, nil
+}
+
+// applyK8sTemplates renders the templates named by spec and applies them in namespace in
+// order, returning the paths of the templates applied. Every manifest is validated with a
+// server-side dry run before any is applied. If applying a manifest of a set of several
+// nonetheless fails, the objects the call created are deleted again, so the set is applied
+// completely or not at all; objects that already existed keep whatever changes were applied.
+func applyK8sTemplates(ctx context.Context, spec, namespace string, substitutions map[string]string) ([]string, error) {
+	rendered, err := renderK8sTemplates(spec, substitutions)
+	if err != nil {
+		loggerFrom(ctx).Error("Error rendering template", "template", spec, "error", err)
+		return nil, err
+	}
+
+	// Let the API server validate the manifests first, so schema errors are reported as
+	// such rather than surfacing halfway through applying them.
+	for _, t := range rendered {
+		if err := dryRunManifest(ctx, t.Path, namespace, t.Manifest, "server"); err != nil {
+			return nil, err
+		}
+	}
+
+	var applied, created []string
+	for _, t := range rendered {
+		if len(rendered) > 1 {
+			names, err := newManifestObjects(ctx, namespace, t.Manifest)
+			if err != nil {
+				return nil, rollBackTemplates(ctx, namespace, created, fmt.Errorf("listing the objects of %s: %w", t.Path, err))
+			}
+			created = append(created, names...)
+		}
+		output, err := kubectlApply(ctx, namespace, t.Manifest)
+		if err != nil {
+			loggerFrom(ctx).Error("Error applying template", "template", t.Path, "error", err, "output", output)
+			err = fmt.Errorf("%w\nOutput: %s", err, output)
+			if len(rendered) > 1 {
+				err = fmt.Errorf("applying %s: %w", filepath.Base(t.Path), err)
+			}
+			return nil, rollBackTemplates(ctx, namespace, created, err)
+		}
+		applied = append(applied, t.Path)
+	}
+	return applied, nil
+}
+
+// newManifestObjects returns the names, as kubectl prints them, such as
+// deployment.apps/prod-app, of the manifest's objects that do not exist in namespace yet.
+func newManifestObjects(ctx context.Context, namespace, manifest string) ([]string, error) {
+	all, err := kubectlApply(ctx, namespace, manifest, "--dry-run=client", "-o", "name")
+	if err != nil {
+		return nil, fmt.Errorf("%w\nOutput: %s", err, all)
+	}
+	args := append(clusterArgs(ctx, "kubectl"), "get", "-n", namespace, "-f", "-", "-o", "name", "--ignore-not-found")
+	existing, err := commandRunner.Run(ctx, 30*time.Second, Command{Name: "kubectl", Args: args, Stdin: manifest})
+	if err != nil {
+		return nil, fmt.Errorf("%w\nOutput: %s", err, existing)
+	}
+	var names []string
+	existingNames := objectNames(existing)
+	for _, name := range objectNames(all) {
+		if !slices.Contains(existingNames, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// objectNames parses kubectl -o name output, skipping any warnings printed with it.
+func objectNames(output string) []string {
+	var names []string
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); strings.Contains(line, "/") && !strings.ContainsAny(line, " \t") {
+			names = append(names, line)
+		}
+	}
+	return names
+}
+
+// rollBackTemplates deletes the objects a failed applyK8sTemplates call created and returns
+// err, noting any objects that could not be deleted. Cancelling ctx does not stop it.
+func rollBackTemplates(ctx context.Context, namespace string, created []string, err error) error {
+	if len(created) == 0 {
+		return err
+	}
+	args := append([]string{"delete", "-n", namespace, "--ignore-not-found", "--wait=false"}, created...)
+	if output, derr := runKubectl(context.WithoutCancel(ctx), 30*time.Second, args...); derr != nil {
+		loggerFrom(ctx).Error("Error rolling back applied templates", "objects", created, "error", derr, "output", output)
+		return fmt.Errorf("%w (rolling back the objects created failed: %v)", err, derr)
+	}
+	loggerFrom(ctx).Info("Rolled back applied templates", "objects", created)
+	return err
+}
+
+// templateNames returns the file names of template paths, for reporting to clients.
+func templateNames(paths []string) string {
+	names := make([]string, len(paths))
+	for i, path := range paths {
+		names[i] = filepath.Base(path)
+	}
+	return strings.Join(names, ", ")
+}
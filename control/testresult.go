@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Criteria for deciding whether the test pod passed, selected with TEST_SUCCESS_CRITERION
+// or the payload's testSuccessCriterion.
+const (
+	// criterionPhase passes once the pod is Running or Succeeded, for test templates that
+	// keep their container alive after the tests pass.
+	criterionPhase = "phase"
+	// criterionExitCode passes once every container has terminated with exit code 0.
+	criterionExitCode = "exit_code"
+	// criterionMarker passes once the containers have terminated and their logs contain
+	// testPassMarker but not testFailMarker.
+	criterionMarker = "marker"
+)
+
+// Test result settings. The markers are also substituted into the test pod template, which
+// prints one of them when the tests finish.
+var (
+	testSuccessCriterion = envString("TEST_SUCCESS_CRITERION", criterionExitCode)
+	testPassMarker       = envString("TEST_PASS_MARKER", "BACKENDIM_TEST_RESULT=pass")
+	testFailMarker       = envString("TEST_FAIL_MARKER", "BACKENDIM_TEST_RESULT=fail")
+)
+
+// validateTestCriterion checks that criterion names a known success criterion.
+func validateTestCriterion(criterion string) error {
+	switch criterion {
+	case criterionPhase, criterionExitCode, criterionMarker:
+		return nil
+	}
+	return fmt.Errorf("test success criterion %q must be %q, %q, or %q", criterion, criterionPhase, criterionExitCode, criterionMarker)
+}
+
+// testExitError reports a test container that terminated with a nonzero exit code.
+type testExitError struct {
+	Pod       string
+	Container string
+	ExitCode  int32
+	Reason    string
+}
+
+func (e *testExitError) Error() string {
+	msg := fmt.Sprintf("container %s in pod %s exited with code %d", e.Container, e.Pod, e.ExitCode)
+	if e.Reason != "" {
+		msg += " (" + e.Reason + ")"
+	}
+	return msg
+}
+
+// evaluateTestPod applies the success criterion to a test pod update, reporting whether the
+// outcome is known and, if the tests failed, why.
+func evaluateTestPod(ctx context.Context, pod *corev1.Pod, criterion string) (bool, error) {
+	if criterion == criterionPhase {
+		switch pod.Status.Phase {
+		case corev1.PodRunning, corev1.PodSucceeded:
+			return true, nil
+		case corev1.PodFailed:
+			return true, fmt.Errorf("pod %s in namespace %s has failed", pod.Name, pod.Namespace)
+		}
+		return false, nil
+	}
+
+	// The remaining criteria need every container to have finished.
+	if len(pod.Status.ContainerStatuses) == 0 {
+		return false, nil
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.State.Terminated == nil {
+			if pod.Status.Phase == corev1.PodFailed {
+				return true, fmt.Errorf("pod %s in namespace %s has failed", pod.Name, pod.Namespace)
+			}
+			return false, nil
+		}
+	}
+
+	if criterion == criterionExitCode {
+		for _, cs := range pod.Status.ContainerStatuses {
+			if t := cs.State.Terminated; t.ExitCode != 0 {
+				return true, &testExitError{Pod: pod.Name, Container: cs.Name, ExitCode: t.ExitCode, Reason: t.Reason}
+			}
+		}
+		return true, nil
+	}
+
+	passed := false
+	for _, cs := range pod.Status.ContainerStatuses {
+		logs, err := kubeFor(ctx).CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{Container: cs.Name}).DoRaw(ctx)
+		if err != nil {
+			return true, fmt.Errorf("reading logs of container %s to find the test result: %w", cs.Name, err)
+		}
+		if strings.Contains(string(logs), testFailMarker) {
+			return true, fmt.Errorf("container %s in pod %s reported failing tests", cs.Name, pod.Name)
+		}
+		passed = passed || strings.Contains(string(logs), testPassMarker)
+	}
+	if !passed {
+		return true, fmt.Errorf("pod %s finished without printing the test result marker %q", pod.Name, testPassMarker)
+	}
+	return true, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// terminatedPod returns a test pod in phase whose containers terminated with exitCodes.
+func terminatedPod(phase corev1.PodPhase, exitCodes ...int32) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-app", Namespace: "alice-app"},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+	for i, code := range exitCodes {
+		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, corev1.ContainerStatus{
+			Name:  []string{"test", "sidecar"}[i],
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: code, Reason: "Error"}},
+		})
+	}
+	return pod
+}
+
+func TestEvaluateTestPodExitCode(t *testing.T) {
+	running := terminatedPod(corev1.PodRunning)
+	running.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "test", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}}
+
+	tests := []struct {
+		name     string
+		pod      *corev1.Pod
+		done     bool
+		exitCode int32
+	}{
+		{"passed", terminatedPod(corev1.PodSucceeded, 0), true, 0},
+		{"succeeded with a nonzero exit code", terminatedPod(corev1.PodSucceeded, 3), true, 3},
+		{"failed", terminatedPod(corev1.PodFailed, 1), true, 1},
+		{"sidecar failed", terminatedPod(corev1.PodSucceeded, 0, 2), true, 2},
+		{"still running", running, false, 0},
+		{"no container statuses yet", terminatedPod(corev1.PodPending), false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done, err := evaluateTestPod(context.Background(), tt.pod, criterionExitCode)
+			if done != tt.done {
+				t.Errorf("done = %t, want %t", done, tt.done)
+			}
+			var exitErr *testExitError
+			if tt.exitCode == 0 {
+				if err != nil {
+					t.Errorf("error = %v, want none", err)
+				}
+			} else if !errors.As(err, &exitErr) || exitErr.ExitCode != tt.exitCode {
+				t.Errorf("error = %v, want exit code %d", err, tt.exitCode)
+			}
+		})
+	}
+}
+
+func TestEvaluateTestPodPhase(t *testing.T) {
+	for phase, wantErr := range map[corev1.PodPhase]bool{corev1.PodRunning: false, corev1.PodSucceeded: false, corev1.PodFailed: true} {
+		done, err := evaluateTestPod(context.Background(), terminatedPod(phase), criterionPhase)
+		if !done || (err != nil) != wantErr {
+			t.Errorf("phase %s: evaluateTestPod = %t, %v; want done with failure %t", phase, done, err, wantErr)
+		}
+	}
+	if done, _ := evaluateTestPod(context.Background(), terminatedPod(corev1.PodPending), criterionPhase); done {
+		t.Error("a pending pod was judged")
+	}
+}
+
+func TestEvaluateTestPodMarker(t *testing.T) {
+	useTestEnvironment(t)
+	// The fake clientset's logs never contain the pass marker.
+	done, err := evaluateTestPod(withCluster(context.Background(), primaryCluster), terminatedPod(corev1.PodSucceeded, 0), criterionMarker)
+	if !done || err == nil {
+		t.Errorf("evaluateTestPod = %t, %v; want a failure for the missing marker", done, err)
+	}
+}
+
+func TestSucceededTestPodWithFailingExitCodeFailsDeployment(t *testing.T) {
+	cs, runner := useTestEnvironment(t)
+	runTestPodsAs(cs, runner, terminatedPod(corev1.PodSucceeded, 1).Status)
+	d, done := startTestDeployment(t, nil, DeploymentPayload{UserID: "alice", RepoURL: "https://github.com/a/app", CommitHash: "abcdef1"})
+	waitForFinish(t, done)
+
+	if status := d.status(); status != StatusFailed {
+		t.Errorf("status = %s, want %s", status, StatusFailed)
+	}
+	if e := waitForEvent(t, d, "test_failure"); !strings.Contains(e.Message, "exited with code 1") {
+		t.Errorf("test_failure message %q does not give the exit code", e.Message)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import "time"
+
+// PhaseTiming records when a deployment phase started and ended. A phase that is still
+// running, or was cut short by the deployment stopping, has no end time.
+type PhaseTiming struct {
+	Phase      string    `json:"phase"`
+	StartedAt  time.Time `json:"startedAt"`
+	EndedAt    time.Time `json:"endedAt,omitzero"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+// phaseTimingNames maps the trace span of each deployment phase to the name its timing is
+// reported under.
+var phaseTimingNames = map[string]string{
+	"namespace":    "namespace",
+	"test_deploy":  "test",
+	"test_monitor": "monitor",
+	"prod_deploy":  "prod",
+	"health_check": "health",
+}
+
+// startPhase ends the deployment's current phase, if any, and records the start of the
+// named one.
+func (d *Deployment) startPhase(phase string) {
+	now := time.Now().UTC()
+	d.update(func(rec *DeploymentRecord) {
+		endPhaseTiming(rec, now)
+		rec.Timings = append(rec.Timings, PhaseTiming{Phase: phase, StartedAt: now})
+	})
+}
+
+// endPhase records the end of the deployment's current phase, if one is running.
+func (d *Deployment) endPhase() {
+	now := time.Now().UTC()
+	d.update(func(rec *DeploymentRecord) { endPhaseTiming(rec, now) })
+}
+
+// timings returns a copy of the deployment's phase timings.
+func (d *Deployment) timings() []PhaseTiming {
+	return append([]PhaseTiming(nil), deployments.Record(d).Timings...)
+}
+
+// endPhaseTiming ends the record's last phase at now unless it has already ended.
+func endPhaseTiming(rec *DeploymentRecord, now time.Time) {
+	if n := len(rec.Timings); n > 0 && rec.Timings[n-1].EndedAt.IsZero() {
+		t := &rec.Timings[n-1]
+		t.EndedAt = now
+		t.DurationMs = now.Sub(t.StartedAt).Milliseconds()
+	}
+}
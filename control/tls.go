@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves a certificate from disk, reloading it when either file changes so
+// renewed certificates are picked up without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+// newCertReloader loads the initial certificate, failing if it cannot be read.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.certificate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// certificate returns the current certificate, reloading it if the files have changed since
+// it was loaded. If a reload fails the previous certificate keeps being served.
+func (r *certReloader) certificate() (*tls.Certificate, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return r.fallback(err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert != nil && modTimes == r.modTimes {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			log.Printf("Error reloading TLS certificate, keeping the previous one: %v", err)
+			return r.cert, nil
+		}
+		return nil, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	if r.cert != nil {
+		log.Printf("Reloaded TLS certificate from %s", r.certFile)
+	}
+	r.cert, r.modTimes = &cert, modTimes
+	return r.cert, nil
+}
+
+// fallback returns the previously loaded certificate when the files cannot be read, as
+// happens briefly while a mounted Secret is updated.
+func (r *certReloader) fallback(err error) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert != nil {
+		return r.cert, nil
+	}
+	return nil, fmt.Errorf("loading TLS certificate: %w", err)
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate()
+}
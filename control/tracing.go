@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingEndpoint is the OTLP/HTTP collector deployment traces are exported to, as a URL such
+// as http://otel-collector:4318. Tracing is disabled when it is empty. The exporter's other
+// OTEL_EXPORTER_OTLP_* settings, such as headers and timeouts, are read from the environment.
+var tracingEndpoint = envString("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+
+// tracingServiceName is the service.name resource attribute spans are exported with.
+var tracingServiceName = envString("OTEL_SERVICE_NAME", "backend-im-control")
+
+// tracer creates the spans of the deployment workflow. It uses the global tracer provider,
+// so spans are dropped until initTracing installs an exporting one.
+var tracer = otel.Tracer("mvp/control")
+
+// traceParentField is the W3C trace context header, which clients may also send in a
+// WebSocket deployment request as the field of the same name.
+const traceParentField = "traceparent"
+
+// initTracing installs a tracer provider that batches spans to tracingEndpoint, returning a
+// function that flushes and stops it. Client trace contexts are propagated either way.
+func initTracing(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if tracingEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(tracingEndpoint))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithAttributes(attribute.String("service.name", tracingServiceName)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	log.Printf("Exporting deployment traces to %s", tracingEndpoint)
+	return provider.Shutdown, nil
+}
+
+// traceContextFrom returns a context carrying the client's trace context from a traceparent
+// header, or ctx unchanged if there is none.
+func traceContextFrom(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// deploymentTrace is the root span of a deployment and the span of the phase it is in. Phase
+// spans are children of the root span, one after another.
+type deploymentTrace struct {
+	deployment *Deployment
+	root       trace.Span
+	phase      trace.Span
+	attrs      []attribute.KeyValue
+}
+
+// startDeploymentTrace starts the root span of a deployment as a child of any trace context
+// in ctx, returning ctx with that span.
+func startDeploymentTrace(ctx context.Context, deployment *Deployment) (context.Context, *deploymentTrace) {
+	t := &deploymentTrace{deployment: deployment, attrs: []attribute.KeyValue{
+		attribute.String("deployment.id", deployment.ID),
+		attribute.String("enduser.id", deployment.UserID),
+	}}
+	ctx, t.root = tracer.Start(ctx, "deployment", trace.WithAttributes(t.attrs...))
+	return ctx, t
+}
+
+// setNamespace tags the root span and every later phase with the cluster and namespace the
+// deployment runs in.
+func (t *deploymentTrace) setNamespace(cluster, namespace string) {
+	attrs := []attribute.KeyValue{
+		attribute.String("k8s.cluster.name", cluster),
+		attribute.String("k8s.namespace.name", namespace),
+	}
+	t.attrs = append(t.attrs, attrs...)
+	t.root.SetAttributes(attrs...)
+}
+
+// startPhase ends the current phase's span and starts one for the named phase, returning
+// ctx with the new span so the work done in the phase is traced beneath it. The phase's
+// timing is recorded on the deployment as well.
+func (t *deploymentTrace) startPhase(ctx context.Context, name string) context.Context {
+	if t.phase != nil {
+		t.phase.End()
+	}
+	t.deployment.startPhase(phaseTimingNames[name])
+	ctx, t.phase = tracer.Start(trace.ContextWithSpan(ctx, t.root), name, trace.WithAttributes(t.attrs...))
+	return ctx
+}
+
+// end ends the current phase and the root span, marking both as errors if the deployment
+// did not finish successfully.
+func (t *deploymentTrace) end(status DeploymentStatus) {
+	spans := []trace.Span{t.root}
+	if t.phase != nil {
+		spans = append(spans, t.phase)
+	}
+	for _, span := range spans {
+		span.SetAttributes(attribute.String("deployment.status", string(status)))
+		if status == StatusFailed {
+			span.SetStatus(codes.Error, "deployment failed")
+		}
+	}
+	if t.phase != nil {
+		t.phase.End()
+		t.deployment.endPhase()
+	}
+	t.root.End()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// maxDeploymentTTL bounds the TTL deployments may ask for, set from Config.
+var maxDeploymentTTL time.Duration
+
+// validateTTL checks a requested deployment TTL in seconds, 0 meaning none.
+func validateTTL(seconds int) error {
+	if seconds < 0 {
+		return errors.New("must not be negative")
+	}
+	if ttl := time.Duration(seconds) * time.Second; ttl > maxDeploymentTTL {
+		return fmt.Errorf("TTL %s exceeds the maximum of %s", ttl, maxDeploymentTTL)
+	}
+	return nil
+}
+
+// namespaceExpiry returns when the namespace's deployment asked for it to be deleted, if
+// it asked for a TTL.
+func namespaceExpiry(ns *corev1.Namespace) (time.Time, bool) {
+	value, ok := ns.Annotations[expiresAtAnnotation]
+	if !ok {
+		return time.Time{}, false
+	}
+	expiresAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		slog.Default().Warn("Ignoring invalid namespace expiry", "namespace", ns.Name, "annotation", expiresAtAnnotation, "value", value)
+		return time.Time{}, false
+	}
+	return expiresAt, true
+}
+
+// reportTTLExpired records that the deployment of a namespace deleted for reaching its TTL
+// is deleted, and reports ttl_expired to its subscribers and event history and to its
+// callback URL, if it has one. Reporting is best-effort: failures are only logged.
+func reportTTLExpired(ctx context.Context, ns *corev1.Namespace) {
+	id := ns.Annotations[deploymentIDAnnotation]
+	if id == "" {
+		return
+	}
+	logger := slog.Default().With("deploymentID", id, "namespace", ns.Name)
+	markDeploymentDeleted(ctx, logger, id)
+
+	event := Event{Event: "ttl_expired", DeploymentID: id,
+		Message: fmt.Sprintf("Deployment %s reached its TTL; namespace %s is being deleted", id, ns.Name)}
+	if l, err := eventLogFor(id, ns.Annotations[userIDAnnotation]); err == nil {
+		l.publish(logger, event)
+	} else if events, err := deploymentStore.Events(ctx, id, 0); err != nil {
+		logger.Error("Error loading deployment events", "error", err)
+	} else {
+		event.Seq, event.Timestamp = 1, time.Now().UTC()
+		if len(events) > 0 {
+			event.Seq = events[len(events)-1].Seq + 1
+		}
+		if err := deploymentStore.AppendEvent(ctx, id, event); err != nil {
+			logger.Error("Error persisting deployment event", "error", err)
+		}
+	}
+
+	if target := ns.Annotations[callbackURLAnnotation]; target != "" && len(callbackSecret) > 0 {
+		go deliverCallback(context.WithoutCancel(ctx), logger, target, callbackPayload{
+			Event:        "ttl_expired",
+			DeploymentID: id,
+			Status:       StatusDeleted,
+			RepoURL:      ns.Annotations[repoURLAnnotation],
+			CommitHash:   ns.Annotations[commitHashAnnotation],
+			FinishedAt:   time.Now().UTC(),
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateTTL(t *testing.T) {
+	maxDeploymentTTL = time.Hour
+	tests := []struct {
+		seconds int
+		ok      bool
+	}{
+		{0, true},
+		{60, true},
+		{3600, true},
+		{3601, false},
+		{-1, false},
+	}
+	for _, tt := range tests {
+		if err := validateTTL(tt.seconds); (err == nil) != tt.ok {
+			t.Errorf("validateTTL(%d) = %v, want ok %t", tt.seconds, err, tt.ok)
+		}
+	}
+}
+
+func TestNamespaceExpiry(t *testing.T) {
+	expiresAt := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	owner := namespaceOwner{DeploymentID: "d1", ExpiresAt: expiresAt}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns", Annotations: owner.annotations()}}
+	if got, ok := namespaceExpiry(ns); !ok || !got.Equal(expiresAt) {
+		t.Errorf("namespaceExpiry = %v, %t; want %v, true", got, ok, expiresAt)
+	}
+
+	for name, annotations := range map[string]map[string]string{
+		"no TTL":  (namespaceOwner{DeploymentID: "d1"}).annotations(),
+		"invalid": {expiresAtAnnotation: "tomorrow"},
+	} {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns", Annotations: annotations}}
+		if got, ok := namespaceExpiry(ns); ok {
+			t.Errorf("%s: namespaceExpiry = %v, true; want false", name, got)
+		}
+	}
+}
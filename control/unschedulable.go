@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// unschedulableGrace is how long a pod may stay unschedulable before the deployment fails
+// on it, set from Config. The scheduler retries as nodes free up or scale up, so a pod may
+// be briefly unschedulable while the cluster makes room.
+var unschedulableGrace time.Duration
+
+// unschedulableError reports a pod the scheduler could not place on any node.
+type unschedulableError struct {
+	Pod string
+	// Message is the scheduler's reason, such as "0/3 nodes are available: 3 Insufficient
+	// cpu."
+	Message string
+	Since   time.Time
+}
+
+func (e *unschedulableError) Error() string {
+	return fmt.Sprintf("pod %s cannot be scheduled and has been pending for %s: %s", e.Pod, time.Since(e.Since).Round(time.Second), e.Message)
+}
+
+// podUnschedulable returns the pod's unschedulable error if the scheduler has reported it
+// unschedulable for at least unschedulableGrace as of now, and nil otherwise.
+func podUnschedulable(pod *corev1.Pod, now time.Time) *unschedulableError {
+	if pod.Status.Phase != corev1.PodPending || pod.DeletionTimestamp != nil {
+		return nil
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type != corev1.PodScheduled || c.Status != corev1.ConditionFalse || c.Reason != corev1.PodReasonUnschedulable {
+			continue
+		}
+		since := c.LastTransitionTime.Time
+		if since.IsZero() {
+			since = pod.CreationTimestamp.Time
+		}
+		if now.Sub(since) < unschedulableGrace {
+			return nil
+		}
+		return &unschedulableError{Pod: pod.Name, Message: c.Message, Since: since}
+	}
+	return nil
+}
+
+// watchUnschedulable polls the namespace's pods selected by opts until ctx is done, calling
+// fail with the first that has stayed unschedulable past unschedulableGrace. The scheduler
+// sets the pod's condition once and need not update it again, so waiting on a pod watch
+// alone would not notice the grace running out.
+func watchUnschedulable(ctx context.Context, namespace string, opts metav1.ListOptions, fail func(*unschedulableError)) {
+	backoff := newPollBackoff(monitorPollInterval)
+	for {
+		list, err := kubeFor(ctx).CoreV1().Pods(namespace).List(ctx, opts)
+		if err == nil {
+			now := time.Now()
+			for i := range list.Items {
+				if uerr := podUnschedulable(&list.Items[i], now); uerr != nil {
+					fail(uerr)
+					return
+				}
+			}
+		} else if ctx.Err() == nil {
+			loggerFrom(ctx).Error("Error listing pods for scheduling failures", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff.next()):
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func pendingPod(name string, unschedulableFor time.Duration) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ns"},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodPending,
+			Conditions: []corev1.PodCondition{{
+				Type:               corev1.PodScheduled,
+				Status:             corev1.ConditionFalse,
+				Reason:             corev1.PodReasonUnschedulable,
+				Message:            "0/3 nodes are available: 3 Insufficient cpu.",
+				LastTransitionTime: metav1.NewTime(time.Now().Add(-unschedulableFor)),
+			}},
+		},
+	}
+}
+
+func withUnschedulableGrace(t *testing.T, grace time.Duration) {
+	t.Helper()
+	oldGrace, oldPoll := unschedulableGrace, monitorPollInterval
+	unschedulableGrace, monitorPollInterval = grace, 20*time.Millisecond
+	t.Cleanup(func() { unschedulableGrace, monitorPollInterval = oldGrace, oldPoll })
+}
+
+func TestPodUnschedulable(t *testing.T) {
+	withUnschedulableGrace(t, 30*time.Second)
+	now := time.Now()
+	running := pendingPod("running", time.Minute)
+	running.Status.Phase = corev1.PodRunning
+
+	if err := podUnschedulable(pendingPod("new", 5*time.Second), now); err != nil {
+		t.Errorf("pod unschedulable for 5s failed within the grace: %v", err)
+	}
+	if err := podUnschedulable(running, now); err != nil {
+		t.Errorf("running pod reported unschedulable: %v", err)
+	}
+	err := podUnschedulable(pendingPod("stuck", time.Minute), now)
+	if err == nil || err.Message != "0/3 nodes are available: 3 Insufficient cpu." {
+		t.Errorf("podUnschedulable = %v, want the scheduler's message", err)
+	}
+}
+
+func TestMonitorTestPodFailsOnUnschedulablePod(t *testing.T) {
+	withUnschedulableGrace(t, 50*time.Millisecond)
+	cs := fake.NewSimpleClientset(pendingPod("test-app", 0))
+	ctx := withCluster(context.Background(), &cluster{Name: "test", Client: cs})
+
+	started := time.Now()
+	ok, err := monitorTestPod(ctx, "ns", "test-app", monitorOptions{Timeout: 10 * time.Second, PollInterval: time.Second, SuccessCriterion: "phase"})
+	var uerr *unschedulableError
+	if ok || !errors.As(err, &uerr) {
+		t.Fatalf("monitorTestPod = %t, %v; want an unschedulable error", ok, err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("took %s to detect the unschedulable pod", elapsed)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// sshRepoURLPattern matches scp-style SSH git URLs such as git@github.com:owner/repo.git.
+var sshRepoURLPattern = regexp.MustCompile(`^git@([A-Za-z0-9.-]+):([A-Za-z0-9._-]+/)*[A-Za-z0-9._-]+$`)
+
+// commitHashPattern matches abbreviated or full hexadecimal git object names.
+var commitHashPattern = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
+
+// envKeyPattern matches valid environment variable names.
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedEnvKeys are variables the platform or runtime controls and users may not override.
+var reservedEnvKeys = map[string]bool{
+	"PATH":            true,
+	"HOME":            true,
+	"HOSTNAME":        true,
+	"USER":            true,
+	"SHELL":           true,
+	"PWD":             true,
+	"LD_PRELOAD":      true,
+	"LD_LIBRARY_PATH": true,
+}
+
+// reservedEnvPrefixes are prefixes of variables injected by Kubernetes or this service.
+var reservedEnvPrefixes = []string{"KUBERNETES_", "BACKENDIM_"}
+
+// validateRepoURL accepts https and git@ SSH repository URLs that point at public hosts,
+// rejecting other schemes, embedded credentials, localhost, and internal IP addresses.
+func validateRepoURL(repoURL string) error {
+	if repoURL == "" {
+		return errors.New("repository URL is required")
+	}
+
+	var host string
+	if m := sshRepoURLPattern.FindStringSubmatch(repoURL); m != nil {
+		host = m[1]
+	} else {
+		u, err := url.Parse(repoURL)
+		if err != nil {
+			return fmt.Errorf("malformed repository URL: %w", err)
+		}
+		if u.Scheme != "https" {
+			return fmt.Errorf("unsupported repository URL scheme %q: only https and git@ SSH URLs are allowed", u.Scheme)
+		}
+		if u.User != nil {
+			return errors.New("repository URL must not contain credentials")
+		}
+		if u.RawQuery != "" || u.Fragment != "" {
+			return errors.New("repository URL must not contain a query or fragment")
+		}
+		if u.Path == "" || u.Path == "/" {
+			return errors.New("repository URL must include a repository path")
+		}
+		host = u.Hostname()
+	}
+	return validateRepoHost(host)
+}
+
+// validateRepoHost rejects hosts that refer to the local machine or private networks.
+func validateRepoHost(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return errors.New("repository URL must include a host")
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || strings.HasSuffix(host, ".local") || strings.HasSuffix(host, ".internal") {
+		return fmt.Errorf("host %q is not allowed", host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+			return fmt.Errorf("host %s is an internal address", host)
+		}
+	}
+	return nil
+}
+
+// validateCommitHash accepts 7 to 40 character hexadecimal commit hashes.
+func validateCommitHash(commitHash string) error {
+	if !commitHashPattern.MatchString(commitHash) {
+		return fmt.Errorf("commit hash %q must be 7 to 40 hexadecimal characters", commitHash)
+	}
+	return nil
+}
+
+// generatedHostPattern matches labels containing the 8 hex digit hash segment that every
+// generated hostname has, so custom subdomains cannot shadow them.
+var generatedHostPattern = regexp.MustCompile(`(^|-)[0-9a-f]{8}(-|$)`)
+
+// validateSubdomain checks that a custom subdomain is a single DNS label that cannot be
+// mistaken for a generated hostname.
+func validateSubdomain(subdomain string) error {
+	if errs := validation.IsDNS1123Label(subdomain); len(errs) > 0 {
+		return fmt.Errorf("subdomain %q is invalid: %s", subdomain, strings.Join(errs, "; "))
+	}
+	if generatedHostPattern.MatchString(subdomain) {
+		return fmt.Errorf("subdomain %q is reserved: labels of 8 hex digits are used by generated hostnames", subdomain)
+	}
+	return nil
+}
+
+// validatePodName checks that name is a legal Kubernetes pod name.
+func validatePodName(name string) error {
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return fmt.Errorf("pod name %q is invalid: %s", name, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// maxTestCommandBytes bounds the size of a deployment's test command.
+const maxTestCommandBytes = 4096
+
+// validateTestCommand checks the payload's optional test command and timeout. The timeout
+// must leave the test pod monitor time to see the result.
+func validateTestCommand(payload DeploymentPayload, monitor monitorOptions) error {
+	if len(payload.TestCommand) > maxTestCommandBytes {
+		return fmt.Errorf("test command exceeds %d bytes", maxTestCommandBytes)
+	}
+	if !utf8.ValidString(payload.TestCommand) || strings.ContainsRune(payload.TestCommand, 0) {
+		return errors.New("test command must be valid UTF-8 text without NUL characters")
+	}
+	if payload.TestCommand != "" && strings.TrimSpace(payload.TestCommand) == "" {
+		return errors.New("test command must not be blank")
+	}
+	if payload.TestTimeoutSeconds < 0 {
+		return errors.New("test timeout must not be negative")
+	}
+	if timeout := time.Duration(payload.TestTimeoutSeconds) * time.Second; timeout > monitor.Timeout {
+		return fmt.Errorf("test timeout %s exceeds the monitor timeout %s", timeout, monitor.Timeout)
+	}
+	return nil
+}
+
+// validateEnv checks that every key is a valid, non-reserved environment variable name.
+func validateEnv(env map[string]string) error {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !envKeyPattern.MatchString(key) {
+			return fmt.Errorf("environment variable name %q is invalid", key)
+		}
+		upper := strings.ToUpper(key)
+		if reservedEnvKeys[upper] {
+			return fmt.Errorf("environment variable %s is reserved", key)
+		}
+		for _, prefix := range reservedEnvPrefixes {
+			if strings.HasPrefix(upper, prefix) {
+				return fmt.Errorf("environment variable %s uses reserved prefix %s", key, prefix)
+			}
+		}
+	}
+	return nil
+}
+
+// payloadErrors lists every problem found in a deployment payload, one entry per field.
+type payloadErrors []string
+
+// check records err, if not nil, against the named field.
+func (e *payloadErrors) check(field string, err error) {
+	if err != nil {
+		*e = append(*e, field+": "+err.Error())
+	}
+}
+
+func (e payloadErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// validatedPayload holds the settings resolved from a payload that passed validatePayload.
+type validatedPayload struct {
+	TestPodName string
+	Resources   prodResources
+	HealthCheck healthCheck
+	Autoscale   autoscaleOptions
+	Monitor     monitorOptions
+	DeployType  string
+	Canary      canaryOptions
+	Cluster     *cluster
+}
+
+// validatePayload checks that the required fields of a deployment payload are present and
+// that every field is well formed, before anything touches the cluster. All problems are
+// reported together as a payloadErrors.
+func validatePayload(payload DeploymentPayload) (validatedPayload, error) {
+	var errs payloadErrors
+	if strings.TrimSpace(payload.UserID) == "" {
+		errs.check("userID", errors.New("user ID is required"))
+	}
+	if payload.Image != "" {
+		errs.check("image", validatePrebuiltPayload(payload))
+	} else {
+		errs.check("repoURL", validateRepoURL(payload.RepoURL))
+		errs.check("revision", validateRevision(payload))
+	}
+
+	v := validatedPayload{TestPodName: payload.TestPodName}
+	if v.TestPodName == "" {
+		v.TestPodName = defaultTestPodName
+	}
+	errs.check("testPodName", validatePodName(v.TestPodName))
+	errs.check("env", validateEnv(payload.Env))
+	errs.check("secrets", validateEnv(payload.Secrets))
+	if payload.Subdomain != "" {
+		errs.check("subdomain", validateSubdomain(payload.Subdomain))
+	}
+	if payload.CustomDomain != "" {
+		errs.check("customDomain", validateCustomDomain(payload.CustomDomain))
+	}
+	if payload.CallbackURL != "" {
+		errs.check("callbackURL", validateCallbackURL(payload.CallbackURL))
+	}
+	errs.check("ttlSeconds", validateTTL(payload.TTLSeconds))
+
+	var err error
+	v.Resources, err = resolveProdResources(payload)
+	errs.check("resources", err)
+	v.HealthCheck, err = resolveHealthCheck(payload)
+	errs.check("health check", err)
+	v.Monitor, err = resolveMonitorOptions(payload)
+	errs.check("monitoring options", err)
+	errs.check("testCommand", validateTestCommand(payload, v.Monitor))
+	v.DeployType, err = resolveDeployType(payload)
+	errs.check("deployType", err)
+	if v.DeployType == DeployTypeHelm && payload.CustomDomain != "" {
+		errs.check("customDomain", errors.New("custom domains are not supported for helm deployments"))
+	}
+	if v.DeployType == DeployTypeHelm && payload.Image != "" {
+		errs.check("image", errors.New("prebuilt images cannot be deployed as helm charts"))
+	}
+	v.Autoscale, err = resolveAutoscaleOptions(payload, v.Resources, v.DeployType)
+	errs.check("autoscaling", err)
+	v.Canary, err = resolveCanaryOptions(payload)
+	errs.check("canary options", err)
+	v.Cluster, err = resolveCluster(payload.Cluster)
+	errs.check("cluster", err)
+
+	if len(errs) > 0 {
+		return validatedPayload{}, errs
+	}
+	return v, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/gorilla/websocket"
+)
+
+// closeReasonFor returns the close code and reason to close a connection with after
+// reading from it failed with err, so clients can tell why they were disconnected and
+// whether reconnecting can help. It reports false when no close frame should be sent: the
+// client closed the connection itself, and it has already been answered.
+func closeReasonFor(err error) (code int, reason string, ok bool) {
+	var closeErr *websocket.CloseError
+	var netErr net.Error
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &closeErr):
+		return 0, "", false
+	case errors.Is(err, websocket.ErrReadLimit):
+		return websocket.CloseMessageTooBig, fmt.Sprintf("message exceeds the %d byte limit", wsMaxMessageBytes), true
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return websocket.CloseGoingAway, "no message or pong received in time", true
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return websocket.CloseInvalidFramePayloadData, "message is not a valid JSON request", true
+	}
+	return websocket.CloseInternalServerErr, "failed to read from the connection", true
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// signTestToken returns a client token for subject that expires after ttl.
+func signTestToken(t *testing.T, subject string, ttl time.Duration) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   subject,
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+	}).SignedString(jwtSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// dialTestServer connects to a server running wsHandler with a token expiring after ttl.
+// Messages are sent in a single frame of up to 1 MiB, as browsers send them.
+func dialTestServer(t *testing.T, srv *httptest.Server, ttl time.Duration) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?token=" + signTestToken(t, "user-1", ttl)
+	dialer := websocket.Dialer{WriteBufferSize: 1 << 20}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readCloseCode reads from conn until the server closes it and returns the close code.
+func readCloseCode(t *testing.T, conn *websocket.Conn) int {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) {
+			t.Fatalf("connection ended without a close frame: %v", err)
+		}
+		return closeErr.Code
+	}
+}
+
+func newWebSocketTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	useTestConfig()
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestWebSocketClosesOversizedMessage(t *testing.T) {
+	srv := newWebSocketTestServer(t)
+	conn := dialTestServer(t, srv, time.Hour)
+	if err := conn.WriteMessage(websocket.TextMessage, make([]byte, 5*wsMaxMessageBytes)); err != nil {
+		t.Fatal(err)
+	}
+	if code := readCloseCode(t, conn); code != websocket.CloseMessageTooBig {
+		t.Errorf("close code = %d, want %d", code, websocket.CloseMessageTooBig)
+	}
+}
+
+// readEvent reads the next event the server sends on conn.
+func readEvent(t *testing.T, conn *websocket.Conn) Event {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var e Event
+	if err := conn.ReadJSON(&e); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestWebSocketRejectsLargeMessage(t *testing.T) {
+	srv := newWebSocketTestServer(t)
+	conn := dialTestServer(t, srv, time.Hour)
+	// The connection stays usable after a message over the limit, but under the close limit.
+	for range 2 {
+		if err := conn.WriteMessage(websocket.TextMessage, make([]byte, 2*wsMaxMessageBytes)); err != nil {
+			t.Fatal(err)
+		}
+		if e := readEvent(t, conn); e.Event != "payload_too_large" || e.Code != codePayloadTooLarge {
+			t.Fatalf("server answered %s (%s), want payload_too_large", e.Event, e.Code)
+		}
+	}
+}
+
+func TestWebSocketClosesOnTokenExpiry(t *testing.T) {
+	srv := newWebSocketTestServer(t)
+	conn := dialTestServer(t, srv, 2*time.Second)
+	if code := readCloseCode(t, conn); code != websocket.ClosePolicyViolation {
+		t.Errorf("close code = %d, want %d", code, websocket.ClosePolicyViolation)
+	}
+}
+
+func TestWebSocketClosesOnShutdown(t *testing.T) {
+	srv := newWebSocketTestServer(t)
+	conn := dialTestServer(t, srv, time.Hour)
+	// The connection is tracked once the handler has taken it over.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		connectionsMu.Lock()
+		n := len(connections)
+		connectionsMu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection was never tracked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Cleanup(func() {
+		shutdownMu.Lock()
+		shuttingDown = false
+		shutdownMu.Unlock()
+	})
+	shutdown(srv.Config)
+	if code := readCloseCode(t, conn); code != websocket.CloseGoingAway {
+		t.Errorf("close code = %d, want %d", code, websocket.CloseGoingAway)
+	}
+}
+
+func TestCloseReasonFor(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code int
+		ok   bool
+	}{
+		{"client closed", &websocket.CloseError{Code: websocket.CloseNormalClosure}, 0, false},
+		{"read limit", websocket.ErrReadLimit, websocket.CloseMessageTooBig, true},
+		{"malformed JSON", readJSONError(`{"action":`), websocket.CloseInvalidFramePayloadData, true},
+		{"other", errors.New("broken pipe"), websocket.CloseInternalServerErr, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, ok := closeReasonFor(tt.err)
+			if code != tt.code || ok != tt.ok {
+				t.Errorf("closeReasonFor(%v) = %d, %t; want %d, %t", tt.err, code, ok, tt.code, tt.ok)
+			}
+		})
+	}
+}
+
+// readJSONError returns the error decoding data as a client message.
+func readJSONError(data string) error {
+	var msg ClientMessage
+	return json.Unmarshal([]byte(data), &msg)
+}